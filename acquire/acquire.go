@@ -0,0 +1,30 @@
+// Package acquire has what the Acquire APIs of all algorithms share. Every
+// algorithm returns these errors, so callers tell them apart with one
+// errors.Is, whichever algorithm they run.
+package acquire
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// TryTimeout is how long TryAcquire waits for CS before giving up. Getting in
+// takes at least a round of messages, so TryAcquire can't return at once.
+var TryTimeout = 100 * time.Millisecond
+
+var ErrBusy = errors.New("CS is already requested by this node")
+var ErrNotInCS = errors.New("not in CS")
+var ErrClosed = errors.New("node is closed")
+
+// Try calls acquire with a context which is done after TryTimeout. It returns
+// false, and no error, if CS was not granted in time.
+func Try(acquire func(ctx context.Context) error) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), TryTimeout)
+	defer cancel()
+	err := acquire(ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return false, nil
+	}
+	return err == nil, err
+}
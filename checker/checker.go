@@ -0,0 +1,235 @@
+// Package checker watches a mutual exclusion run and reports when algorithms
+// break their promises. Every request, entry and exit is recorded with node id,
+// CSID and logical time of the request, and checked against
+//
+//   - mutual exclusion: no more than Capacity nodes in CS at once
+//   - group exclusion: with Group, only nodes of same CSID in CS at once
+//   - starvation: every request is granted within Starvation
+//   - order: with Ordered, requests are granted in (logical time, id) order
+//
+// Record requests after AskToEnterCS returns, entries after EnterCS and exits
+// before ExitCS. Then the checker never sees more than really happened, so a
+// reported violation really happened.
+package checker
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrMutualExclusion = errors.New("mutual exclusion violated")
+var ErrGroupExclusion = errors.New("different CSIDs in CS at once")
+var ErrStarvation = errors.New("request not granted in time")
+var ErrOrder = errors.New("request granted out of timestamp order")
+
+type RecordType string
+
+const (
+	RecordRequest RecordType = "request"
+	RecordEnter   RecordType = "enter"
+	RecordExit    RecordType = "exit"
+)
+
+// Record is one event of a run
+type Record struct {
+	Type RecordType
+	Node int
+	CSID string
+	Time uint          // logical time of the request. 0 for algorithms without clock
+	At   time.Duration // since start of the run, on wall clock or virtual clock
+}
+
+func (r Record) String() string {
+	return fmt.Sprintf("%v %s node %d CSID %q time %d", r.At, r.Type, r.Node, r.CSID, r.Time)
+}
+
+// Violation is a broken invariant. Record is the event which broke it.
+type Violation struct {
+	Err    error
+	Record Record
+	Detail string
+}
+
+func (v Violation) Error() string {
+	return fmt.Sprintf("%v at %v: %s", v.Err, v.Record.At, v.Detail)
+}
+
+func (v Violation) Unwrap() error {
+	return v.Err
+}
+
+type Config struct {
+	Capacity   int           // nodes in CS at once. 0 means 1, or no limit with Group
+	Group      bool          // nodes of same CSID may share CS, like K-entry algorithms and joung
+	Starvation time.Duration // bound for a request to be granted. 0 means no bound
+	Ordered    bool          // CS is granted in order of requests, like lamport
+}
+
+// Clocked is an algorithm with logical clock
+type Clocked interface {
+	RequestTime() uint
+}
+
+// RequestTime is logical time of node's request, or 0 if node has no clock
+func RequestTime(node interface{}) uint {
+	if c, ok := node.(Clocked); ok {
+		return c.RequestTime()
+	}
+	return 0
+}
+
+type Checker struct {
+	config     Config
+	records    []Record
+	waiting    map[int]Record // requests not granted yet
+	inCS       map[int]Record
+	violations []Violation
+	lock       *sync.Mutex
+}
+
+func New(config Config) *Checker {
+	if config.Capacity == 0 && !config.Group {
+		config.Capacity = 1
+	}
+	return &Checker{
+		config:  config,
+		waiting: map[int]Record{},
+		inCS:    map[int]Record{},
+		lock:    &sync.Mutex{},
+	}
+}
+
+// Request records a request. It returns nil, violations only happen on entry.
+func (c *Checker) Request(node int, CSID string, requestTime uint, at time.Duration) error {
+	return c.Record(Record{Type: RecordRequest, Node: node, CSID: CSID, Time: requestTime, At: at})
+}
+
+// Enter records an entry and returns the first invariant it broke, if any
+func (c *Checker) Enter(node int, CSID string, requestTime uint, at time.Duration) error {
+	return c.Record(Record{Type: RecordEnter, Node: node, CSID: CSID, Time: requestTime, At: at})
+}
+
+func (c *Checker) Exit(node int, CSID string, requestTime uint, at time.Duration) error {
+	return c.Record(Record{Type: RecordExit, Node: node, CSID: CSID, Time: requestTime, At: at})
+}
+
+// Record records r and returns the first invariant it broke, if any
+func (c *Checker) Record(r Record) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.records = append(c.records, r)
+
+	n := len(c.violations)
+	switch r.Type {
+	case RecordRequest:
+		c.waiting[r.Node] = r
+	case RecordEnter:
+		c.enter(r)
+	case RecordExit:
+		delete(c.inCS, r.Node)
+	}
+	if len(c.violations) > n {
+		return c.violations[n]
+	}
+	return nil
+}
+
+// enter expects c.lock to be held
+func (c *Checker) enter(r Record) {
+	request, requested := c.waiting[r.Node]
+	delete(c.waiting, r.Node)
+
+	others := c.sorted(c.inCS)
+	if c.config.Capacity > 0 && len(others) >= c.config.Capacity {
+		c.violate(ErrMutualExclusion, r, "%d entered while %v are in CS", r.Node, ids(others))
+	}
+	if c.config.Group {
+		for _, o := range others {
+			if o.CSID != r.CSID {
+				c.violate(ErrGroupExclusion, r, "%d entered %q while %d is in %q", r.Node, r.CSID, o.Node, o.CSID)
+				break
+			}
+		}
+	}
+	if requested && c.config.Starvation > 0 && r.At-request.At > c.config.Starvation {
+		c.violate(ErrStarvation, r, "%d waited %v for CS", r.Node, r.At-request.At)
+	}
+	if c.config.Ordered {
+		for _, w := range c.sorted(c.waiting) {
+			if before(w, r) {
+				c.violate(ErrOrder, r, "%d entered with request time %d while %d waits with %d", r.Node, r.Time, w.Node, w.Time)
+				break
+			}
+		}
+	}
+	c.inCS[r.Node] = r
+}
+
+// before tells if request a comes before request b in (logical time, id) order
+func before(a Record, b Record) bool {
+	return a.Time < b.Time || (a.Time == b.Time && a.Node < b.Node)
+}
+
+// Finish ends the run at `at`. Requests still waiting then were never granted,
+// they are reported as starved.
+func (c *Checker) Finish(at time.Duration) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	n := len(c.violations)
+	for _, w := range c.sorted(c.waiting) {
+		c.violate(ErrStarvation, w, "%d waited %v for CS and was never granted", w.Node, at-w.At)
+	}
+	if len(c.violations) > n {
+		return c.violations[n]
+	}
+	return nil
+}
+
+// violate expects c.lock to be held
+func (c *Checker) violate(err error, r Record, format string, v ...interface{}) {
+	c.violations = append(c.violations, Violation{Err: err, Record: r, Detail: fmt.Sprintf(format, v...)})
+}
+
+// sorted returns records in id order, so violations read the same every run
+func (c *Checker) sorted(records map[int]Record) []Record {
+	sorted := []Record{}
+	for _, r := range records {
+		sorted = append(sorted, r)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Node < sorted[j].Node })
+	return sorted
+}
+
+func ids(records []Record) []int {
+	ids := []int{}
+	for _, r := range records {
+		ids = append(ids, r.Node)
+	}
+	return ids
+}
+
+// Records returns everything recorded so far, in the order it was recorded
+func (c *Checker) Records() []Record {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]Record{}, c.records...)
+}
+
+func (c *Checker) Violations() []Violation {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]Violation{}, c.violations...)
+}
+
+// Err returns the first violation, or nil if there was none
+func (c *Checker) Err() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.violations) == 0 {
+		return nil
+	}
+	return c.violations[0]
+}
@@ -0,0 +1,104 @@
+package checker
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func request(node int, CSID string, t uint, at time.Duration) Record {
+	return Record{Type: RecordRequest, Node: node, CSID: CSID, Time: t, At: at}
+}
+
+func enter(node int, CSID string, t uint, at time.Duration) Record {
+	return Record{Type: RecordEnter, Node: node, CSID: CSID, Time: t, At: at}
+}
+
+func exit(node int, CSID string, t uint, at time.Duration) Record {
+	return Record{Type: RecordExit, Node: node, CSID: CSID, Time: t, At: at}
+}
+
+func TestViolations(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		config  Config
+		records []Record
+		finish  time.Duration // Finish is called at this time if not 0
+		want    error         // first violation. nil if there is none
+	}{
+		{"one at a time", Config{}, []Record{
+			request(0, "", 1, 0), request(1, "", 2, 0),
+			enter(0, "", 1, 1), exit(0, "", 1, 2),
+			enter(1, "", 2, 3), exit(1, "", 2, 4),
+		}, 0, nil},
+		{"two in CS", Config{}, []Record{
+			request(0, "", 1, 0), request(1, "", 2, 0),
+			enter(0, "", 1, 1), enter(1, "", 2, 2),
+		}, 0, ErrMutualExclusion},
+		{"within capacity", Config{Capacity: 2}, []Record{
+			request(0, "", 1, 0), request(1, "", 2, 0),
+			enter(0, "", 1, 1), enter(1, "", 2, 2),
+		}, 0, nil},
+		{"over capacity", Config{Capacity: 2}, []Record{
+			enter(0, "", 1, 1), enter(1, "", 2, 2), enter(2, "", 3, 3),
+		}, 0, ErrMutualExclusion},
+		{"group shares CS", Config{Group: true}, []Record{
+			enter(0, "east", 0, 1), enter(1, "east", 0, 2), enter(2, "east", 0, 3),
+		}, 0, nil},
+		{"groups meet", Config{Group: true}, []Record{
+			enter(0, "east", 0, 1), enter(1, "west", 0, 2),
+		}, 0, ErrGroupExclusion},
+		{"groups take turns", Config{Group: true}, []Record{
+			enter(0, "east", 0, 1), exit(0, "east", 0, 2), enter(1, "west", 0, 3),
+		}, 0, nil},
+		{"group over capacity", Config{Group: true, Capacity: 1}, []Record{
+			enter(0, "east", 0, 1), enter(1, "east", 0, 2),
+		}, 0, ErrMutualExclusion},
+		{"granted in time", Config{Starvation: time.Second}, []Record{
+			request(0, "", 1, 0), enter(0, "", 1, time.Second),
+		}, 0, nil},
+		{"granted late", Config{Starvation: time.Second}, []Record{
+			request(0, "", 1, 0), enter(0, "", 1, 2*time.Second),
+		}, 0, ErrStarvation},
+		{"never granted", Config{}, []Record{
+			request(0, "", 1, 0), request(1, "", 2, 0), enter(0, "", 1, 1),
+		}, time.Minute, ErrStarvation},
+		{"in order", Config{Ordered: true}, []Record{
+			request(0, "", 2, 0), request(1, "", 1, 0),
+			enter(1, "", 1, 1), exit(1, "", 1, 2), enter(0, "", 2, 3),
+		}, 0, nil},
+		{"out of order", Config{Ordered: true}, []Record{
+			request(0, "", 2, 0), request(1, "", 1, 0), enter(0, "", 2, 1),
+		}, 0, ErrOrder},
+		{"same time, lower id first", Config{Ordered: true}, []Record{
+			request(0, "", 1, 0), request(1, "", 1, 0), enter(1, "", 1, 1),
+		}, 0, ErrOrder},
+		{"order not checked", Config{}, []Record{
+			request(0, "", 2, 0), request(1, "", 1, 0), enter(0, "", 2, 1),
+		}, 0, nil},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			checker := New(c.config)
+			var first error
+			for _, r := range c.records {
+				if err := checker.Record(r); err != nil && first == nil {
+					first = err
+				}
+			}
+			if c.finish != 0 {
+				if err := checker.Finish(c.finish); err != nil && first == nil {
+					first = err
+				}
+			}
+			if !errors.Is(first, c.want) {
+				t.Fatalf("got %v, want %v", first, c.want)
+			}
+			if err := checker.Err(); !errors.Is(err, c.want) {
+				t.Fatalf("Err returned %v, want %v", err, c.want)
+			}
+			if got := len(checker.Records()); got != len(c.records) {
+				t.Fatalf("%d records, want %d", got, len(c.records))
+			}
+		})
+	}
+}
@@ -0,0 +1,16 @@
+package checker
+
+import "distributed-lock-example/simulator"
+
+// Observe records an event of a simulated run. pass it to Sim.Observe.
+// violations can be read after the run with Err or Violations.
+func (c *Checker) Observe(e simulator.Event) {
+	switch e.Type {
+	case simulator.EventRequest:
+		c.Request(e.Node, e.CSID, e.RequestTime, e.Time)
+	case simulator.EventEnter:
+		c.Enter(e.Node, e.CSID, e.RequestTime, e.Time)
+	case simulator.EventExit:
+		c.Exit(e.Node, e.CSID, e.RequestTime, e.Time)
+	}
+}
@@ -0,0 +1,88 @@
+package clock
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Timestamp of a hybrid logical clock. Wall is the largest wall clock time
+// seen, in nanoseconds since the epoch. Logical orders events with same Wall.
+type Timestamp struct {
+	Wall    int64  `json:"wall"`
+	Logical uint32 `json:"logical"`
+}
+
+// Compare returns -1 if t is before other, 1 if after and 0 if they are equal
+func (t Timestamp) Compare(other Timestamp) int {
+	switch {
+	case t.Wall < other.Wall || (t.Wall == other.Wall && t.Logical < other.Logical):
+		return -1
+	case t == other:
+		return 0
+	}
+	return 1
+}
+
+func (t Timestamp) String() string {
+	return fmt.Sprintf("%s.%d", time.Unix(0, t.Wall).UTC().Format("15:04:05.000000"), t.Logical)
+}
+
+// HLC is a hybrid logical clock. Its timestamps are never behind wall clock
+// time, and a receive is always stamped after the send, even if the clock of
+// the sender runs ahead.
+type HLC struct {
+	now  func() time.Time
+	lock *sync.Mutex
+	last Timestamp
+}
+
+// NewHLC reads wall clock time with now, or time.Now if now is nil. A
+// simulator passes its virtual clock.
+func NewHLC(now func() time.Time) *HLC {
+	if now == nil {
+		now = time.Now
+	}
+	return &HLC{now: now, lock: &sync.Mutex{}}
+}
+
+// Time returns the last timestamp handed out
+func (c *HLC) Time() Timestamp {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.last
+}
+
+// Tick stamps a local event, like sending a message
+func (c *HLC) Tick() Timestamp {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	wall := c.now().UnixNano()
+	if wall > c.last.Wall {
+		c.last = Timestamp{Wall: wall}
+	} else {
+		c.last.Logical++
+	}
+	return c.last
+}
+
+// Receive stamps receiving a message stamped with t
+func (c *HLC) Receive(t Timestamp) Timestamp {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	wall := c.now().UnixNano()
+	switch {
+	case wall > c.last.Wall && wall > t.Wall:
+		c.last = Timestamp{Wall: wall}
+	case c.last.Wall == t.Wall:
+		if t.Logical > c.last.Logical {
+			c.last.Logical = t.Logical
+		}
+		c.last.Logical++
+	case c.last.Wall > t.Wall:
+		c.last.Logical++
+	default:
+		c.last = Timestamp{Wall: t.Wall, Logical: t.Logical + 1}
+	}
+	return c.last
+}
@@ -0,0 +1,54 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHLCReceive(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		last Timestamp // of the receiving clock
+		wall int64     // wall clock time of the receive
+		t    Timestamp // of the message
+		want Timestamp
+	}{
+		{"wall clock ahead of both", Timestamp{10, 3}, 20, Timestamp{15, 7}, Timestamp{20, 0}},
+		{"same wall, message logical larger", Timestamp{10, 3}, 5, Timestamp{10, 7}, Timestamp{10, 8}},
+		{"same wall, own logical larger", Timestamp{10, 7}, 5, Timestamp{10, 3}, Timestamp{10, 8}},
+		{"same wall as wall clock", Timestamp{10, 3}, 10, Timestamp{10, 3}, Timestamp{10, 4}},
+		{"own clock ahead", Timestamp{15, 2}, 12, Timestamp{10, 9}, Timestamp{15, 3}},
+		{"sender ahead", Timestamp{10, 2}, 12, Timestamp{30, 4}, Timestamp{30, 5}},
+		{"sender ahead of zero clock", Timestamp{}, 5, Timestamp{30, 0}, Timestamp{30, 1}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			clock := NewHLC(func() time.Time { return time.Unix(0, c.wall) })
+			clock.last = c.last
+			got := clock.Receive(c.t)
+			if got != c.want {
+				t.Fatalf("got %+v, want %+v", got, c.want)
+			}
+			if got.Compare(c.t) != 1 || got.Compare(c.last) != 1 {
+				t.Fatalf("%+v is not after both %+v and %+v", got, c.t, c.last)
+			}
+		})
+	}
+}
+
+func TestHLCTick(t *testing.T) {
+	wall := int64(10)
+	clock := NewHLC(func() time.Time { return time.Unix(0, wall) })
+	for _, want := range []Timestamp{{10, 0}, {10, 1}, {10, 2}} {
+		if got := clock.Tick(); got != want {
+			t.Fatalf("got %+v, want %+v", got, want)
+		}
+	}
+	wall = 5 // wall clock stepped back
+	if got, want := clock.Tick(), (Timestamp{10, 3}); got != want {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+	wall = 11
+	if got, want := clock.Tick(), (Timestamp{11, 0}); got != want {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,42 @@
+// Package clock has logical clocks for ordering events across nodes. All of
+// them are safe to use from several goroutines.
+//
+// Lamport is a scalar which orders events consistently with causality, but
+// can't tell concurrent events apart. Vector tells whether two events are
+// causally related or concurrent. HLC stays close to wall clock time and
+// still orders causally related events.
+package clock
+
+import "sync"
+
+// Lamport is a Lamport clock. The zero value is ready to use.
+type Lamport struct {
+	lock sync.Mutex
+	time uint
+}
+
+func (c *Lamport) Time() uint {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.time
+}
+
+// Tick counts a local event, like sending a message, and returns its time
+func (c *Lamport) Tick() uint {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.time++
+	return c.time
+}
+
+// Receive counts receiving a message stamped with t. The clock moves past both
+// its own time and t, and the time of the receive event is returned.
+func (c *Lamport) Receive(t uint) uint {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if t > c.time {
+		c.time = t
+	}
+	c.time++
+	return c.time
+}
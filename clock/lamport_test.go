@@ -0,0 +1,27 @@
+package clock
+
+import "testing"
+
+func TestLamportReceive(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		time uint // of the receiving clock
+		t    uint // of the message
+		want uint
+	}{
+		{"message ahead", 3, 7, 8},
+		{"clock ahead", 7, 3, 8},
+		{"same time", 5, 5, 6},
+		{"zero clock", 0, 0, 1},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			clock := &Lamport{time: c.time}
+			if got := clock.Receive(c.t); got != c.want {
+				t.Fatalf("got %d, want %d", got, c.want)
+			}
+			if got := clock.Time(); got != c.want {
+				t.Fatalf("Time returned %d, want %d", got, c.want)
+			}
+		})
+	}
+}
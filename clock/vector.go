@@ -0,0 +1,125 @@
+package clock
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Order is how two vector stamps relate
+type Order int
+
+const (
+	Equal Order = iota
+	Before
+	After
+	Concurrent
+)
+
+func (o Order) String() string {
+	return [...]string{"equal", "before", "after", "concurrent"}[o]
+}
+
+// Vector is a vector stamp: how many events of each node, by id, happened
+// before. Missing ids count as 0.
+type Vector map[int]uint64
+
+// Copy returns a vector which can be changed without changing v
+func (v Vector) Copy() Vector {
+	c := Vector{}
+	for id, n := range v {
+		c[id] = n
+	}
+	return c
+}
+
+// Merge raises every entry of v to the one of other, if that is larger
+func (v Vector) Merge(other Vector) {
+	for id, n := range other {
+		if n > v[id] {
+			v[id] = n
+		}
+	}
+}
+
+// Compare tells whether v happened before other, after it, is the same or is
+// concurrent with it
+func (v Vector) Compare(other Vector) Order {
+	less, greater := false, false
+	for id, n := range v {
+		if n < other[id] {
+			less = true
+		} else if n > other[id] {
+			greater = true
+		}
+	}
+	for id, n := range other {
+		if _, ok := v[id]; !ok && n > 0 {
+			less = true
+		}
+	}
+	switch {
+	case less && greater:
+		return Concurrent
+	case less:
+		return Before
+	case greater:
+		return After
+	}
+	return Equal
+}
+
+// Concurrent tells if neither of v and other happened before the other one
+func (v Vector) Concurrent(other Vector) bool {
+	return v.Compare(other) == Concurrent
+}
+
+// String prints entries in id order, like [0:2 1:0 3:5]
+func (v Vector) String() string {
+	ids := []int{}
+	for id := range v {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	entries := []string{}
+	for _, id := range ids {
+		entries = append(entries, strconv.Itoa(id)+":"+strconv.FormatUint(v[id], 10))
+	}
+	return "[" + strings.Join(entries, " ") + "]"
+}
+
+// VectorClock is the vector clock of node id
+type VectorClock struct {
+	id     int
+	lock   *sync.Mutex
+	vector Vector
+}
+
+func NewVectorClock(id int) *VectorClock {
+	return &VectorClock{id: id, lock: &sync.Mutex{}, vector: Vector{id: 0}}
+}
+
+// Time returns a copy of the current stamp
+func (c *VectorClock) Time() Vector {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.vector.Copy()
+}
+
+// Tick counts a local event, like sending a message, and returns its stamp
+func (c *VectorClock) Tick() Vector {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.vector[c.id]++
+	return c.vector.Copy()
+}
+
+// Receive merges the stamp of a received message and counts the receive event
+func (c *VectorClock) Receive(v Vector) Vector {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.vector.Merge(v)
+	c.vector[c.id]++
+	return c.vector.Copy()
+}
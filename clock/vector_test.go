@@ -0,0 +1,47 @@
+package clock
+
+import "testing"
+
+func TestVectorCompare(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		v    Vector
+		w    Vector
+		want Order
+	}{
+		{"both empty", Vector{}, Vector{}, Equal},
+		{"same", Vector{0: 1, 1: 2}, Vector{0: 1, 1: 2}, Equal},
+		{"missing counts as 0", Vector{0: 1, 1: 0}, Vector{0: 1}, Equal},
+		{"one entry smaller", Vector{0: 1, 1: 2}, Vector{0: 2, 1: 2}, Before},
+		{"all entries smaller", Vector{0: 1, 1: 1}, Vector{0: 2, 1: 3}, Before},
+		{"entry only in other", Vector{0: 1}, Vector{0: 1, 1: 1}, Before},
+		{"one entry larger", Vector{0: 3, 1: 2}, Vector{0: 2, 1: 2}, After},
+		{"entry only in v", Vector{0: 1, 2: 4}, Vector{0: 1}, After},
+		{"crossing entries", Vector{0: 2, 1: 1}, Vector{0: 1, 1: 2}, Concurrent},
+		{"disjoint ids", Vector{0: 1}, Vector{1: 1}, Concurrent},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if got := c.v.Compare(c.w); got != c.want {
+				t.Fatalf("%v compared to %v is %v, want %v", c.v, c.w, got, c.want)
+			}
+			// the other way round
+			want := map[Order]Order{Equal: Equal, Before: After, After: Before, Concurrent: Concurrent}[c.want]
+			if got := c.w.Compare(c.v); got != want {
+				t.Fatalf("%v compared to %v is %v, want %v", c.w, c.v, got, want)
+			}
+		})
+	}
+}
+
+func TestVectorClockOrdersMessages(t *testing.T) {
+	a, b := NewVectorClock(0), NewVectorClock(1)
+	sent := a.Tick()
+	local := b.Tick()
+	if !sent.Concurrent(local) {
+		t.Fatalf("%v and %v should be concurrent", sent, local)
+	}
+	received := b.Receive(sent)
+	if sent.Compare(received) != Before || local.Compare(received) != Before {
+		t.Fatalf("receive %v is not after send %v and %v", received, sent, local)
+	}
+}
@@ -0,0 +1,253 @@
+package cluster
+
+import (
+	"distributed-lock-example/checker"
+	"distributed-lock-example/joung"
+	"distributed-lock-example/lamport"
+	lamport_K_entry "distributed-lock-example/lamport-K-entry"
+	"distributed-lock-example/maekawa"
+	"distributed-lock-example/raymond"
+	raymond_K_entry "distributed-lock-example/raymond-K-entry"
+	ricart_agrawala "distributed-lock-example/ricart-agrawala"
+	suzuki_kasami "distributed-lock-example/suzuki-kasami"
+	"distributed-lock-example/transport"
+	"errors"
+	"runtime"
+	"sync"
+	"time"
+)
+
+type Algorithm interface {
+	ID() int
+	ProcessMessage(b []byte)
+	InCS() bool
+	EnterCS()
+	ExitCS()
+	AskToEnterCS(CSID string)
+	WaitForCS()
+	Start()
+}
+
+// Cluster runs N nodes in one process, wired together by an in-memory network.
+// No sockets are opened, so any number of clusters can run side by side.
+type Cluster struct {
+	Nodes      []Algorithm
+	Starvation time.Duration    // bound for a request to be granted in runs. 0 means no bound
+	Checker    *checker.Checker // records of last run
+	ordered    bool             // nodes grant CS in order of requests
+	network    *transport.Network
+	transports []*transport.Memory
+}
+
+func newCluster(n int) *Cluster {
+	c := &Cluster{network: transport.NewNetwork()}
+	for id := 0; id < n; id++ {
+		c.transports = append(c.transports, c.network.Join(id))
+	}
+	return c
+}
+
+// NewLamport creates fully connected lamport nodes 0..n-1
+func NewLamport(n int) *Cluster {
+	c := newCluster(n)
+	c.ordered = true
+	for id := 0; id < n; id++ {
+		c.Nodes = append(c.Nodes, lamport.NewNode(id, others(id, n), c.transports[id]))
+	}
+	return c
+}
+
+// NewRicartAgrawala creates fully connected ricart-agrawala nodes 0..n-1
+func NewRicartAgrawala(n int) *Cluster {
+	c := newCluster(n)
+	c.ordered = true
+	for id := 0; id < n; id++ {
+		c.Nodes = append(c.Nodes, ricart_agrawala.NewNode(id, others(id, n), c.transports[id]))
+	}
+	return c
+}
+
+// NewSuzukiKasami creates fully connected suzuki-kasami nodes 0..n-1. node 0
+// holds the token initially.
+func NewSuzukiKasami(n int) *Cluster {
+	c := newCluster(n)
+	for id := 0; id < n; id++ {
+		c.Nodes = append(c.Nodes, suzuki_kasami.NewNode(id, others(id, n), 0, c.transports[id]))
+	}
+	return c
+}
+
+// NewMaekawa creates maekawa nodes 0..n-1 voting in grid quorums
+func NewMaekawa(n int) *Cluster {
+	c := newCluster(n)
+	for id := 0; id < n; id++ {
+		c.Nodes = append(c.Nodes, maekawa.NewNode(id, others(id, n), c.transports[id]))
+	}
+	return c
+}
+
+// NewJoung creates fully connected joung nodes 0..n-1. use RunBridge with
+// capacity n to run them, any number of nodes may share a session.
+func NewJoung(n int) *Cluster {
+	c := newCluster(n)
+	for id := 0; id < n; id++ {
+		c.Nodes = append(c.Nodes, joung.NewNode(id, others(id, n), c.transports[id]))
+	}
+	return c
+}
+
+// NewLamportKEntry creates fully connected lamport-K-entry nodes 0..n-1. use
+// RunBridge to run them, nodes of the same CSID may share CS.
+func NewLamportKEntry(n int) *Cluster {
+	c := newCluster(n)
+	for id := 0; id < n; id++ {
+		c.Nodes = append(c.Nodes, lamport_K_entry.NewNode(id, others(id, n), c.transports[id]))
+	}
+	return c
+}
+
+// NewRaymond creates raymond nodes 0..n-1 arranged as a binary tree. node 0 is
+// the root and holds the token initially.
+func NewRaymond(n int) *Cluster {
+	c := newCluster(n)
+	for id := 0; id < n; id++ {
+		neighbours, holder := treeNeighbours(id, n)
+		c.Nodes = append(c.Nodes, raymond.NewNode(id, neighbours, holder, c.transports[id]))
+	}
+	return c
+}
+
+func others(id int, n int) []int {
+	ids := []int{}
+	for i := 0; i < n; i++ {
+		if i != id {
+			ids = append(ids, i)
+		}
+	}
+	return ids
+}
+
+// treeNeighbours returns parent and children of id in a binary tree of n nodes.
+// parent is returned as holder, root holds the token itself.
+func treeNeighbours(id int, n int) ([]int, int) {
+	neighbours := []int{}
+	holder := id
+	if id != 0 {
+		holder = (id - 1) / 2
+		neighbours = append(neighbours, holder)
+	}
+	for _, child := range []int{2*id + 1, 2*id + 2} {
+		if child < n {
+			neighbours = append(neighbours, child)
+		}
+	}
+	return neighbours, holder
+}
+
+// NewRaymondKEntry creates raymond-K-entry nodes 0..n-1 arranged like
+// NewRaymond. up to `tokens` nodes of same CSID may be in CS at once.
+func NewRaymondKEntry(n int, tokens int) *Cluster {
+	c := newCluster(n)
+	for id := 0; id < n; id++ {
+		neighbours, holder := treeNeighbours(id, n)
+		c.Nodes = append(c.Nodes, raymond_K_entry.NewNode(id, neighbours, holder, tokens, c.transports[id]))
+	}
+	return c
+}
+
+// Start starts message processing of all nodes. Nodes can talk to each other
+// right away, there is no need to wait for others to join.
+func (c *Cluster) Start() {
+	for _, node := range c.Nodes {
+		go node.Start()
+	}
+}
+
+func (c *Cluster) Close() {
+	for _, t := range c.transports {
+		t.Close()
+	}
+}
+
+var ErrTimeout = errors.New("cluster did not finish in time")
+
+// Run makes every node enter and exit CS `iterations` times concurrently. It
+// fails as soon as two nodes are in CS at the same time, a request waits
+// longer than Starvation or, for lamport and ricart-agrawala, CS is granted out
+// of timestamp order. It fails with ErrTimeout if nodes are still waiting for
+// CS when timeout passes.
+func (c *Cluster) Run(iterations int, timeout time.Duration) error {
+	config := checker.Config{Ordered: c.ordered, Starvation: c.Starvation}
+	return c.run(iterations, timeout, config, func(id int, i int) string { return "" })
+}
+
+// RunBridge simulates cars crossing the bridge like main.go does. car with even
+// id starts going east, odd one west, and every car turns around after
+// crossing. Up to `capacity` cars may be on the bridge in the same direction.
+// It fails as soon as cars of both directions, or more than capacity cars, are
+// on the bridge.
+func (c *Cluster) RunBridge(iterations int, timeout time.Duration, capacity int) error {
+	config := checker.Config{Capacity: capacity, Group: true, Starvation: c.Starvation}
+	return c.run(iterations, timeout, config, func(id int, i int) string {
+		if (id+i)%2 == 0 {
+			return "east"
+		}
+		return "west"
+	})
+}
+
+func (c *Cluster) run(iterations int, timeout time.Duration, config checker.Config, direction func(id int, i int) string) error {
+	c.Checker = checker.New(config)
+	start := time.Now()
+	errCh := make(chan error, 1)
+	report := func(err error) {
+		if err == nil {
+			return
+		}
+		select {
+		case errCh <- err:
+		default:
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, node := range c.Nodes {
+		wg.Add(1)
+		go func(node Algorithm) {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				CSID := direction(node.ID(), i)
+				node.AskToEnterCS(CSID)
+				requestTime := checker.RequestTime(node)
+				report(c.Checker.Request(node.ID(), CSID, requestTime, time.Since(start)))
+				node.WaitForCS()
+				node.EnterCS()
+				report(c.Checker.Enter(node.ID(), CSID, requestTime, time.Since(start)))
+				runtime.Gosched() // give others a chance to break in
+				report(c.Checker.Exit(node.ID(), CSID, requestTime, time.Since(start)))
+				node.ExitCS()
+			}
+		}(node)
+	}
+
+	doneCh := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(doneCh)
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-doneCh:
+	case <-time.After(timeout):
+		c.Checker.Finish(time.Since(start))
+		return ErrTimeout
+	}
+	select {
+	case err := <-errCh:
+		return err
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,191 @@
+package cluster
+
+import (
+	"distributed-lock-example/lamport"
+	lamport_K_entry "distributed-lock-example/lamport-K-entry"
+	"distributed-lock-example/transport"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+	"time"
+)
+
+// runs of each algorithm. every run starts a fresh cluster, so interleavings
+// differ from run to run
+var runs = 300
+
+func TestMain(m *testing.M) {
+	log.SetOutput(ioutil.Discard) // algorithms log every message
+	os.Exit(m.Run())
+}
+
+// runMany starts a fresh cluster for every run and fails on the first error
+func runMany(t *testing.T, runs int, newCluster func() *Cluster, run func(c *Cluster) error) {
+	if testing.Short() {
+		runs = runs / 10
+	}
+	for i := 0; i < runs; i++ {
+		c := newCluster()
+		c.Start()
+		err := run(c)
+		c.Close()
+		if err != nil {
+			t.Fatalf("run %d: %v", i, err)
+		}
+	}
+}
+
+func runCS(c *Cluster) error {
+	return c.Run(5, 10*time.Second)
+}
+
+func TestLamport(t *testing.T) {
+	runMany(t, runs, func() *Cluster { return NewLamport(5) }, runCS)
+}
+
+func TestRaymond(t *testing.T) {
+	runMany(t, runs, func() *Cluster { return NewRaymond(5) }, runCS)
+}
+
+func TestRicartAgrawala(t *testing.T) {
+	runMany(t, runs/3, func() *Cluster { return NewRicartAgrawala(5) }, runCS)
+}
+
+func TestSuzukiKasami(t *testing.T) {
+	runMany(t, runs/3, func() *Cluster { return NewSuzukiKasami(5) }, runCS)
+}
+
+func TestMaekawa(t *testing.T) {
+	runMany(t, runs/3, func() *Cluster { return NewMaekawa(5) }, runCS)
+}
+
+func TestRaymondKEntryBridge(t *testing.T) {
+	for _, tokens := range []int{1, 2, 3} {
+		tokens := tokens
+		t.Run(fmt.Sprintf("%d tokens", tokens), func(t *testing.T) {
+			runMany(t, runs/3, func() *Cluster { return NewRaymondKEntry(6, tokens) }, func(c *Cluster) error {
+				return c.RunBridge(4, 10*time.Second, tokens)
+			})
+		})
+	}
+}
+
+func TestJoung(t *testing.T) {
+	runMany(t, runs/3, func() *Cluster {
+		c := NewJoung(5)
+		c.Starvation = 2 * time.Second // a waiting session gets in once the other one drains
+		return c
+	}, func(c *Cluster) error {
+		return c.RunBridge(4, 10*time.Second, 5)
+	})
+}
+
+func TestLamportKEntry(t *testing.T) {
+	runMany(t, runs/3, func() *Cluster { return NewLamportKEntry(5) }, func(c *Cluster) error {
+		return c.RunBridge(4, 10*time.Second, 0)
+	})
+}
+
+// member is an algorithm whose peers can change while it runs
+type member interface {
+	Algorithm
+	TryWaitForCS() bool
+	RemovePeer(id int)
+	AddPeer(id int)
+}
+
+var members = []struct {
+	name    string
+	create  func(n int) *Cluster
+	newNode func(id int, neighbourIDs []int, t transport.Transport) member
+	run     func(c *Cluster) error
+}{
+	{"lamport", NewLamport,
+		func(id int, neighbourIDs []int, t transport.Transport) member {
+			return lamport.NewNode(id, neighbourIDs, t)
+		}, runCS},
+	{"lamport K entry", NewLamportKEntry,
+		func(id int, neighbourIDs []int, t transport.Transport) member {
+			return lamport_K_entry.NewNode(id, neighbourIDs, t)
+		}, func(c *Cluster) error { return c.RunBridge(5, 10*time.Second, 0) }},
+}
+
+// Node 3 dies with a request queued at the others, while node 1 waits for
+// its reply. Once the others remove it, they keep entering CS.
+func TestRemovePeerMidRequest(t *testing.T) {
+	for _, m := range members {
+		m := m
+		t.Run(m.name, func(t *testing.T) {
+			c := m.create(4)
+			c.Start()
+			defer c.Close()
+			c.Nodes[0].AskToEnterCS("east")
+			c.Nodes[0].WaitForCS()
+			c.Nodes[0].EnterCS()
+			c.Nodes[3].AskToEnterCS("west")
+			c.transports[3].Close()
+			c.Nodes[1].AskToEnterCS("west")
+			c.Nodes[0].ExitCS()
+
+			time.Sleep(100 * time.Millisecond)
+			if c.Nodes[1].(member).TryWaitForCS() {
+				t.Fatal("node 1 got in without the reply of dead node 3")
+			}
+			for _, node := range c.Nodes[:3] {
+				node.(member).RemovePeer(3)
+			}
+			entered := make(chan struct{})
+			go func() {
+				c.Nodes[1].WaitForCS()
+				close(entered)
+			}()
+			select {
+			case <-entered:
+			case <-time.After(5 * time.Second):
+				t.Fatal("node 1 still waits after dead node 3 was removed")
+			}
+			c.Nodes[1].EnterCS()
+			c.Nodes[1].ExitCS()
+
+			c.Nodes = c.Nodes[:3]
+			if err := m.run(c); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// Node 3 joins a running cluster of three while node 0 requests CS. It must
+// answer the pending request, and then take turns with the others.
+func TestAddPeer(t *testing.T) {
+	for _, m := range members {
+		m := m
+		t.Run(m.name, func(t *testing.T) {
+			c := m.create(3)
+			c.Start()
+			defer c.Close()
+			c.Nodes[1].AskToEnterCS("east")
+			c.Nodes[1].WaitForCS()
+			c.Nodes[1].EnterCS()
+			c.Nodes[0].AskToEnterCS("west")
+
+			c.transports = append(c.transports, c.network.Join(3))
+			node := m.newNode(3, []int{0, 1, 2}, c.transports[3])
+			go node.Start()
+			for _, n := range c.Nodes {
+				n.(member).AddPeer(3)
+			}
+			c.Nodes = append(c.Nodes, node)
+
+			c.Nodes[1].ExitCS()
+			c.Nodes[0].WaitForCS()
+			c.Nodes[0].EnterCS()
+			c.Nodes[0].ExitCS()
+			if err := m.run(c); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
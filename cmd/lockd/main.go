@@ -0,0 +1,280 @@
+// lockd runs a lock manager as a peer and serves its locks over HTTP, so that
+// services not written in Go can use them.
+//
+//	POST /locks/{name}/acquire?timeout=5s
+//	POST /locks/{name}/release?token=...
+//	GET  /locks/{name}
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"distributed-lock-example/acquire"
+	"distributed-lock-example/faults"
+	lockmanager "distributed-lock-example/lock-manager"
+	"distributed-lock-example/peers"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultTimeout is used when acquire has no timeout parameter
+var DefaultTimeout = 10 * time.Second
+
+var errNotHolder = errors.New("token does not hold the lock")
+
+type server struct {
+	locks *lockmanager.LockManager
+	lock  *sync.Mutex
+	turns map[string]*turn
+}
+
+// turn is whose turn it is among clients of this daemon for one lock. A peer
+// holds a lock for one client at a time, the others wait for turn, in the
+// order they came.
+type turn struct {
+	slot   chan struct{} // full while a client holds or requests the lock
+	holder string        // token of client holding the lock. empty if none
+}
+
+func newServer(locks *lockmanager.LockManager) *server {
+	return &server{locks: locks, lock: &sync.Mutex{}, turns: map[string]*turn{}}
+}
+
+func (s *server) turn(name string) *turn {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	t, ok := s.turns[name]
+	if !ok {
+		t = &turn{slot: make(chan struct{}, 1)}
+		s.turns[name] = t
+	}
+	return t
+}
+
+// releaseTurn lets the lock go if token holds it, and passes the turn on after. It
+// reports false if token doesn't hold the lock, also when it let go already.
+func (s *server) releaseTurn(t *turn, name string, token string) (bool, error) {
+	s.lock.Lock()
+	if token == "" || t.holder != token {
+		s.lock.Unlock()
+		return false, nil
+	}
+	t.holder = ""
+	s.lock.Unlock()
+	err := s.locks.Release(name)
+	<-t.slot
+	return true, err
+}
+
+func newToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatalln(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+type response struct {
+	Name     string     `json:"name"`
+	Acquired bool       `json:"acquired,omitempty"`
+	Released bool       `json:"released,omitempty"`
+	Token    string     `json:"token,omitempty"` // releases the lock
+	Fence    uint64     `json:"fence,omitempty"`
+	Expires  *time.Time `json:"expires,omitempty"` // only in lease mode
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("❗️", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, errorResponse{Error: err.Error()})
+}
+
+// ServeHTTP routes /locks/{name} and /locks/{name}/{action}
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/locks/"), "/")
+	if parts[0] == "" || len(parts) > 2 {
+		http.NotFound(w, r)
+		return
+	}
+	name := parts[0]
+	action := ""
+	if len(parts) == 2 {
+		action = parts[1]
+	}
+
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		s.status(w, name)
+	case action == "acquire" && r.Method == http.MethodPost:
+		s.acquire(w, r, name)
+	case action == "release" && r.Method == http.MethodPost:
+		s.release(w, r, name)
+	case action == "" || action == "acquire" || action == "release":
+		w.Header().Set("Allow", map[string]string{"": "GET", "acquire": "POST", "release": "POST"}[action])
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// acquire waits for the lock until timeout, or until the client goes away.
+// The request is withdrawn in both cases. Clients of this daemon first wait
+// for their turn, then the peer asks the others for the lock.
+func (s *server) acquire(w http.ResponseWriter, r *http.Request, name string) {
+	timeout := DefaultTimeout
+	if v := r.URL.Query().Get("timeout"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			writeError(w, http.StatusBadRequest, errors.New("timeout must be a positive duration like 500ms or 5s"))
+			return
+		}
+		timeout = d
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	t := s.turn(name)
+	select {
+	case t.slot <- struct{}{}:
+	case <-ctx.Done():
+		s.writeAcquireError(w, ctx.Err())
+		return
+	}
+	g, err := s.locks.AcquireLease(ctx, name)
+	if err != nil {
+		<-t.slot
+		s.writeAcquireError(w, err)
+		return
+	}
+
+	token := newToken()
+	s.lock.Lock()
+	t.holder = token
+	s.lock.Unlock()
+	res := response{Name: name, Acquired: true, Token: token, Fence: g.Fence}
+	if !g.Expires.IsZero() {
+		res.Expires = &g.Expires
+		// the peer leaves CS on its own, the next client must not wait for a
+		// release which may never come
+		time.AfterFunc(time.Until(g.Expires), func() {
+			s.releaseTurn(t, name, token)
+		})
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (s *server) writeAcquireError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		writeError(w, http.StatusConflict, errors.New("timed out waiting for lock"))
+	case errors.Is(err, context.Canceled):
+		// client is gone, nobody reads the response
+	case errors.Is(err, lockmanager.ErrClosed), errors.Is(err, acquire.ErrClosed):
+		writeError(w, http.StatusServiceUnavailable, err)
+	default: // acquire.ErrBusy
+		writeError(w, http.StatusConflict, err)
+	}
+}
+
+// release needs the token acquire returned, so a client can't release a lock
+// held by another
+func (s *server) release(w http.ResponseWriter, r *http.Request, name string) {
+	s.lock.Lock()
+	t, ok := s.turns[name]
+	s.lock.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, lockmanager.ErrUnknownLock)
+		return
+	}
+	held, err := s.releaseTurn(t, name, r.URL.Query().Get("token"))
+	if !held {
+		writeError(w, http.StatusForbidden, errNotHolder)
+		return
+	}
+	switch {
+	case err == nil:
+		writeJSON(w, http.StatusOK, response{Name: name, Released: true})
+	case errors.Is(err, lockmanager.ErrUnknownLock):
+		writeError(w, http.StatusNotFound, err)
+	default: // acquire.ErrNotInCS or lease.ErrExpired
+		writeError(w, http.StatusConflict, err)
+	}
+}
+
+func (s *server) status(w http.ResponseWriter, name string) {
+	st, err := s.locks.Status(name)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, st)
+}
+
+func main() {
+	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
+	var id int
+	var algorithm string
+	var listenAddr string
+	var httpAddr string
+	var neighbours peers.Flag
+	var holder int
+	var reliable bool
+	var transportName string
+	var leaseDuration time.Duration
+	var faultsPath string
+	flag.IntVar(&id, "id", -1, "id of this peer")
+	flag.IntVar(&holder, "holder", 0, "initial holder of every token") // applicable only to raymond
+	flag.StringVar(&algorithm, "algorithm", "lamport", "lamport or raymond")
+	flag.StringVar(&listenAddr, "listen", "", "own listening address for peers")
+	flag.StringVar(&httpAddr, "http", "localhost:8080", "address of HTTP API")
+	flag.Var(&neighbours, "neighbour", "neighbour ids")
+	flag.BoolVar(&reliable, "reliable", false, "retransmit lost messages and drop duplicates")
+	flag.StringVar(&transportName, "transport", "udp", "udp or tcp")
+	flag.DurationVar(&leaseDuration, "lease", 0, "release locks held longer than this. 0 means never. must be same on all peers")
+	flag.StringVar(&faultsPath, "faults", "", "scenario file of network faults to inject")
+	flag.Parse()
+
+	var scenario *faults.Scenario
+	if faultsPath != "" {
+		var err error
+		scenario, err = faults.Load(faultsPath)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+	t, err := peers.NewTransport(id, transportName, listenAddr, neighbours, reliable, scenario)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	var locks *lockmanager.LockManager
+	switch algorithm {
+	case "raymond":
+		locks = lockmanager.NewRaymond(id, neighbours.IDs(), holder, leaseDuration, t)
+	case "lamport":
+		locks = lockmanager.NewLamport(id, neighbours.IDs(), leaseDuration, t)
+	default:
+		log.Fatalln("unknown algorithm ", algorithm)
+	}
+
+	http.Handle("/locks/", newServer(locks))
+	log.Println("🚀 serving locks on http://" + httpAddr)
+	log.Fatalln(http.ListenAndServe(httpAddr, nil))
+}
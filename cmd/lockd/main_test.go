@@ -0,0 +1,147 @@
+package main
+
+import (
+	lockmanager "distributed-lock-example/lock-manager"
+	"distributed-lock-example/transport"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(ioutil.Discard) // locks log every message
+	os.Exit(m.Run())
+}
+
+// newServers creates lockd servers of two lamport peers
+func newServers(t *testing.T, leaseDuration time.Duration) []*server {
+	network := transport.NewNetwork()
+	servers := []*server{}
+	for id := 0; id < 2; id++ {
+		locks := lockmanager.NewLamport(id, []int{1 - id}, leaseDuration, network.Join(id))
+		t.Cleanup(func() { locks.Close() })
+		servers = append(servers, newServer(locks))
+	}
+	return servers
+}
+
+// do serves one request and decodes the response into v, if not nil
+func do(t *testing.T, s *server, method string, url string, v interface{}) int {
+	t.Helper()
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(method, url, nil))
+	if v != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+			t.Fatalf("%s %s: %v: %s", method, url, err, w.Body.String())
+		}
+	}
+	return w.Code
+}
+
+func acquireLock(t *testing.T, s *server, url string) response {
+	t.Helper()
+	var res response
+	if code := do(t, s, http.MethodPost, url, &res); code != http.StatusOK || !res.Acquired || res.Token == "" {
+		t.Fatalf("acquire: %d %+v", code, res)
+	}
+	return res
+}
+
+func TestAcquireAndRelease(t *testing.T) {
+	s := newServers(t, 0)
+	res := acquireLock(t, s[0], "/locks/db/acquire?timeout=5s")
+	if res.Name != "db" || res.Fence == 0 || res.Expires != nil {
+		t.Fatalf("acquired %+v", res)
+	}
+	var st lockmanager.Status
+	if code := do(t, s[0], http.MethodGet, "/locks/db", &st); code != http.StatusOK || !st.InCS || st.Holder != 0 {
+		t.Fatalf("status: %d %+v", code, st)
+	}
+
+	// the peer times out while the lock is held
+	var e errorResponse
+	if code := do(t, s[1], http.MethodPost, "/locks/db/acquire?timeout=100ms", &e); code != http.StatusConflict {
+		t.Fatalf("acquire of a held lock: %d %+v", code, e)
+	}
+
+	for _, token := range []string{"", "wrong"} {
+		if code := do(t, s[0], http.MethodPost, "/locks/db/release?token="+token, &e); code != http.StatusForbidden {
+			t.Fatalf("release with token %q: %d", token, code)
+		}
+	}
+	var released response
+	if code := do(t, s[0], http.MethodPost, "/locks/db/release?token="+res.Token, &released); code != http.StatusOK || !released.Released {
+		t.Fatalf("release: %d %+v", code, released)
+	}
+	// a token is good for one release
+	if code := do(t, s[0], http.MethodPost, "/locks/db/release?token="+res.Token, &e); code != http.StatusForbidden {
+		t.Fatalf("release with a stale token: %d", code)
+	}
+
+	next := acquireLock(t, s[1], "/locks/db/acquire?timeout=5s")
+	if next.Fence <= res.Fence {
+		t.Fatalf("fence %d after %d", next.Fence, res.Fence)
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	s := newServers(t, 0)[0]
+	for _, c := range []struct {
+		method string
+		url    string
+		code   int
+		allow  string
+	}{
+		{http.MethodPost, "/locks/db", http.StatusMethodNotAllowed, "GET"},
+		{http.MethodGet, "/locks/db/acquire", http.StatusMethodNotAllowed, "POST"},
+		{http.MethodDelete, "/locks/db/release", http.StatusMethodNotAllowed, "POST"},
+		{http.MethodGet, "/locks/", http.StatusNotFound, ""},
+		{http.MethodGet, "/locks/db/lock", http.StatusNotFound, ""},
+		{http.MethodGet, "/locks/db/acquire/now", http.StatusNotFound, ""},
+		{http.MethodGet, "/locks/unused", http.StatusNotFound, ""},
+		{http.MethodPost, "/locks/unused/release?token=x", http.StatusNotFound, ""},
+		{http.MethodPost, "/locks/db/acquire?timeout=soon", http.StatusBadRequest, ""},
+		{http.MethodPost, "/locks/db/acquire?timeout=-1s", http.StatusBadRequest, ""},
+	} {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(c.method, c.url, nil))
+		if w.Code != c.code || w.Header().Get("Allow") != c.allow {
+			t.Errorf("%s %s: %d, Allow %q. want %d, Allow %q", c.method, c.url, w.Code, w.Header().Get("Allow"), c.code, c.allow)
+		}
+	}
+}
+
+func TestExpiredLeasePassesTurnOn(t *testing.T) {
+	s := newServers(t, 200*time.Millisecond)[0]
+	first := acquireLock(t, s, "/locks/db/acquire?timeout=5s")
+	if first.Expires == nil {
+		t.Fatal("no expiry in lease mode")
+	}
+
+	// the first client never releases. the second one gets its turn when the
+	// lease runs out
+	start := time.Now()
+	second := acquireLock(t, s, "/locks/db/acquire?timeout=5s")
+	if time.Now().Before(*first.Expires) {
+		t.Fatalf("second client got in %v before the lease ran out", first.Expires.Sub(time.Now()))
+	}
+	if waited := time.Since(start); waited > 2*time.Second {
+		t.Fatalf("second client waited %v", waited)
+	}
+	if second.Fence <= first.Fence {
+		t.Fatalf("fence %d after %d", second.Fence, first.Fence)
+	}
+	var e errorResponse
+	if code := do(t, s, http.MethodPost, "/locks/db/release?token="+first.Token, &e); code != http.StatusForbidden {
+		t.Fatalf("release after lease ran out: %d", code)
+	}
+	var released response
+	if code := do(t, s, http.MethodPost, "/locks/db/release?token="+second.Token, &released); code != http.StatusOK {
+		t.Fatalf("release: %d %+v", code, released)
+	}
+}
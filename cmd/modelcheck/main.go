@@ -0,0 +1,169 @@
+// modelcheck explores every interleaving of a small cluster of one algorithm
+// and prints the shortest run which breaks mutual exclusion or deadlocks. The
+// search stops after --max-states states, pass 0 to check all of them. The
+// default run of lamport, lamport-K-entry and joung is partial: with 3 nodes
+// they have more states than the default limit, lamport alone over 300000.
+//
+//	go run ./cmd/modelcheck --algorithm lamport --nodes 2 --iterations 2
+//	go run ./cmd/modelcheck --algorithm maekawa --nodes 4 --walks 10000
+package main
+
+import (
+	"distributed-lock-example/checker"
+	"distributed-lock-example/joung"
+	"distributed-lock-example/lamport"
+	lamport_K_entry "distributed-lock-example/lamport-K-entry"
+	"distributed-lock-example/maekawa"
+	"distributed-lock-example/modelcheck"
+	"distributed-lock-example/raymond"
+	raymond_K_entry "distributed-lock-example/raymond-K-entry"
+	ricart_agrawala "distributed-lock-example/ricart-agrawala"
+	suzuki_kasami "distributed-lock-example/suzuki-kasami"
+	"distributed-lock-example/transport"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+)
+
+func others(id int, n int) []int {
+	ids := []int{}
+	for i := 0; i < n; i++ {
+		if i != id {
+			ids = append(ids, i)
+		}
+	}
+	return ids
+}
+
+// treeNeighbours returns parent and children of id in a binary tree of n nodes.
+// parent is returned as holder, root holds the token itself.
+func treeNeighbours(id int, n int) ([]int, int) {
+	neighbours := []int{}
+	holder := id
+	if id != 0 {
+		holder = (id - 1) / 2
+		neighbours = append(neighbours, holder)
+	}
+	for _, child := range []int{2*id + 1, 2*id + 2} {
+		if child < n {
+			neighbours = append(neighbours, child)
+		}
+	}
+	return neighbours, holder
+}
+
+func newNode(algorithm string, n int, tokens int) (func(id int, t transport.Transport) modelcheck.Algorithm, error) {
+	switch algorithm {
+	case "lamport":
+		return func(id int, t transport.Transport) modelcheck.Algorithm {
+			return lamport.NewNode(id, others(id, n), t)
+		}, nil
+	case "lamport-K-entry":
+		return func(id int, t transport.Transport) modelcheck.Algorithm {
+			return lamport_K_entry.NewNode(id, others(id, n), t)
+		}, nil
+	case "ricart-agrawala":
+		return func(id int, t transport.Transport) modelcheck.Algorithm {
+			return ricart_agrawala.NewNode(id, others(id, n), t)
+		}, nil
+	case "suzuki-kasami":
+		return func(id int, t transport.Transport) modelcheck.Algorithm {
+			return suzuki_kasami.NewNode(id, others(id, n), 0, t)
+		}, nil
+	case "maekawa":
+		return func(id int, t transport.Transport) modelcheck.Algorithm {
+			return maekawa.NewNode(id, others(id, n), t)
+		}, nil
+	case "joung":
+		return func(id int, t transport.Transport) modelcheck.Algorithm {
+			return joung.NewNode(id, others(id, n), t)
+		}, nil
+	case "raymond":
+		return func(id int, t transport.Transport) modelcheck.Algorithm {
+			neighbours, holder := treeNeighbours(id, n)
+			return raymond.NewNode(id, neighbours, holder, t)
+		}, nil
+	case "raymond-K-entry":
+		return func(id int, t transport.Transport) modelcheck.Algorithm {
+			neighbours, holder := treeNeighbours(id, n)
+			return raymond_K_entry.NewNode(id, neighbours, holder, tokens, t)
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown algorithm %q", algorithm)
+}
+
+// check returns the invariants algorithm promises
+func check(algorithm string, tokens int) checker.Config {
+	switch algorithm {
+	case "lamport", "ricart-agrawala":
+		return checker.Config{Ordered: true}
+	case "lamport-K-entry", "joung":
+		return checker.Config{Group: true}
+	case "raymond-K-entry":
+		return checker.Config{Group: true, Capacity: tokens}
+	}
+	return checker.Config{}
+}
+
+func main() {
+	var algorithm string
+	var nodes int
+	var iterations int
+	var tokens int
+	var unordered bool
+	var maxStates int
+	var walks int
+	var seed int64
+	flag.StringVar(&algorithm, "algorithm", "lamport", "raymond, lamport, lamport-K-entry, raymond-K-entry, ricart-agrawala, suzuki-kasami, maekawa or joung")
+	flag.IntVar(&nodes, "nodes", 3, "num of nodes")
+	flag.IntVar(&iterations, "iterations", 1, "CS entries per node")
+	flag.IntVar(&tokens, "tokens", 1, "max num of nodes in CS with same CSID") // applicable only to raymond-K-entry
+	flag.BoolVar(&unordered, "unordered", false, "links may reorder messages, like UDP")
+	flag.IntVar(&maxStates, "max-states", 20000, "give up after this many states. 0 means no limit. the default run of lamport, lamport-K-entry and joung with 3 nodes is partial")
+	flag.IntVar(&walks, "walks", 0, "sample this many random runs instead of checking all")
+	flag.Int64Var(&seed, "seed", 1, "seed of random runs")
+	flag.Parse()
+
+	nodeFunc, err := newNode(algorithm, nodes, tokens)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	raymond.TokenTimeout = 0 // nodes are created for every replay, they must not start timers
+
+	config := modelcheck.Config{
+		Nodes:      nodes,
+		Iterations: iterations,
+		NewNode:    nodeFunc,
+		Check:      check(algorithm, tokens),
+		Unordered:  unordered,
+		MaxStates:  maxStates,
+		Walks:      walks,
+		Seed:       seed,
+	}
+	// nodes of K-entry algorithms cross the bridge in alternating directions
+	if config.Check.Group {
+		config.CSID = func(id int, i int) string {
+			if (id+i)%2 == 0 {
+				return "east"
+			}
+			return "west"
+		}
+	}
+
+	start := time.Now()
+	log.SetOutput(ioutil.Discard) // algorithms log every message
+	result, err := modelcheck.Run(config)
+	log.SetOutput(os.Stderr)
+	if err != nil {
+		fmt.Print(result)
+		log.Fatalf("❗️ %s with %d nodes: %v (%d states)", algorithm, nodes, err, result.States)
+	}
+	if !result.Complete && walks == 0 {
+		log.Printf("✅ no violation in first %d states, search stopped (%v). raise --max-states to go on", result.States, time.Since(start))
+		return
+	}
+	log.Printf("✅ no violation in %d states (%v)", result.States, time.Since(start))
+}
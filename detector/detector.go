@@ -0,0 +1,286 @@
+// Package detector notices dead peers. Every node sends a heartbeat to its
+// peers each Interval. A peer is suspected when nothing was heard from it for
+// Timeout, or, in phi accrual mode, when the suspicion level phi computed from
+// its past heartbeat intervals exceeds Phi. A suspected peer which is heard
+// from again is alive again.
+//
+// A detector needs a transport of its own. Use a channel of the node's
+// transport so no extra socket is needed:
+//
+//	mux := transport.NewMux(t, nil)
+//	node := lamport.NewNode(id, neighbourIDs, mux.Channel("lamport"))
+//	d := detector.New(id, neighbourIDs, mux.Channel("heartbeat"), detector.Config{})
+//	d.Subscribe(func(e detector.Event) { ... })
+//	go d.Start()
+package detector
+
+import (
+	"distributed-lock-example/logger"
+	"distributed-lock-example/transport"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+var MessageHeartbeat string = "heartbeat"
+
+type message struct {
+	SenderID int    `json:"senderId"`
+	Message  string `json:"message"`
+}
+
+// Config of a detector. Zero fields take defaults.
+type Config struct {
+	Interval time.Duration    // between heartbeats. default 100ms
+	Timeout  time.Duration    // silence after which a peer is suspected. default 10 intervals
+	Phi      float64          // phi accrual threshold, like 8. 0 uses Timeout only
+	Window   int              // num of heartbeat intervals phi is estimated from. default 100
+	Now      func() time.Time // reads the time. default time.Now, tests pass a fake clock
+}
+
+func (c Config) withDefaults() Config {
+	if c.Interval <= 0 {
+		c.Interval = 100 * time.Millisecond
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = 10 * c.Interval
+	}
+	if c.Window <= 0 {
+		c.Window = 100
+	}
+	if c.Now == nil {
+		c.Now = time.Now
+	}
+	return c
+}
+
+type EventType string
+
+var EventSuspect EventType = "suspect"
+var EventAlive EventType = "alive"
+
+type Event struct {
+	Peer int       `json:"peer"`
+	Type EventType `json:"type"`
+}
+
+type peer struct {
+	lastHeard time.Time
+	heard     bool            // lastHeard is a heartbeat, not start time
+	intervals []time.Duration // ring of last Window heartbeat intervals
+	next      int
+	suspected bool
+}
+
+// Detector watches a fixed set of peers
+type Detector struct {
+	id          int
+	config      Config
+	peers       map[int]*peer
+	subscribers []func(Event)
+	lock        *sync.Mutex
+	log         *logger.Logger
+	transport   transport.Transport
+	done        chan struct{}
+	closeOnce   *sync.Once
+}
+
+func New(id int, peerIDs []int, t transport.Transport, config Config) *Detector {
+	d := &Detector{id: id, config: config.withDefaults(),
+		peers:     map[int]*peer{},
+		lock:      &sync.Mutex{},
+		log:       &logger.Logger{Prefix: fmt.Sprintf("[%d]", id)},
+		transport: t,
+		done:      make(chan struct{}),
+		closeOnce: &sync.Once{},
+	}
+	now := d.config.Now()
+	for _, p := range peerIDs {
+		// a peer which never says anything is suspected after Timeout
+		d.peers[p] = &peer{lastHeard: now}
+	}
+	return d
+}
+
+// Subscribe registers f for suspect and alive events. Events are delivered one
+// at a time in the order they happen, so f must not block for long.
+func (d *Detector) Subscribe(f func(Event)) {
+	d.lock.Lock()
+	d.subscribers = append(d.subscribers, f)
+	d.lock.Unlock()
+}
+
+// Suspected reports whether peer is currently suspected
+func (d *Detector) Suspected(peerID int) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	p, ok := d.peers[peerID]
+	return ok && p.suspected
+}
+
+// Alive returns ids of peers which are not suspected, in ascending order
+func (d *Detector) Alive() []int {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	ids := []int{}
+	for id, p := range d.peers {
+		if !p.suspected {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// Phi returns the current suspicion level of peer. It is 0 until a few
+// heartbeats of peer have arrived.
+func (d *Detector) Phi(peerID int) float64 {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	p, ok := d.peers[peerID]
+	if !ok {
+		return 0
+	}
+	return p.phi(d.config.Now())
+}
+
+// Start sends heartbeats and handles incoming ones until Close
+func (d *Detector) Start() {
+	go d.tick()
+	for b := range d.transport.Receive() {
+		var m message
+		if err := json.Unmarshal(b, &m); err != nil || m.Message != MessageHeartbeat {
+			continue
+		}
+		d.heard(m.SenderID, d.config.Now())
+	}
+	d.Close()
+}
+
+func (d *Detector) Close() error {
+	var err error
+	d.closeOnce.Do(func() {
+		close(d.done)
+		err = d.transport.Close()
+	})
+	return err
+}
+
+func (d *Detector) heard(peerID int, now time.Time) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	p, ok := d.peers[peerID]
+	if !ok {
+		return
+	}
+	interval := now.Sub(p.lastHeard)
+	p.lastHeard = now
+	if !p.heard {
+		p.heard = true
+		return
+	}
+	if len(p.intervals) < d.config.Window {
+		p.intervals = append(p.intervals, interval)
+	} else {
+		p.intervals[p.next] = interval
+		p.next = (p.next + 1) % d.config.Window
+	}
+}
+
+func (d *Detector) tick() {
+	ticker := time.NewTicker(d.config.Interval)
+	defer ticker.Stop()
+	for {
+		d.heartbeat()
+		d.check(d.config.Now())
+		select {
+		case <-ticker.C:
+		case <-d.done:
+			return
+		}
+	}
+}
+
+func (d *Detector) heartbeat() {
+	b, _ := json.Marshal(message{SenderID: d.id, Message: MessageHeartbeat})
+	d.lock.Lock()
+	ids := make([]int, 0, len(d.peers))
+	for id := range d.peers {
+		ids = append(ids, id)
+	}
+	d.lock.Unlock()
+	for _, id := range ids {
+		if err := d.transport.Send(id, b); err != nil {
+			d.log.Println("❗️", err)
+		}
+	}
+}
+
+// check updates suspicion of every peer and tells subscribers what changed
+func (d *Detector) check(now time.Time) {
+	d.lock.Lock()
+	var events []Event
+	for id, p := range d.peers {
+		suspect := now.Sub(p.lastHeard) > d.config.Timeout
+		if d.config.Phi > 0 && len(p.intervals) >= minSamples {
+			suspect = p.phi(now) > d.config.Phi
+		}
+		if suspect == p.suspected {
+			continue
+		}
+		p.suspected = suspect
+		if suspect {
+			d.log.Println("💀 suspecting ", id)
+			events = append(events, Event{Peer: id, Type: EventSuspect})
+		} else {
+			d.log.Println("💚 alive again ", id)
+			events = append(events, Event{Peer: id, Type: EventAlive})
+		}
+	}
+	subscribers := d.subscribers
+	d.lock.Unlock()
+
+	sort.Slice(events, func(i, j int) bool { return events[i].Peer < events[j].Peer })
+	for _, e := range events {
+		for _, f := range subscribers {
+			f(e)
+		}
+	}
+}
+
+// minSamples is how many intervals phi needs before it is trusted
+const minSamples = 3
+
+// phi is -log10 of the probability that a heartbeat comes even later than now,
+// assuming intervals are normally distributed. uses the logistic
+// approximation of the normal CDF from the phi accrual paper's implementations.
+func (p *peer) phi(now time.Time) float64 {
+	if len(p.intervals) < minSamples {
+		return 0
+	}
+	var sum float64
+	for _, i := range p.intervals {
+		sum += float64(i)
+	}
+	mean := sum / float64(len(p.intervals))
+	var variance float64
+	for _, i := range p.intervals {
+		variance += (float64(i) - mean) * (float64(i) - mean)
+	}
+	stddev := math.Sqrt(variance / float64(len(p.intervals)))
+	// heartbeats on a quiet network are very regular. a tiny stddev would
+	// make phi jump on a single late heartbeat
+	if floor := mean / 2; stddev < floor {
+		stddev = floor
+	}
+
+	y := (float64(now.Sub(p.lastHeard)) - mean) / stddev
+	e := math.Exp(-y * (1.5976 + 0.070566*y*y))
+	if y > 0 {
+		return -math.Log10(e / (1 + e))
+	}
+	return -math.Log10(1 - 1/(1+e))
+}
@@ -0,0 +1,161 @@
+package detector
+
+import (
+	"distributed-lock-example/transport"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(ioutil.Discard)
+	os.Exit(m.Run())
+}
+
+// fakeClock is only moved by the test
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) advance(d time.Duration) time.Time {
+	c.now = c.now.Add(d)
+	return c.now
+}
+
+// newDetector watches peer 1. It is not started, the test feeds heartbeats
+// and checks with heard and check.
+func newDetector(t *testing.T, config Config) (*Detector, *fakeClock, *[]Event) {
+	c := &fakeClock{now: time.Unix(1000, 0)}
+	config.Now = c.Now
+	d := New(0, []int{1}, transport.NewNetwork().Join(0), config)
+	t.Cleanup(func() { d.Close() })
+	events := &[]Event{}
+	d.Subscribe(func(e Event) { *events = append(*events, e) })
+	return d, c, events
+}
+
+func TestTimeoutSuspicion(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		heardAt []time.Duration // since start
+		checkAt time.Duration
+		suspect bool
+	}{
+		{"silent within timeout", nil, 500 * time.Millisecond, false},
+		{"silent at timeout", nil, time.Second, false},
+		{"silent past timeout", nil, 1500 * time.Millisecond, true},
+		{"heard lately", []time.Duration{time.Second}, 1500 * time.Millisecond, false},
+		{"silent since last heard", []time.Duration{100 * time.Millisecond}, 1200 * time.Millisecond, true},
+	} {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			d, clock, events := newDetector(t, Config{Timeout: time.Second})
+			start := clock.now
+			for _, at := range c.heardAt {
+				clock.now = start.Add(at)
+				d.heard(1, clock.now)
+			}
+			clock.now = start.Add(c.checkAt)
+			d.check(clock.now)
+			if d.Suspected(1) != c.suspect {
+				t.Fatalf("suspected: %v", d.Suspected(1))
+			}
+			want := "[]"
+			if c.suspect {
+				want = "[{1 suspect}]"
+			}
+			if got := fmt.Sprint(*events); got != want {
+				t.Fatalf("events %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestSuspectedPeerIsAliveAgain(t *testing.T) {
+	d, clock, events := newDetector(t, Config{Timeout: time.Second})
+	d.check(clock.advance(2 * time.Second))
+	d.check(clock.advance(time.Second)) // no news, no event
+	if fmt.Sprint(d.Alive()) != "[]" {
+		t.Fatalf("alive: %v", d.Alive())
+	}
+
+	d.heard(1, clock.advance(time.Second))
+	d.check(clock.advance(100 * time.Millisecond))
+	if d.Suspected(1) || fmt.Sprint(d.Alive()) != "[1]" {
+		t.Fatalf("peer heard from is still suspected")
+	}
+	if got := fmt.Sprint(*events); got != "[{1 suspect} {1 alive}]" {
+		t.Fatalf("events %s", got)
+	}
+}
+
+func TestPhi(t *testing.T) {
+	ms := time.Millisecond
+	regular := []time.Duration{100 * ms, 100 * ms, 100 * ms, 100 * ms, 100 * ms}
+	for _, c := range []struct {
+		name      string
+		window    int
+		intervals []time.Duration
+		silence   time.Duration
+		phi       float64
+	}{
+		{"warming up", 0, []time.Duration{100 * ms, 100 * ms}, 10 * time.Second, 0},
+		{"on time", 0, regular, 100 * ms, 0.301030}, // stddev floored to mean/2, y = 0
+		{"early", 0, regular, 50 * ms, 0.075033},    // y = -1
+		{"late", 0, regular, 300 * ms, 4.736695},    // y = 4
+		// mean 125ms, stddev 43ms floored to 62.5ms, y = 2
+		{"stddev floor", 0, []time.Duration{100 * ms, 100 * ms, 100 * ms, 200 * ms}, 250 * ms, 1.642828},
+		// mean 100ms, stddev 80ms, y = 1
+		{"jittery", 0, []time.Duration{20 * ms, 180 * ms, 20 * ms, 180 * ms}, 180 * ms, 0.799508},
+		// only the last 3 intervals count
+		{"window", 3, []time.Duration{time.Second, time.Second, time.Second, 100 * ms, 100 * ms, 100 * ms}, 300 * ms, 4.736695},
+	} {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			d, clock, _ := newDetector(t, Config{Window: c.window})
+			d.heard(1, clock.now)
+			for _, i := range c.intervals {
+				d.heard(1, clock.advance(i))
+			}
+			clock.advance(c.silence)
+			if phi := d.Phi(1); math.Abs(phi-c.phi) > 1e-5 {
+				t.Fatalf("phi %f, want %f", phi, c.phi)
+			}
+		})
+	}
+}
+
+func TestPhiSuspicion(t *testing.T) {
+	ms := time.Millisecond
+	for _, c := range []struct {
+		name      string
+		intervals int // regular 100ms heartbeats
+		silence   time.Duration
+		suspect   bool
+	}{
+		{"warming up falls back to timeout", 2, 200 * ms, true},
+		{"late but likely", 5, 200 * ms, false}, // phi 1.6, past Timeout
+		{"too late", 5, 500 * ms, true},         // phi 21
+	} {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			d, clock, _ := newDetector(t, Config{Timeout: 150 * ms, Phi: 8})
+			d.heard(1, clock.now)
+			for i := 0; i < c.intervals; i++ {
+				d.heard(1, clock.advance(100*ms))
+			}
+			d.check(clock.advance(c.silence))
+			if d.Suspected(1) != c.suspect {
+				t.Fatalf("suspected: %v, phi %f", d.Suspected(1), d.Phi(1))
+			}
+		})
+	}
+}
@@ -0,0 +1,218 @@
+// Package discovery finds peers on the local network segment. Every node
+// announces its id, listening address and algorithm on a UDP multicast group
+// each Interval, and collects the announcements of the others. Nodes refuse to
+// start if two of them use the same id or if they run different algorithms.
+//
+// Nodes keep announcing after they found their peers, so nodes which start
+// later find them too.
+package discovery
+
+import (
+	"context"
+	"distributed-lock-example/logger"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Group is the multicast group nodes announce themselves on
+var Group = "239.255.77.77:7946"
+
+// Interval is how often a node announces itself
+var Interval = 200 * time.Millisecond
+
+var ErrIDCollision = errors.New("id is used by another node")
+var ErrAlgorithmMismatch = errors.New("nodes run different algorithms")
+
+type Announcement struct {
+	ID        int    `json:"id"`
+	Addr      string `json:"addr"`
+	Algorithm string `json:"algorithm"`
+	Session   int64  `json:"session"` // tells nodes with same id apart
+}
+
+type Discoverer struct {
+	self   Announcement
+	conn   *net.UDPConn
+	group  *net.UDPAddr
+	peers  map[int]Announcement
+	err    error
+	waitCh chan struct{}
+	done   chan struct{}
+	once   *sync.Once
+	lock   *sync.Mutex
+	log    *logger.Logger
+}
+
+// New joins Group on the interface named ifname, or on the loopback interface
+// if ifname is empty. All nodes on one machine find each other on the loopback
+// interface. Nodes on other machines need a real interface, like eth0.
+func New(id int, addr string, algorithm string, ifname string) (*Discoverer, error) {
+	ifi, err := multicastInterface(ifname)
+	if err != nil {
+		return nil, err
+	}
+	group, err := net.ResolveUDPAddr("udp4", Group)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenMulticastUDP("udp4", ifi, group)
+	if err != nil {
+		return nil, err
+	}
+	return &Discoverer{
+		self:   Announcement{ID: id, Addr: addr, Algorithm: algorithm, Session: time.Now().UnixNano()},
+		conn:   conn,
+		group:  group,
+		peers:  map[int]Announcement{},
+		waitCh: make(chan struct{}, 1),
+		done:   make(chan struct{}),
+		once:   &sync.Once{},
+		lock:   &sync.Mutex{},
+		log:    &logger.Logger{Prefix: fmt.Sprintf("[%d]", id)},
+	}, nil
+}
+
+func multicastInterface(ifname string) (*net.Interface, error) {
+	if ifname != "" {
+		return net.InterfaceByName(ifname)
+	}
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	for _, ifi := range interfaces {
+		if ifi.Flags&net.FlagLoopback != 0 && ifi.Flags&net.FlagUp != 0 {
+			return &ifi, nil
+		}
+	}
+	return nil, errors.New("no loopback interface")
+}
+
+// notify wakes up Wait. signals are coalesced, so it never blocks
+func (d *Discoverer) notify() {
+	select {
+	case d.waitCh <- struct{}{}:
+	default:
+	}
+}
+
+// Wait blocks until nodes peers besides this one are found, or ctx is done. It
+// returns their addresses by id.
+func (d *Discoverer) Wait(ctx context.Context, nodes int) (map[int]string, error) {
+	for {
+		d.lock.Lock()
+		err := d.err
+		found := len(d.peers) >= nodes
+		d.lock.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			return d.Peers(), nil
+		}
+
+		select {
+		case <-d.waitCh:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Peers returns addresses of the nodes found so far by id
+func (d *Discoverer) Peers() map[int]string {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	peers := map[int]string{}
+	for id, a := range d.peers {
+		peers[id] = a.Addr
+	}
+	return peers
+}
+
+// Start announces this node and listens to others until Close
+func (d *Discoverer) Start() {
+	go d.announce()
+	buffer := make([]byte, 1024)
+	backoff := time.Duration(0)
+	for {
+		n, from, err := d.conn.ReadFromUDP(buffer)
+		if err != nil {
+			// an error like a vanished interface comes back at once, so wait
+			// longer every time, up to Interval
+			if backoff == 0 {
+				d.log.Println("❗️", err)
+			}
+			backoff = 2*backoff + time.Millisecond
+			if backoff > Interval {
+				backoff = Interval
+			}
+			select {
+			case <-d.done:
+				return
+			case <-time.After(backoff):
+				continue
+			}
+		}
+		backoff = 0
+		var a Announcement
+		if err := json.Unmarshal(buffer[:n], &a); err != nil {
+			continue
+		}
+		d.lock.Lock()
+		d.process(a, from)
+		d.lock.Unlock()
+	}
+}
+
+func (d *Discoverer) announce() {
+	b, _ := json.Marshal(d.self)
+	ticker := time.NewTicker(Interval)
+	defer ticker.Stop()
+	for {
+		if _, err := d.conn.WriteToUDP(b, d.group); err != nil {
+			d.log.Println("❗️", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-d.done:
+			return
+		}
+	}
+}
+
+// process expects d.lock to be held
+func (d *Discoverer) process(a Announcement, from *net.UDPAddr) {
+	if a.Session == d.self.Session || d.err != nil {
+		return
+	}
+	// an address like :7000 is on the host the announcement came from
+	if host, port, err := net.SplitHostPort(a.Addr); err == nil {
+		if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+			a.Addr = net.JoinHostPort(from.IP.String(), port)
+		}
+	}
+
+	known, ok := d.peers[a.ID]
+	switch {
+	case a.ID == d.self.ID || (ok && known.Session != a.Session):
+		d.err = fmt.Errorf("%w: %d at %s", ErrIDCollision, a.ID, a.Addr)
+	case a.Algorithm != d.self.Algorithm:
+		d.err = fmt.Errorf("%w: %d at %s runs %s", ErrAlgorithmMismatch, a.ID, a.Addr, a.Algorithm)
+	case !ok:
+		d.log.Printf("🔎 found %d at %s", a.ID, a.Addr)
+		d.peers[a.ID] = a
+	default:
+		return
+	}
+	d.notify()
+}
+
+func (d *Discoverer) Close() error {
+	d.once.Do(func() { close(d.done) })
+	return d.conn.Close()
+}
@@ -0,0 +1,74 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(ioutil.Discard)
+	Group = "239.255.77.78:7947" // not the one of cars which may be running
+	Interval = 20 * time.Millisecond
+	os.Exit(m.Run())
+}
+
+func start(t *testing.T, id int, algorithm string) *Discoverer {
+	d, err := New(id, fmt.Sprintf("127.0.0.1:%d", 7100+id), algorithm, "")
+	if err != nil {
+		t.Skip("no multicast on loopback:", err)
+	}
+	go d.Start()
+	t.Cleanup(func() { d.Close() })
+	return d
+}
+
+func TestDiscoverersFindEachOther(t *testing.T) {
+	ds := []*Discoverer{start(t, 0, "lamport"), start(t, 1, "lamport"), start(t, 2, "lamport")}
+	for i, d := range ds {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		peers, err := d.Wait(ctx, len(ds)-1)
+		cancel()
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		for id := range ds {
+			want := fmt.Sprintf("127.0.0.1:%d", 7100+id)
+			if addr, ok := peers[id]; id != i && addr != want {
+				t.Fatalf("%d found %d at %q, want %s", i, id, addr, want)
+			} else if id == i && ok {
+				t.Fatalf("%d found itself", i)
+			}
+		}
+	}
+}
+
+func TestRefusesConflictingNodes(t *testing.T) {
+	for _, c := range []struct {
+		name      string
+		id        int
+		algorithm string
+		want      error
+	}{
+		{"same id", 0, "lamport", ErrIDCollision},
+		{"other algorithm", 1, "raymond", ErrAlgorithmMismatch},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			a := start(t, 0, "lamport")
+			b := start(t, c.id, c.algorithm)
+			for _, d := range []*Discoverer{a, b} {
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				_, err := d.Wait(ctx, 5)
+				cancel()
+				if !errors.Is(err, c.want) {
+					t.Fatalf("Wait returned %v, want %v", err, c.want)
+				}
+			}
+		})
+	}
+}
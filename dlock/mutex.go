@@ -0,0 +1,137 @@
+// Package dlock wraps a distributed mutual exclusion algorithm into a mutex
+// which is used like sync.Mutex:
+//
+//	m := dlock.New(node)
+//	m.Lock()
+//	defer m.Unlock()
+package dlock
+
+import (
+	"context"
+	"log"
+	"sync"
+)
+
+// Algorithm is the part of a node's API a Mutex drives. Every algorithm in
+// this repo implements it.
+type Algorithm interface {
+	AskToEnterCS(CSID string)
+	WaitForCS()
+	EnterCS()
+	ExitCS()
+}
+
+// acquirer is implemented by algorithms which can withdraw a request
+type acquirer interface {
+	Acquire(ctx context.Context, CSID string) error
+	Release() error
+}
+
+// Mutex is a sync.Locker backed by a node of a distributed algorithm. A node
+// can have one request at a time, so goroutines of the same process queue up
+// locally before they ask the other nodes.
+type Mutex struct {
+	algo  Algorithm
+	csid  string
+	state *state
+}
+
+// state is shared by mutexes of the same node
+type state struct {
+	sem  chan struct{} // full while this node requests or holds CS
+	lock *sync.Mutex
+	held bool
+}
+
+func (s *state) setHeld(held bool) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	was := s.held
+	s.held = held
+	return was
+}
+
+var _ sync.Locker = &Mutex{}
+
+// New returns a mutex with empty CSID for algo. algo must be started already.
+func New(algo Algorithm) *Mutex {
+	return &Mutex{algo: algo, state: &state{sem: make(chan struct{}, 1), lock: &sync.Mutex{}}}
+}
+
+// WithCSID returns a mutex for the same node which asks for CSID. Group and K
+// entry algorithms let holders of the same CSID in together. Mutexes returned
+// for the same node exclude each other locally.
+func (m *Mutex) WithCSID(CSID string) *Mutex {
+	return &Mutex{algo: m.algo, csid: CSID, state: m.state}
+}
+
+func (m *Mutex) Lock() {
+	m.LockContext(context.Background())
+}
+
+// LockContext blocks until the lock is held or ctx is done. It returns
+// ctx.Err() in the latter case, the lock is not held then. Algorithms with
+// Acquire withdraw the request. For others the request stays, and CS is left
+// right after it is granted.
+func (m *Mutex) LockContext(ctx context.Context) error {
+	select {
+	case m.state.sem <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	if a, ok := m.algo.(acquirer); ok {
+		if err := a.Acquire(ctx, m.csid); err != nil {
+			<-m.state.sem
+			return err
+		}
+		m.state.setHeld(true)
+		return nil
+	}
+
+	m.algo.AskToEnterCS(m.csid)
+	granted := make(chan struct{})
+	go func() {
+		m.algo.WaitForCS()
+		close(granted)
+	}()
+	select {
+	case <-granted:
+		m.algo.EnterCS()
+		m.state.setHeld(true)
+		return nil
+	case <-ctx.Done():
+		go func() {
+			<-granted
+			m.algo.EnterCS()
+			m.algo.ExitCS()
+			<-m.state.sem
+		}()
+		return ctx.Err()
+	}
+}
+
+// Unlock leaves CS. Like sync.Mutex, it panics if m is not locked. Errors of
+// leaving, like an expired lease, are logged. Release returns them instead.
+func (m *Mutex) Unlock() {
+	if err := m.Release(); err != nil {
+		log.Println("❗️ dlock:", err)
+	}
+}
+
+// Release is Unlock which returns the error of leaving CS. lease.ErrExpired
+// means the lease ran out while m was held, so others may have been in CS
+// meanwhile. m is unlocked in any case.
+func (m *Mutex) Release() error {
+	if !m.state.setHeld(false) {
+		panic("dlock: unlock of unlocked mutex")
+	}
+	var err error
+	if a, ok := m.algo.(acquirer); ok {
+		err = a.Release()
+	} else {
+		m.algo.ExitCS()
+	}
+	<-m.state.sem
+	return err
+}
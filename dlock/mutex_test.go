@@ -0,0 +1,175 @@
+package dlock
+
+import (
+	"context"
+	"distributed-lock-example/lamport"
+	ricart_agrawala "distributed-lock-example/ricart-agrawala"
+	"distributed-lock-example/transport"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(ioutil.Discard) // nodes log every message
+	os.Exit(m.Run())
+}
+
+type node interface {
+	Algorithm
+	Start()
+}
+
+// newPair creates two connected nodes, started. They are closed when the test
+// ends.
+func newPair(t *testing.T, create func(id int, t transport.Transport) node) []*Mutex {
+	network := transport.NewNetwork()
+	mutexes := []*Mutex{}
+	for id := 0; id < 2; id++ {
+		m := network.Join(id)
+		n := create(id, m)
+		go n.Start()
+		t.Cleanup(func() { m.Close() })
+		mutexes = append(mutexes, New(n))
+	}
+	return mutexes
+}
+
+var algorithms = []struct {
+	name   string
+	create func(id int, t transport.Transport) node
+}{
+	{"lamport", func(id int, t transport.Transport) node { return lamport.NewNode(id, []int{1 - id}, t) }},
+	{"ricart-agrawala", func(id int, t transport.Transport) node { return ricart_agrawala.NewNode(id, []int{1 - id}, t) }},
+}
+
+func lockAsync(ctx context.Context, m *Mutex) <-chan error {
+	errCh := make(chan error, 1)
+	go func() { errCh <- m.LockContext(ctx) }()
+	return errCh
+}
+
+func wait(t *testing.T, what string, errCh <-chan error) error {
+	t.Helper()
+	select {
+	case err := <-errCh:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s never returned", what)
+		return nil
+	}
+}
+
+// Of two goroutines of node 0, the first one asks the other node and the
+// second one waits behind it. Both give up while node 1 holds the lock.
+func TestLockContextCancelled(t *testing.T) {
+	for _, a := range algorithms {
+		a := a
+		t.Run(a.name, func(t *testing.T) {
+			m := newPair(t, a.create)
+			m[1].Lock()
+
+			acquiring, cancelAcquiring := context.WithCancel(context.Background())
+			first := lockAsync(acquiring, m[0])
+			time.Sleep(50 * time.Millisecond) // first takes the local turn and asks node 1
+			waiting, cancelWaiting := context.WithCancel(context.Background())
+			second := lockAsync(waiting, m[0])
+
+			cancelWaiting()
+			if err := wait(t, "waiting goroutine", second); err != context.Canceled {
+				t.Fatalf("waiting goroutine: %v", err)
+			}
+			cancelAcquiring()
+			if err := wait(t, "acquiring goroutine", first); err != context.Canceled {
+				t.Fatalf("acquiring goroutine: %v", err)
+			}
+
+			// nobody holds m[0] and the lock still moves between the nodes
+			third := lockAsync(context.Background(), m[0])
+			m[1].Unlock()
+			if err := wait(t, "goroutine after cancelled ones", third); err != nil {
+				t.Fatal(err)
+			}
+			m[0].Unlock()
+			m[1].Lock()
+			m[1].Unlock()
+		})
+	}
+}
+
+// fake grants every request at once and records the CSIDs asked for
+type fake struct {
+	lock  *sync.Mutex
+	asked []string
+	inCS  bool
+}
+
+func (f *fake) AskToEnterCS(CSID string) {
+	f.lock.Lock()
+	f.asked = append(f.asked, CSID)
+	f.lock.Unlock()
+}
+
+func (f *fake) WaitForCS() {}
+
+func (f *fake) EnterCS() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.inCS {
+		panic("entered CS twice")
+	}
+	f.inCS = true
+}
+
+func (f *fake) ExitCS() {
+	f.lock.Lock()
+	f.inCS = false
+	f.lock.Unlock()
+}
+
+func TestWithCSIDSharesState(t *testing.T) {
+	f := &fake{lock: &sync.Mutex{}}
+	m := New(f)
+	north := m.WithCSID("north")
+	north.Lock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := m.LockContext(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("locked m while north of the same node is held: %v", err)
+	}
+	if err := m.WithCSID("south").LockContext(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("locked south while north of the same node is held: %v", err)
+	}
+
+	north.Unlock()
+	m.Lock()
+	m.Unlock()
+	if got := f.asked; len(got) != 2 || got[0] != "north" || got[1] != "" {
+		t.Fatalf("asked for %q", got)
+	}
+}
+
+func TestUnlockOfUnlockedMutexPanics(t *testing.T) {
+	m := New(&fake{lock: &sync.Mutex{}})
+	for _, c := range []struct {
+		name string
+		f    func()
+	}{
+		{"never locked", m.Unlock},
+		{"release never locked", func() { m.Release() }},
+		{"unlocked twice", func() { m.Lock(); m.Unlock(); m.Unlock() }},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Fatal("no panic")
+				}
+			}()
+			c.f()
+		})
+	}
+}
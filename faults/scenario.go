@@ -0,0 +1,154 @@
+// Package faults makes a network misbehave on purpose. Transport wraps the
+// transport of a node and drops, duplicates, delays and reorders the messages
+// it sends, and cuts links during partitions, following the rules of a
+// Scenario. Scenarios are JSON files which every node loads, so a chaos run
+// can be repeated with the same file.
+package faults
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+// Duration is a time.Duration written like "200ms" in scenario files
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"200ms\": %s", b)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Rule applies to messages of one link, or one message type, or both. Start
+// and End are measured from when the node started. Each node applies rules to
+// messages it sends.
+type Rule struct {
+	From      *int     `json:"from,omitempty"`      // sender. any if missing
+	To        *int     `json:"to,omitempty"`        // receiver. any if missing
+	Message   string   `json:"message,omitempty"`   // like request, reply, release or privilege. any if empty
+	Drop      float64  `json:"drop,omitempty"`      // probability a message is lost
+	Duplicate float64  `json:"duplicate,omitempty"` // probability a message is sent twice
+	Delay     Duration `json:"delay,omitempty"`     // added to every message
+	Reorder   Duration `json:"reorder,omitempty"`   // random delay up to this, messages sent within it may overtake each other
+	Start     Duration `json:"start,omitempty"`
+	End       Duration `json:"end,omitempty"` // 0 means never
+}
+
+// Partition splits nodes into groups which can't reach each other from Start
+// to End. Nodes in no group still reach everyone.
+type Partition struct {
+	Groups [][]int  `json:"groups"`
+	Start  Duration `json:"start,omitempty"`
+	End    Duration `json:"end,omitempty"` // 0 means never heals
+}
+
+type Scenario struct {
+	Seed       int64       `json:"seed"` // same seed makes same choices for same messages
+	Rules      []Rule      `json:"rules,omitempty"`
+	Partitions []Partition `json:"partitions,omitempty"`
+}
+
+// Load reads a scenario file
+func Load(path string) (*Scenario, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var s Scenario
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := s.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &s, nil
+}
+
+func (s *Scenario) validate() error {
+	for i, r := range s.Rules {
+		if r.Drop < 0 || r.Drop > 1 || r.Duplicate < 0 || r.Duplicate > 1 {
+			return fmt.Errorf("rule %d: probabilities must be between 0 and 1", i)
+		}
+		if r.Delay < 0 || r.Reorder < 0 {
+			return fmt.Errorf("rule %d: delays can't be negative", i)
+		}
+		if !during(r.Start, r.End) {
+			return fmt.Errorf("rule %d: ends before it starts", i)
+		}
+	}
+	for i, p := range s.Partitions {
+		if len(p.Groups) < 2 {
+			return fmt.Errorf("partition %d: needs at least two groups", i)
+		}
+		if !during(p.Start, p.End) {
+			return fmt.Errorf("partition %d: ends before it starts", i)
+		}
+	}
+	return nil
+}
+
+func during(start Duration, end Duration) bool {
+	return start >= 0 && (end == 0 || end > start)
+}
+
+func active(start Duration, end Duration, now time.Duration) bool {
+	return now >= time.Duration(start) && (end == 0 || now < time.Duration(end))
+}
+
+func (r *Rule) matches(from int, to int, message string, now time.Duration) bool {
+	return (r.From == nil || *r.From == from) &&
+		(r.To == nil || *r.To == to) &&
+		(r.Message == "" || r.Message == message) &&
+		active(r.Start, r.End, now)
+}
+
+// cuts tells if the partition separates from and to at now
+func (p *Partition) cuts(from int, to int, now time.Duration) bool {
+	if !active(p.Start, p.End, now) {
+		return false
+	}
+	fromGroup, toGroup := -1, -1
+	for i, group := range p.Groups {
+		for _, id := range group {
+			if id == from {
+				fromGroup = i
+			}
+			if id == to {
+				toGroup = i
+			}
+		}
+	}
+	return fromGroup != -1 && toGroup != -1 && fromGroup != toGroup
+}
+
+// messageType finds the type of an algorithm message. Reliable and Mux wrap
+// messages in envelopes with a payload, so payloads are looked into until a
+// message field shows up. Acks and other messages without type return "".
+func messageType(b []byte) string {
+	for {
+		var m struct {
+			Message string          `json:"message"`
+			Payload json.RawMessage `json:"payload"`
+		}
+		if err := json.Unmarshal(b, &m); err != nil {
+			return ""
+		}
+		if m.Message != "" || len(m.Payload) == 0 {
+			return m.Message
+		}
+		b = m.Payload
+	}
+}
@@ -0,0 +1,52 @@
+package faults
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		scenario string
+		want     string // part of the error. empty if valid
+	}{
+		{"empty", `{"seed": 1}`, ""},
+		{"valid", `{"seed": 1,
+			"rules": [{"from": 0, "to": 1, "message": "reply", "drop": 0.5, "duplicate": 1, "delay": "20ms", "reorder": "5ms", "start": "1s", "end": "2s"}],
+			"partitions": [{"groups": [[0, 1], [2]], "start": "3s"}]}`, ""},
+		{"drop over 1", `{"rules": [{"drop": 1.5}]}`, "rule 0: probabilities"},
+		{"negative duplicate", `{"rules": [{}, {"duplicate": -0.1}]}`, "rule 1: probabilities"},
+		{"negative delay", `{"rules": [{"delay": "-1ms"}]}`, "rule 0: delays"},
+		{"negative reorder", `{"rules": [{"reorder": "-1ms"}]}`, "rule 0: delays"},
+		{"rule ends before start", `{"rules": [{"start": "2s", "end": "1s"}]}`, "rule 0: ends before"},
+		{"rule ends at start", `{"rules": [{"start": "1s", "end": "1s"}]}`, "rule 0: ends before"},
+		{"rule starts before node", `{"rules": [{"start": "-1s"}]}`, "rule 0: ends before"},
+		{"rule never ends", `{"rules": [{"start": "1s"}]}`, ""},
+		{"one group", `{"partitions": [{"groups": [[0, 1]]}]}`, "partition 0: needs at least two groups"},
+		{"no groups", `{"partitions": [{"groups": [[0], [1]]}, {}]}`, "partition 1: needs at least two groups"},
+		{"partition ends before start", `{"partitions": [{"groups": [[0], [1]], "start": "5s", "end": "1s"}]}`, "partition 0: ends before"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			var s Scenario
+			if err := json.Unmarshal([]byte(c.scenario), &s); err != nil {
+				t.Fatal(err)
+			}
+			err := s.validate()
+			switch {
+			case c.want == "" && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case c.want != "" && (err == nil || !strings.Contains(err.Error(), c.want)):
+				t.Fatalf("got %v, want error with %q", err, c.want)
+			}
+		})
+	}
+}
+
+func TestDurationMustBeString(t *testing.T) {
+	var s Scenario
+	if err := json.Unmarshal([]byte(`{"rules": [{"delay": 20}]}`), &s); err == nil {
+		t.Fatal("a number was taken for a duration")
+	}
+}
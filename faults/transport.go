@@ -0,0 +1,114 @@
+package faults
+
+import (
+	"distributed-lock-example/logger"
+	"distributed-lock-example/transport"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Transport applies a scenario to messages node id sends through inner. Put it
+// below transport.Reliable to see whether retransmission copes, or above to
+// see how algorithms cope on their own.
+type Transport struct {
+	id       int
+	inner    transport.Transport
+	scenario *Scenario
+	start    time.Time
+	rand     *rand.Rand
+	lock     *sync.Mutex
+	log      *logger.Logger
+}
+
+func New(id int, inner transport.Transport, scenario *Scenario) *Transport {
+	return &Transport{
+		id:       id,
+		inner:    inner,
+		scenario: scenario,
+		start:    time.Now(),
+		rand:     rand.New(rand.NewSource(scenario.Seed + int64(id))),
+		lock:     &sync.Mutex{},
+		log:      &logger.Logger{Prefix: fmt.Sprintf("[%d]", id)},
+	}
+}
+
+// Send drops the message, or sends it once or twice after its delay. A dropped
+// message is not an error, like on a real network.
+func (f *Transport) Send(nodeID int, b []byte) error {
+	now := time.Since(f.start)
+	message := messageType(b)
+	for i := range f.scenario.Partitions {
+		if f.scenario.Partitions[i].cuts(f.id, nodeID, now) {
+			f.log.Println("✂️ partition drops", message, "to", nodeID)
+			return nil
+		}
+	}
+
+	copies := 1
+	var delay time.Duration
+	f.lock.Lock()
+	for i := range f.scenario.Rules {
+		r := &f.scenario.Rules[i]
+		if !r.matches(f.id, nodeID, message, now) {
+			continue
+		}
+		if r.Drop > 0 && f.rand.Float64() < r.Drop {
+			f.lock.Unlock()
+			f.log.Println("🌩 dropped", message, "to", nodeID)
+			return nil
+		}
+		if r.Duplicate > 0 && f.rand.Float64() < r.Duplicate {
+			copies++
+		}
+		delay += time.Duration(r.Delay)
+		if r.Reorder > 0 {
+			delay += time.Duration(f.rand.Int63n(int64(r.Reorder)))
+		}
+	}
+	f.lock.Unlock()
+
+	if copies > 1 {
+		f.log.Println("🌩 duplicated", message, "to", nodeID)
+	}
+	if delay == 0 {
+		var err error
+		for i := 0; i < copies; i++ {
+			err = f.inner.Send(nodeID, b)
+		}
+		return err
+	}
+
+	// the caller may reuse b once Send returns
+	c := make([]byte, len(b))
+	copy(c, b)
+	time.AfterFunc(delay, func() {
+		for i := 0; i < copies; i++ {
+			if err := f.inner.Send(nodeID, c); err != nil {
+				f.log.Println("❗️", err)
+			}
+		}
+	})
+	return nil
+}
+
+func (f *Transport) Receive() <-chan []byte {
+	return f.inner.Receive()
+}
+
+func (f *Transport) Close() error {
+	return f.inner.Close()
+}
+
+func (f *Transport) AddPeer(id int, addr string) error {
+	return transport.AddPeer(f.inner, id, addr)
+}
+
+func (f *Transport) RemovePeer(id int) {
+	transport.RemovePeer(f.inner, id)
+}
+
+func (f *Transport) PeerAddr(id int) (string, bool) {
+	return transport.PeerAddr(f.inner, id)
+}
@@ -0,0 +1,198 @@
+package faults
+
+import (
+	"distributed-lock-example/transport"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(ioutil.Discard) // every fault is logged
+	os.Exit(m.Run())
+}
+
+// newLink puts node 0 behind scenario. Nodes 1 and 2 only receive.
+func newLink(t *testing.T, scenario string) (*Transport, []*transport.Memory) {
+	var s Scenario
+	if err := json.Unmarshal([]byte(scenario), &s); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.validate(); err != nil {
+		t.Fatal(err)
+	}
+	network := transport.NewNetwork()
+	f := New(0, network.Join(0), &s)
+	peers := []*transport.Memory{network.Join(1), network.Join(2)}
+	t.Cleanup(func() {
+		f.Close()
+		for _, p := range peers {
+			p.Close()
+		}
+	})
+	return f, peers
+}
+
+func send(t *testing.T, f *Transport, to int, message string, seq int) {
+	t.Helper()
+	if err := f.Send(to, []byte(fmt.Sprintf(`{"message":%q,"seq":%d}`, message, seq))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// received returns what arrived at m until nothing more did for wait
+func received(m *transport.Memory, wait time.Duration) []string {
+	got := []string{}
+	for {
+		select {
+		case b := <-m.Receive():
+			got = append(got, string(b))
+		case <-time.After(wait):
+			return got
+		}
+	}
+}
+
+func count(messages []string, message string) int {
+	n := 0
+	for _, b := range messages {
+		if messageType([]byte(b)) == message {
+			n++
+		}
+	}
+	return n
+}
+
+func TestDrop(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		scenario string
+		requests [2]int // min and max num of 100 requests which arrive
+		replies  [2]int // of 100 replies
+	}{
+		{"nothing", `{"seed": 1}`, [2]int{100, 100}, [2]int{100, 100}},
+		{"every request", `{"seed": 1, "rules": [{"message": "request", "drop": 1}]}`, [2]int{0, 0}, [2]int{100, 100}},
+		{"half of requests", `{"seed": 1, "rules": [{"message": "request", "drop": 0.5}]}`, [2]int{30, 70}, [2]int{100, 100}},
+		{"other link", `{"seed": 1, "rules": [{"to": 2, "drop": 1}]}`, [2]int{100, 100}, [2]int{100, 100}},
+		{"other sender", `{"seed": 1, "rules": [{"from": 1, "drop": 1}]}`, [2]int{100, 100}, [2]int{100, 100}},
+		{"not started", `{"seed": 1, "rules": [{"drop": 1, "start": "1h"}]}`, [2]int{100, 100}, [2]int{100, 100}},
+	} {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			f, peers := newLink(t, c.scenario)
+			for i := 0; i < 100; i++ {
+				send(t, f, 1, "request", i)
+				send(t, f, 1, "reply", i)
+			}
+			got := received(peers[0], 10*time.Millisecond)
+			if n := count(got, "request"); n < c.requests[0] || n > c.requests[1] {
+				t.Errorf("%d requests arrived, want %d to %d", n, c.requests[0], c.requests[1])
+			}
+			if n := count(got, "reply"); n < c.replies[0] || n > c.replies[1] {
+				t.Errorf("%d replies arrived, want %d to %d", n, c.replies[0], c.replies[1])
+			}
+		})
+	}
+}
+
+// The same seed drops the same messages
+func TestSeedRepeatsFaults(t *testing.T) {
+	run := func(seed int) []string {
+		f, peers := newLink(t, fmt.Sprintf(`{"seed": %d, "rules": [{"drop": 0.3, "duplicate": 0.3}]}`, seed))
+		for i := 0; i < 100; i++ {
+			send(t, f, 1, "request", i)
+		}
+		return received(peers[0], 10*time.Millisecond)
+	}
+	first := run(1)
+	if again := run(1); fmt.Sprint(again) != fmt.Sprint(first) {
+		t.Fatalf("same seed, different runs:\n%v\n%v", first, again)
+	}
+	if other := run(2); fmt.Sprint(other) == fmt.Sprint(first) {
+		t.Fatal("another seed made the same choices")
+	}
+}
+
+func TestDuplicate(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		scenario string
+		min      int // num of 100 messages which arrive
+		max      int
+	}{
+		{"every message", `{"seed": 1, "rules": [{"duplicate": 1}]}`, 200, 200},
+		{"half of messages", `{"seed": 1, "rules": [{"duplicate": 0.5}]}`, 130, 170},
+		{"delayed", `{"seed": 1, "rules": [{"duplicate": 1, "delay": "5ms"}]}`, 200, 200},
+	} {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			f, peers := newLink(t, c.scenario)
+			for i := 0; i < 100; i++ {
+				send(t, f, 1, "request", i)
+			}
+			got := received(peers[0], 50*time.Millisecond)
+			if len(got) < c.min || len(got) > c.max {
+				t.Fatalf("%d messages arrived, want %d to %d", len(got), c.min, c.max)
+			}
+		})
+	}
+}
+
+func TestDuplicateFollowsOriginal(t *testing.T) {
+	f, peers := newLink(t, `{"seed": 1, "rules": [{"duplicate": 1}]}`)
+	for i := 0; i < 10; i++ {
+		send(t, f, 1, "request", i)
+	}
+	got := received(peers[0], 10*time.Millisecond)
+	for i := 0; i < 10; i++ {
+		want := fmt.Sprintf(`{"message":"request","seq":%d}`, i)
+		if len(got) < 2*i+2 || got[2*i] != want || got[2*i+1] != want {
+			t.Fatalf("got %v", got)
+		}
+	}
+}
+
+func TestDelay(t *testing.T) {
+	f, peers := newLink(t, `{"seed": 1, "rules": [{"to": 1, "delay": "100ms"}]}`)
+	start := time.Now()
+	send(t, f, 1, "request", 0)
+	send(t, f, 2, "request", 0)
+	if got := received(peers[1], 20*time.Millisecond); len(got) != 1 {
+		t.Fatalf("undelayed link: %v", got)
+	}
+	select {
+	case <-peers[0].Receive():
+		t.Fatalf("arrived %v after sending", time.Since(start))
+	default:
+	}
+	select {
+	case <-peers[0].Receive():
+		if waited := time.Since(start); waited < 100*time.Millisecond {
+			t.Fatalf("arrived after %v", waited)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("delayed message never arrived")
+	}
+}
+
+func TestPartition(t *testing.T) {
+	f, peers := newLink(t, `{"seed": 1, "partitions": [{"groups": [[0], [1]], "end": "100ms"}]}`)
+	send(t, f, 1, "request", 0)
+	send(t, f, 2, "request", 0) // 2 is in no group
+	if got := received(peers[0], 20*time.Millisecond); len(got) != 0 {
+		t.Fatalf("crossed partition: %v", got)
+	}
+	if got := received(peers[1], 20*time.Millisecond); len(got) != 1 {
+		t.Fatalf("node in no group got %v", got)
+	}
+
+	time.Sleep(100 * time.Millisecond) // healed
+	send(t, f, 1, "request", 1)
+	if got := received(peers[0], 20*time.Millisecond); len(got) != 1 {
+		t.Fatalf("after healing: %v", got)
+	}
+}
@@ -0,0 +1,199 @@
+package joung
+
+import (
+	"distributed-lock-example/lamport"
+	"distributed-lock-example/logger"
+	"distributed-lock-example/transport"
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+var MessageRequest string = "request"
+var MessageReply string = "reply"
+
+type message struct {
+	SenderID   int    `json:"senderId"`
+	ReceiverID int    `json:"receiverId"`
+	Message    string `json:"message"`
+	Time       uint   `json:"time"`
+	Session    string `json:"session,omitempty"`
+}
+
+// Node implements group mutual exclusion in the style of Joung's RA1, an
+// extension of ricart-agrawala. CSID passed to AskToEnterCS is the session
+// (ex: direction of a car). Nodes of the same session may be in CS together,
+// nodes of different sessions exclude each other.
+//
+// A request is answered right away by a node which is idle or whose own
+// request has lower priority. A node which is in CS, or has the higher
+// priority request, answers only requests of its own session and defers the
+// rest until it exits. Once it has deferred a request of another session it
+// stops letting newcomers of its own session in, so a session which is
+// waiting can't be starved by a steady stream of the other one.
+type Node struct {
+	id          int
+	clock       *lamport.Clock
+	requesting  bool
+	requestTime uint
+	session     string
+	inCS        bool
+	replies     int
+	defered     []int
+	waitCh      chan struct{}
+	neighbours  []int
+	log         *logger.Logger
+	lock        *sync.Mutex
+	transport   transport.Transport
+}
+
+func NewNode(id int, neighbourIDs []int, t transport.Transport) *Node {
+	return &Node{id: id,
+		clock:      &lamport.Clock{},
+		waitCh:     make(chan struct{}, 1),
+		neighbours: neighbourIDs,
+		log:        &logger.Logger{Prefix: fmt.Sprintf("[%d]", id)},
+		lock:       &sync.Mutex{},
+		transport:  t,
+	}
+}
+
+func (j *Node) ID() int {
+	return j.id
+}
+
+func (j *Node) send(m message) {
+	b, _ := json.Marshal(m)
+	if err := j.transport.Send(m.ReceiverID, b); err != nil {
+		j.log.Println("❗️ ", err)
+	}
+	j.log.Println("->> ", string(b))
+}
+
+func (j *Node) notify() {
+	select {
+	case j.waitCh <- struct{}{}:
+	default:
+	}
+}
+
+// hasPriority tells whether own pending request goes before request of senderID made at t
+func (j *Node) hasPriority(t uint, senderID int) bool {
+	return j.requestTime < t || (j.requestTime == t && j.id < senderID)
+}
+
+// shouldReply decides whether request m can be answered now
+func (j *Node) shouldReply(m message) bool {
+	if !j.requesting && !j.inCS {
+		return true
+	}
+	if !j.inCS && !j.hasPriority(m.Time, m.SenderID) {
+		return true
+	}
+	// m has to wait for me unless it joins my session and nobody of other session is waiting
+	return m.Session == j.session && len(j.defered) == 0
+}
+
+func (j *Node) ProcessMessage(b []byte) {
+	var m message
+	if err := json.Unmarshal(b, &m); err != nil {
+		j.log.Println("❗️", err)
+		return
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	j.clock.Receive(m.Time)
+	switch m.Message {
+	case MessageRequest:
+		if j.shouldReply(m) {
+			j.send(message{SenderID: j.id, ReceiverID: m.SenderID, Message: MessageReply, Time: j.clock.Time()})
+		} else {
+			j.log.Printf("deferring reply to %d for session %s", m.SenderID, m.Session)
+			j.defered = append(j.defered, m.SenderID)
+		}
+	case MessageReply:
+		j.replies++
+		j.notify()
+	}
+}
+
+func (j *Node) InCS() bool {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return j.inCS
+}
+
+// RequestTime is logical time of current or last request
+func (j *Node) RequestTime() uint {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return j.requestTime
+}
+
+func (j *Node) EnterCS() {
+	j.log.Println("entering to CS. session: ", j.session)
+	j.lock.Lock()
+	j.clock.Tick()
+	j.inCS = true
+	j.lock.Unlock()
+}
+
+func (j *Node) ExitCS() {
+	j.log.Println("exiting CS")
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	j.clock.Tick()
+	j.inCS = false
+	j.requesting = false
+	j.session = ""
+	for _, id := range j.defered {
+		j.send(message{SenderID: j.id, ReceiverID: id, Message: MessageReply, Time: j.clock.Time()})
+	}
+	j.defered = nil
+}
+
+func (j *Node) AskToEnterCS(CSID string) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	j.clock.Tick()
+	j.requesting = true
+	j.requestTime = j.clock.Time()
+	j.session = CSID
+	j.replies = 0
+	for _, id := range j.neighbours {
+		j.send(message{SenderID: j.id, ReceiverID: id, Message: MessageRequest, Time: j.requestTime, Session: CSID})
+	}
+	j.notify()
+}
+
+func (j *Node) WaitForCS() {
+	for {
+		<-j.waitCh
+
+		j.lock.Lock()
+		gotPermission := j.replies == len(j.neighbours)
+		j.lock.Unlock()
+		if gotPermission {
+			break
+		}
+	}
+}
+
+// TryWaitForCS is WaitForCS which doesn't block. It reports whether CS was
+// granted.
+func (j *Node) TryWaitForCS() bool {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return j.requesting && !j.inCS && j.replies == len(j.neighbours)
+}
+
+// Start handles messages one at a time, in the order the transport delivers them
+func (j *Node) Start() {
+	for b := range j.transport.Receive() {
+		j.log.Println("<<- ", string(b))
+		j.ProcessMessage(b)
+	}
+}
@@ -2,67 +2,53 @@ package lamport
 
 import (
 	"container/list"
+	"context"
+	"distributed-lock-example/clock"
 	"distributed-lock-example/logger"
-	udpclient "distributed-lock-example/udpclient"
+	"distributed-lock-example/transport"
 	"encoding/json"
 	"fmt"
-	"net"
 	"sync"
 )
 
 type message struct {
-	SenderID     int    `json:"senderId"`
-	SenderAddr   string `json:"senderAddr"`
-	ReceiverAddr string `json:"receiverAddr"`
-	Message      string `json:"message"`
-	Time         uint   `json:"time"`
-	CSID         string `json:"csid"`
-}
-
-type Clock struct {
-	time uint
-}
-
-func (c *Clock) Time() uint {
-	return c.time
-}
-
-func (c *Clock) Tick() {
-	c.time++
-}
-
-func (c *Clock) TakeMax(recvTime uint) {
-	if recvTime > c.time {
-		c.time = recvTime + 1
-	} else {
-		c.time++
-	}
+	SenderID    int          `json:"senderId"`
+	ReceiverID  int          `json:"receiverId"`
+	Message     string       `json:"message"`
+	Time        uint         `json:"time"`
+	CSID        string       `json:"csid"`
+	RequestTime uint         `json:"requestTime,omitempty"` // time of the request a reply is for
+	Vector      clock.Vector `json:"vector,omitempty"`      // stamp of sending. requests carry stamp of asking
 }
 
 type Node struct {
-	id         int
-	clock      *Clock
-	queue      *list.List
-	waitCh     chan struct{}
-	replies    map[string]int
-	defered    *list.List
-	inCS       bool
-	neighbours map[int]string
-	log        *logger.Logger
-	lock       *sync.Mutex
-	CSID       string // just unique identifier for critical section
-	listenAddr string
+	id            int
+	clock         *clock.Lamport
+	vector        *clock.VectorClock
+	requestVector clock.Vector
+	queue         *list.List
+	waitCh        chan struct{}
+	replies       map[string]map[int]bool // CSID -> neighbours which replied to current request
+	requestTime   uint
+	defered       *list.List
+	inCS          bool
+	closed        bool
+	neighbours    []int
+	log           *logger.Logger
+	lock          *sync.Mutex
+	CSID          string // just unique identifier for critical section
+	transport     transport.Transport
 }
 
-func NewNode(id int, listenAddr string, neighbourIDs map[int]string) *Node {
-	replyCh := make(chan struct{})
+func NewNode(id int, neighbourIDs []int, t transport.Transport) *Node {
+	replyCh := make(chan struct{}, 1)
 	return &Node{id: id,
-		queue: list.New(), waitCh: replyCh, defered: list.New(), clock: &Clock{time: 0},
+		queue: list.New(), waitCh: replyCh, defered: list.New(), clock: &clock.Lamport{}, vector: clock.NewVectorClock(id),
 		neighbours: neighbourIDs,
 		log:        &logger.Logger{Prefix: fmt.Sprintf("[%d]", id)},
 		lock:       &sync.Mutex{},
-		replies:    map[string]int{},
-		listenAddr: listenAddr,
+		replies:    map[string]map[int]bool{},
+		transport:  t,
 	}
 }
 
@@ -70,174 +56,215 @@ func (l *Node) ID() int {
 	return l.id
 }
 
+func (l *Node) send(m message) {
+	if m.Vector == nil {
+		m.Vector = l.vector.Tick()
+	}
+	b, _ := json.Marshal(m)
+	if err := l.transport.Send(m.ReceiverID, b); err != nil {
+		l.log.Println("❗️ ", err)
+	}
+	l.log.Println("->> ", string(b))
+}
+
+// notify wakes up WaitForCS. signals are coalesced, so it never blocks
+func (l *Node) notify() {
+	select {
+	case l.waitCh <- struct{}{}:
+	default:
+	}
+}
+
+func (l *Node) dequeue(senderID int) {
+	for e := l.queue.Front(); e != nil; e = e.Next() {
+		if e.Value.(message).SenderID == senderID {
+			l.queue.Remove(e)
+			break
+		}
+	}
+}
+
 func (l *Node) ProcessMessage(b []byte) {
 	var m message
 	if err := json.Unmarshal(b, &m); err != nil {
 		l.log.Println("❗️", err)
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if !l.isNeighbour(m.SenderID) {
+		return // removed peer
 	}
-	l.clock.TakeMax(m.Time)
-	senderAddr := l.neighbours[m.SenderID]
+
+	l.clock.Receive(m.Time)
+	l.vector.Receive(m.Vector)
 	switch m.Message {
 	case "request":
 		l.queue.PushBack(m)
-		reply := message{SenderID: l.id, Message: "reply", Time: l.clock.Time(), ReceiverAddr: senderAddr, CSID: m.CSID}
+		reply := message{SenderID: l.id, Message: "reply", Time: l.clock.Time(), ReceiverID: m.SenderID, CSID: m.CSID, RequestTime: m.Time}
 
 		if l.CSID == "" || l.CSID == m.CSID {
 			// reply
-			l.log.Println("Replying to ", reply.ReceiverAddr)
-			b, _ := json.Marshal(reply)
-			if err := udpclient.SendMessage(reply.ReceiverAddr, b); err != nil {
-				l.log.Println("❗️", err)
-			}
-			l.log.Println("->>", string(b))
+			l.log.Println("Replying to ", reply.ReceiverID)
+			l.send(reply)
 		} else { // l.CSID != m.CSID
-			if l.InCS() {
+			if l.inCS {
 				// defer
-				l.log.Println("Deferring reply to ", reply.ReceiverAddr)
+				l.log.Println("Deferring reply to ", reply.ReceiverID)
 				l.defered.PushBack(reply)
-			} else if l.clock.time < m.Time {
-				// use clock time to decide whether to defer reply or not
-				// request happened earlier than my time.
+			} else if l.precedes(m) {
+				// request happened earlier than mine.
 				// reply
-				l.log.Println("Replying to ", reply.ReceiverAddr)
-				b, _ := json.Marshal(reply)
-				if err := udpclient.SendMessage(reply.ReceiverAddr, b); err != nil {
-					l.log.Println("❗️", err)
-				}
-				l.log.Println("->>", string(b))
-			} else { // !l.InCS() && l.clock.time > m.Time
+				l.log.Println("Replying to ", reply.ReceiverID)
+				l.send(reply)
+			} else { // !l.InCS() && mine happened earlier
 				//defer
-				l.log.Println("Deferring reply to ", reply.ReceiverAddr)
+				l.log.Println("Deferring reply to ", reply.ReceiverID)
 				l.defered.PushBack(reply)
 			}
 		}
 
 		// use clock time to decide whether to defer reply or not
 		// if l.InCS() && l.CSID != "" && l.CSID != m.CSID && l.clock.time < m.Time {
-		// 	l.log.Println("Deferring reply to ", reply.ReceiverAddr)
+		// 	l.log.Println("Deferring reply to ", reply.ReceiverID)
 		// 	l.defered.PushBack(reply)
 		// } else {
-		// 	l.log.Println("Replying to ", reply.ReceiverAddr)
-		// 	b, _ := json.Marshal(reply)
-		// 	if err := udpclient.SendMessage(reply.ReceiverAddr, b); err != nil {
-		// 		l.log.Println("❗️", err)
-		// 	}
-		// 	l.log.Println("->>", string(b))
+		// 	l.log.Println("Replying to ", reply.ReceiverID)
+		// 	l.send(reply)
 		// }
 
 	case "reply":
+		replied, ok := l.replies[m.CSID]
+		if !ok || m.CSID != l.CSID || m.RequestTime != l.requestTime {
+			return // reply to a retracted request
+		}
 		l.log.Printf("got permission to enter from %d for CSID %s", m.SenderID, m.CSID)
-		l.replies[m.CSID]++
-		l.waitCh <- struct{}{}
+		replied[m.SenderID] = true
+		l.notify()
 	case "release":
+		l.dequeue(m.SenderID)
+		l.notify()
+	}
+}
 
-		l.lock.Lock()
-		for e := l.queue.Front(); e != nil; e = e.Next() {
-			rm := e.Value.(message)
-			if rm.SenderID == m.SenderID {
-				l.queue.Remove(e)
-				break
-			}
-		}
-		l.lock.Unlock()
-		l.waitCh <- struct{}{}
+// precedes tells if request m goes before own request. Requests which are
+// causally related go in the order they happened, concurrent ones by time and
+// then id, like in lamport.
+func (l *Node) precedes(m message) bool {
+	switch order := m.Vector.Compare(l.requestVector); order {
+	case clock.Before, clock.After:
+		return order == clock.Before
 	}
+	l.log.Printf("request of %d %v is concurrent with mine %v", m.SenderID, m.Vector, l.requestVector)
+	return m.Time < l.requestTime || (m.Time == l.requestTime && m.SenderID < l.id)
 }
 
 func (l *Node) InCS() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
 	return l.inCS
 }
 
+// RequestTime is logical time of current or last request
+func (l *Node) RequestTime() uint {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.requestTime
+}
+
 func (l *Node) EnterCS() {
 	l.log.Println("entering to CS")
+	l.lock.Lock()
 	l.clock.Tick()
 	l.inCS = true
+	l.lock.Unlock()
 }
 
 func (l *Node) ReplyToDefered() {
 	l.lock.Lock()
+	l.replyToDefered()
+	l.lock.Unlock()
+}
+
+func (l *Node) replyToDefered() {
 	for e := l.defered.Front(); e != nil; e = e.Next() {
 		m := e.Value.(message)
-		l.log.Println("replying to defered requests. receiver : ", m.ReceiverAddr)
-		b, _ := json.Marshal(m)
-		l.log.Println("->> ", string(b))
-		go func(recieverAddr string) {
-			if err := udpclient.SendMessage(recieverAddr, b); err != nil {
-				l.log.Println("❗️ ", err)
-			}
-		}(m.ReceiverAddr)
+		l.log.Println("replying to defered requests. receiver : ", m.ReceiverID)
+		l.send(m)
 	}
-	l.lock.Unlock()
-
 	l.defered.Init()
 }
 
 func (l *Node) ExitCS() {
 	l.log.Println("exiting  CS")
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
 	l.clock.Tick()
 	l.inCS = false
+	l.release()
+}
+
+// release gives up own request. deferred requests are answered and own request
+// is taken off every queue
+func (l *Node) release() {
+	delete(l.replies, l.CSID)
 	l.CSID = ""
-	l.ReplyToDefered()
-
-	for _, addr := range l.neighbours {
-		m := message{SenderID: l.id, ReceiverAddr: addr, Message: "release", Time: l.clock.Time()}
-		b, _ := json.Marshal(m)
-		l.log.Println("->> ", string(b))
-		go func(receiverAddr string) {
-			if err := udpclient.SendMessage(receiverAddr, b); err != nil {
-				l.log.Println("❗️ ", err)
-			}
-			l.log.Println("->> ", string(b))
-		}(addr)
+	l.replyToDefered()
 
+	for _, id := range l.neighbours {
+		l.send(message{SenderID: l.id, ReceiverID: id, Message: "release", Time: l.clock.Time()})
 	}
+	l.dequeue(l.id)
+}
 
+func (l *Node) AskToEnterCS(CSID string) {
 	l.lock.Lock()
-	for e := l.queue.Front(); e != nil; e = e.Next() {
-		m := e.Value.(message)
-		if m.SenderID == l.id {
-			l.queue.Remove(e)
-			break
-		}
-	}
-	l.lock.Unlock()
+	defer l.lock.Unlock()
+	l.askToEnterCS(CSID)
 }
 
-func (l *Node) AskToEnterCS(CSID string) {
+func (l *Node) askToEnterCS(CSID string) {
 	l.clock.Tick()
 	l.CSID = CSID
-	m := message{SenderID: l.id, Message: "request", Time: l.clock.Time(), CSID: CSID}
+	l.requestTime = l.clock.Time()
+	l.requestVector = l.vector.Tick()
+	l.replies[CSID] = map[int]bool{}
+	m := message{SenderID: l.id, Message: "request", Time: l.requestTime, CSID: CSID, Vector: l.requestVector}
 	l.queue.PushBack(m)
 
-	for _, addr := range l.neighbours {
-		m := message{SenderID: l.id, Message: "request", Time: l.clock.Time(), ReceiverAddr: addr, CSID: CSID}
-		b, _ := json.Marshal(m)
-		go func(receiverAddr string) {
-			if err := udpclient.SendMessage(receiverAddr, b); err != nil {
-				l.log.Println("❗️ ", err)
-			}
-			l.log.Println("->> ", string(b))
-		}(addr)
-
+	for _, id := range l.neighbours {
+		l.send(message{SenderID: l.id, Message: "request", Time: l.requestTime, ReceiverID: id, CSID: CSID, Vector: l.requestVector})
 	}
+	l.notify()
 }
 
 func (l *Node) WaitForCS() {
+	l.waitForCS(context.Background())
+}
 
-	for {
-		<-l.waitCh
+// TryWaitForCS is WaitForCS which doesn't block. It reports whether CS was
+// granted.
+func (l *Node) TryWaitForCS() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	replied, ok := l.replies[l.CSID]
+	return ok && !l.inCS && len(replied) == len(l.neighbours)
+}
 
-		if l.defered.Len() == 0 && l.replies[l.CSID] == len(l.neighbours) {
-			l.replies[l.CSID] = 0
-			break
+func (l *Node) waitForCS(ctx context.Context) error {
+	for {
+		select {
+		case <-l.waitCh:
+		case <-ctx.Done():
+			return ctx.Err()
 		}
 
-		if l.defered.Len() > 0 {
-			m := l.defered.Front().Value.(message)
-			if m.SenderID == l.ID() && l.replies[l.CSID] == len(l.neighbours) {
-				l.replies[l.CSID] = 0
-				break
-			}
+		l.lock.Lock()
+		gotPermission := len(l.replies[l.CSID]) == len(l.neighbours)
+		l.lock.Unlock()
+		if gotPermission {
+			return nil
 		}
 
 		// for e := l.defered.Front(); e != nil; e = e.Next() {
@@ -252,26 +279,10 @@ func (l *Node) WaitForCS() {
 	}
 }
 
+// Start handles messages one at a time, in the order the transport delivers them
 func (l *Node) Start() {
-	s, err := net.ResolveUDPAddr("udp4", l.listenAddr)
-	if err != nil {
-		l.log.Fatalln(err)
-	}
-
-	conn, err := net.ListenUDP("udp4", s)
-	if err != nil {
-		l.log.Fatalln(err)
-	}
-	defer conn.Close()
-
-	for {
-		buffer := make([]byte, 1024)
-		n, _, err := conn.ReadFromUDP(buffer)
-		if err != nil {
-			l.log.Println("failed to read from udp: ", err)
-		}
-		b := buffer[0 : n-1]
+	for b := range l.transport.Receive() {
 		l.log.Println("<<- ", string(b))
-		go l.ProcessMessage(b)
+		l.ProcessMessage(b)
 	}
 }
@@ -0,0 +1,64 @@
+package lamport
+
+import (
+	"context"
+	"distributed-lock-example/acquire"
+	"distributed-lock-example/lease"
+)
+
+// Acquire asks for CS and blocks until this node is in CS, or ctx is done. In
+// the latter case the request is taken off every peer's queue and ctx.Err()
+// is returned.
+func (l *Node) Acquire(ctx context.Context, CSID string) error {
+	l.lock.Lock()
+	if l.closed {
+		l.lock.Unlock()
+		return acquire.ErrClosed
+	}
+	if l.requesting || l.inCS {
+		l.lock.Unlock()
+		return acquire.ErrBusy
+	}
+	l.askToEnterCS()
+	l.lock.Unlock()
+
+	if err := l.waitForCS(ctx); err != nil {
+		l.log.Println("giving up on CS: ", err)
+		l.lock.Lock()
+		l.release()
+		l.lock.Unlock()
+		return err
+	}
+	l.EnterCS()
+	return nil
+}
+
+// TryAcquire is Acquire with a short timeout, acquire.TryTimeout. It returns
+// false if CS was not granted in time.
+func (l *Node) TryAcquire(CSID string) (bool, error) {
+	return acquire.Try(func(ctx context.Context) error { return l.Acquire(ctx, CSID) })
+}
+
+// Release leaves CS. It returns lease.ErrExpired if the lease ran out before.
+func (l *Node) Release() error {
+	l.lock.Lock()
+	inCS, expired := l.inCS, l.expired
+	l.expired = false
+	l.lock.Unlock()
+	if !inCS {
+		if expired {
+			return lease.ErrExpired
+		}
+		return acquire.ErrNotInCS
+	}
+	l.ExitCS()
+	return nil
+}
+
+// Close stops the node. Start returns once the transport is closed.
+func (l *Node) Close() error {
+	l.lock.Lock()
+	l.closed = true
+	l.lock.Unlock()
+	return l.transport.Close()
+}
@@ -0,0 +1,115 @@
+package lamport
+
+import (
+	"context"
+	"distributed-lock-example/transport"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(ioutil.Discard) // nodes log every message
+	os.Exit(m.Run())
+}
+
+// newNodes creates fully connected nodes 0..n-1 and starts them. They are
+// closed when the test ends.
+func newNodes(t *testing.T, n int) []*Node {
+	network := transport.NewNetwork()
+	nodes := []*Node{}
+	for id := 0; id < n; id++ {
+		neighbours := []int{}
+		for other := 0; other < n; other++ {
+			if other != id {
+				neighbours = append(neighbours, other)
+			}
+		}
+		nodes = append(nodes, NewNode(id, neighbours, network.Join(id)))
+	}
+	for _, node := range nodes {
+		go node.Start()
+	}
+	t.Cleanup(func() {
+		for _, node := range nodes {
+			node.Close()
+		}
+	})
+	return nodes
+}
+
+func acquireAsync(ctx context.Context, n *Node) <-chan error {
+	errCh := make(chan error, 1)
+	go func() { errCh <- n.Acquire(ctx, "") }()
+	return errCh
+}
+
+func waitAcquired(t *testing.T, n *Node, errCh <-chan error) {
+	t.Helper()
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatalf("node %d: %v", n.id, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("node %d never entered CS", n.id)
+	}
+}
+
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal(what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func queued(n *Node, id int) bool {
+	for _, q := range n.Status().Queue {
+		if q == id {
+			return true
+		}
+	}
+	return false
+}
+
+func TestCancelledAcquireLeavesQueues(t *testing.T) {
+	nodes := newNodes(t, 3)
+	if err := nodes[0].Acquire(context.Background(), ""); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := nodes[1].Acquire(ctx, ""); err != context.DeadlineExceeded {
+		t.Fatalf("acquire while 0 is in CS: %v", err)
+	}
+	eventually(t, "cancelled request still queued", func() bool {
+		for _, n := range nodes {
+			if queued(n, 1) {
+				return false
+			}
+		}
+		return true
+	})
+
+	// the request of 1 was older, 2 must not wait for it
+	errCh := acquireAsync(context.Background(), nodes[2])
+	eventually(t, "request of 2 never reached 0", func() bool { return queued(nodes[0], 2) })
+	if err := nodes[0].Release(); err != nil {
+		t.Fatal(err)
+	}
+	waitAcquired(t, nodes[2], errCh)
+	if nodes[1].InCS() {
+		t.Fatal("cancelled node got CS")
+	}
+
+	errCh = acquireAsync(context.Background(), nodes[1])
+	nodes[2].Release()
+	waitAcquired(t, nodes[1], errCh)
+	nodes[1].Release()
+}
@@ -2,64 +2,60 @@ package lamport
 
 import (
 	"container/list"
+	"context"
+	"distributed-lock-example/clock"
+	"distributed-lock-example/lease"
 	"distributed-lock-example/logger"
-	udpclient "distributed-lock-example/udpclient"
+	"distributed-lock-example/transport"
 	"encoding/json"
 	"fmt"
-	"net"
 	"sync"
+	"time"
 )
 
 type message struct {
-	SenderID     int    `json:"senderId"`
-	SenderAddr   string `json:"senderAddr"`
-	ReceiverAddr string `json:"receiverAddr"`
-	Message      string `json:"message"`
-	Time         uint   `json:"time"`
+	SenderID    int          `json:"senderId"`
+	ReceiverID  int          `json:"receiverId"`
+	Message     string       `json:"message"`
+	Time        uint         `json:"time"`
+	RequestTime uint         `json:"requestTime,omitempty"` // time of the request a reply is for
+	Vector      clock.Vector `json:"vector,omitempty"`      // stamp of sending. requests carry stamp of asking
 }
 
-type Clock struct {
-	time uint
-}
-
-func (c *Clock) Time() uint {
-	return c.time
-}
-
-func (c *Clock) Tick() {
-	c.time++
-}
+// Clock is the Lamport clock every algorithm orders requests with
+type Clock = clock.Lamport
 
-func (c *Clock) TakeMax(recvTime uint) {
-	if recvTime > c.time {
-		c.time = recvTime + 1
-	} else {
-		c.time++
-	}
+type Node struct {
+	id            int
+	clock         *Clock
+	vector        *clock.VectorClock
+	queue         *list.List
+	waitCh        chan struct{}
+	requesting    bool
+	requestTime   uint
+	requestVector clock.Vector
+	replied       map[int]bool // neighbours which replied to current request
+	defered       *list.List
+	inCS          bool
+	closed        bool
+	lease         time.Duration
+	grant         lease.Grant
+	expired       bool    // lease ran out before ExitCS
+	entered       message // request of the last peer which told it entered CS
+	neighbours    []int
+	log           *logger.Logger
+	lock          *sync.Mutex
+	transport     transport.Transport
 }
 
-type Node struct {
-	id         int
-	clock      *Clock
-	queue      *list.List
-	waitCh     chan struct{}
-	replies    int
-	defered    *list.List
-	inCS       bool
-	neighbours map[int]string
-	log        *logger.Logger
-	lock       *sync.Mutex
-	listenAddr string
-}
-
-func NewNode(id int, listenAddr string, neighbourIDs map[int]string) *Node {
-	replyCh := make(chan struct{})
+func NewNode(id int, neighbourIDs []int, t transport.Transport) *Node {
+	replyCh := make(chan struct{}, 1)
 	return &Node{id: id,
-		queue: list.New(), waitCh: replyCh, defered: list.New(), clock: &Clock{time: 0},
+		queue: list.New(), waitCh: replyCh, defered: list.New(), clock: &Clock{}, vector: clock.NewVectorClock(id), replied: map[int]bool{},
 		neighbours: neighbourIDs,
 		log:        &logger.Logger{Prefix: fmt.Sprintf("[%d]", id)},
 		lock:       &sync.Mutex{},
-		listenAddr: listenAddr,
+		transport:  t,
 	}
 }
 
@@ -67,160 +63,207 @@ func (l *Node) ID() int {
 	return l.id
 }
 
+func (l *Node) send(m message) {
+	if m.Vector == nil {
+		m.Vector = l.vector.Tick()
+	}
+	b, _ := json.Marshal(m)
+	if err := l.transport.Send(m.ReceiverID, b); err != nil {
+		l.log.Println("❗️ ", err)
+	}
+	l.log.Println("->> ", string(b))
+}
+
+// notify wakes up WaitForCS. signals are coalesced, so it never blocks
+func (l *Node) notify() {
+	select {
+	case l.waitCh <- struct{}{}:
+	default:
+	}
+}
+
+// enqueue keeps queue sorted by (time, sender id), the total order of requests
+func (l *Node) enqueue(m message) {
+	for e := l.queue.Front(); e != nil; e = e.Next() {
+		qm := e.Value.(message)
+		if m.Time < qm.Time || (m.Time == qm.Time && m.SenderID < qm.SenderID) {
+			l.queue.InsertBefore(m, e)
+			return
+		}
+	}
+	l.queue.PushBack(m)
+}
+
+func (l *Node) dequeue(senderID int) {
+	for e := l.queue.Front(); e != nil; e = e.Next() {
+		if e.Value.(message).SenderID == senderID {
+			l.queue.Remove(e)
+			break
+		}
+	}
+}
+
 func (l *Node) ProcessMessage(b []byte) {
 	var m message
 	if err := json.Unmarshal(b, &m); err != nil {
 		l.log.Println("error unmarshalling message", err)
+		return
 	}
-	l.clock.TakeMax(m.Time)
-	senderAddr := l.neighbours[m.SenderID]
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if !l.isNeighbour(m.SenderID) {
+		return // removed peer
+	}
+
+	l.clock.Receive(m.Time)
+	l.vector.Receive(m.Vector)
 	switch m.Message {
 	case "request":
 		l.log.Println("request came from ", m.SenderID)
-		l.queue.PushBack(m)
-		reply := message{SenderID: l.id, Message: "reply", Time: l.clock.Time(), ReceiverAddr: senderAddr}
-		if !l.InCS() {
-			l.log.Println("I am not in CS. replying to ", reply.ReceiverAddr)
-			b, _ := json.Marshal(reply)
-			if err := udpclient.SendMessage(reply.ReceiverAddr, b); err != nil {
-				l.log.Println("❗️ ", err)
-			}
-			l.log.Println("->>", string(b))
+		l.enqueue(m)
+		reply := message{SenderID: l.id, Message: "reply", Time: l.clock.Time(), ReceiverID: m.SenderID, RequestTime: m.Time}
+		if !l.inCS {
+			l.log.Println("I am not in CS. replying to ", reply.ReceiverID)
+			l.send(reply)
 		} else {
-			l.log.Println("I am in CS. deferring reply to ", reply.ReceiverAddr)
+			l.log.Println("I am in CS. deferring reply to ", reply.ReceiverID)
 			l.defered.PushBack(reply)
 		}
 	case "reply":
+		if !l.requesting || m.RequestTime != l.requestTime {
+			return // reply to a retracted request
+		}
 		l.log.Println("got permission to enter from ", m.SenderID)
-		l.replies++
-		l.waitCh <- struct{}{}
+		l.replied[m.SenderID] = true
+		l.notify()
+	case "enter":
+		l.entered = message{SenderID: m.SenderID, Time: m.RequestTime}
+		l.watchLease(m)
 	case "release":
-
-		l.lock.Lock()
-		for e := l.queue.Front(); e != nil; e = e.Next() {
-			rm := e.Value.(message)
-			if rm.SenderID == m.SenderID {
-				l.queue.Remove(e)
-				break
-			}
-		}
-		l.lock.Unlock()
-		l.waitCh <- struct{}{}
+		l.dequeue(m.SenderID)
+		l.notify()
 	}
 }
 
 func (l *Node) InCS() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
 	return l.inCS
 }
 
 func (l *Node) EnterCS() {
 	l.log.Println("entering to CS")
+	l.lock.Lock()
 	l.clock.Tick()
 	l.inCS = true
+	l.startLease()
+	l.lock.Unlock()
 }
 
 func (l *Node) ReplyToDefered() {
 	l.lock.Lock()
+	l.replyToDefered()
+	l.lock.Unlock()
+}
+
+func (l *Node) replyToDefered() {
 	for e := l.defered.Front(); e != nil; e = e.Next() {
 		m := e.Value.(message)
-		l.log.Println("replying to defered requests. receiver : ", m.ReceiverAddr)
-		b, _ := json.Marshal(m)
-		go func(recieverAddr string) {
-			if err := udpclient.SendMessage(recieverAddr, b); err != nil {
-				l.log.Println("❗️ ", err)
-			}
-			l.log.Println("->>", string(b))
-		}(m.ReceiverAddr)
+		l.log.Println("replying to defered requests. receiver : ", m.ReceiverID)
+		l.send(m)
 	}
-	l.lock.Unlock()
-
 	l.defered.Init()
 }
 
 func (l *Node) ExitCS() {
 	l.log.Println("exiting  CS")
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
 	l.clock.Tick()
 	l.inCS = false
-	l.ReplyToDefered()
-
-	for _, addr := range l.neighbours {
-		m := message{SenderID: l.id, ReceiverAddr: addr, Message: "release", Time: l.clock.Time()}
-		b, _ := json.Marshal(m)
-		go func(receiverAddr string) {
-			if err := udpclient.SendMessage(receiverAddr, b); err != nil {
-				l.log.Println("❗️ ", err)
-			}
-			l.log.Println("->> ", string(b))
-		}(addr)
+	l.replyToDefered()
+	l.release()
+}
 
+// release takes own request off every queue
+func (l *Node) release() {
+	l.requesting = false
+	l.replied = map[int]bool{}
+	for _, id := range l.neighbours {
+		l.send(message{SenderID: l.id, ReceiverID: id, Message: "release", Time: l.clock.Time()})
 	}
+	l.dequeue(l.id)
+}
 
+func (l *Node) AskToEnterCS(_ string /* just to satisfy interface */) {
 	l.lock.Lock()
-	for e := l.queue.Front(); e != nil; e = e.Next() {
-		m := e.Value.(message)
-		if m.SenderID == l.id {
-			l.queue.Remove(e)
-			break
-		}
-	}
-	l.lock.Unlock()
+	defer l.lock.Unlock()
+	l.askToEnterCS()
 }
 
-func (l *Node) AskToEnterCS(_ string /* just to satisfy interface */) {
+func (l *Node) askToEnterCS() {
 	l.clock.Tick()
-	m := message{SenderID: l.id, Message: "request", Time: l.clock.Time()}
-	l.queue.PushBack(m)
-	for _, addr := range l.neighbours {
-		m := message{SenderID: l.id, Message: "request", Time: l.clock.Time(), ReceiverAddr: addr}
-		b, _ := json.Marshal(m)
-		l.log.Println("->> ", string(b))
-		go func(receiverAddr string) {
-			if err := udpclient.SendMessage(receiverAddr, b); err != nil {
-				l.log.Println("❗️ ", err)
-			}
-			l.log.Println("->> ", string(b))
-		}(addr)
+	l.requesting = true
+	l.requestTime = l.clock.Time()
+	l.replied = map[int]bool{}
+	l.expired = false
+	l.requestVector = l.vector.Tick()
+	m := message{SenderID: l.id, Message: "request", Time: l.requestTime, Vector: l.requestVector}
+	l.enqueue(m)
+	for _, id := range l.neighbours {
+		l.send(message{SenderID: l.id, Message: "request", Time: l.requestTime, ReceiverID: id, Vector: l.requestVector})
+	}
+	l.notify()
+}
 
+// gotPermission expects l.lock to be held
+func (l *Node) gotPermission() bool {
+	if !l.requesting || len(l.replied) != len(l.neighbours) {
+		return false
+	}
+	m := l.queue.Front().Value.(message)
+	if m.SenderID != l.id {
+		l.log.Println("I got permission. but priority goes to ", m.SenderID)
+		return false
 	}
+	return true
 }
 
 func (l *Node) WaitForCS() {
+	l.waitForCS(context.Background())
+}
+
+// TryWaitForCS is WaitForCS which doesn't block. It reports whether CS was
+// granted.
+func (l *Node) TryWaitForCS() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.gotPermission()
+}
+
+func (l *Node) waitForCS(ctx context.Context) error {
 	for {
-		<-l.waitCh
+		select {
+		case <-l.waitCh:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 
-		gotPermission := l.replies == len(l.neighbours)
+		l.lock.Lock()
+		gotPermission := l.gotPermission()
+		l.lock.Unlock()
 		if gotPermission {
-			m := l.queue.Front().Value.(message)
-			if m.SenderID == l.id {
-				break
-			} else {
-				l.log.Println("I got permission. but priority goes to ", m.SenderID)
-			}
+			return nil
 		}
 	}
-	l.replies = 0
 }
 
+// Start handles messages one at a time, in the order the transport delivers
+// them. The algorithm relies on messages from a peer not overtaking each other.
 func (l *Node) Start() {
-	s, err := net.ResolveUDPAddr("udp4", l.listenAddr)
-	if err != nil {
-		l.log.Fatalln(err)
-	}
-
-	conn, err := net.ListenUDP("udp4", s)
-	if err != nil {
-		l.log.Fatalln(err)
-	}
-	defer conn.Close()
-
-	for {
-		buffer := make([]byte, 1024)
-		n, _, err := conn.ReadFromUDP(buffer)
-		if err != nil {
-			l.log.Println("failed to read from udp: ", err)
-		}
-		b := buffer[0 : n-1]
+	for b := range l.transport.Receive() {
 		l.log.Println("<<-", string(b))
-		go l.ProcessMessage(b)
+		l.ProcessMessage(b)
 	}
 }
@@ -0,0 +1,94 @@
+package lamport
+
+import (
+	"context"
+	"distributed-lock-example/lease"
+	"time"
+)
+
+// SetLease turns lease mode on. A node which stays in CS longer than d leaves
+// CS by itself. It tells peers when it enters, and they drop its request
+// d + lease.Grace after they hear of it, so a holder which crashes in CS
+// doesn't block everyone. A node which crashes before it enters is not
+// covered, a failure detector has to remove it. All nodes must use the same d.
+// 0 turns lease mode off.
+func (l *Node) SetLease(d time.Duration) {
+	l.lock.Lock()
+	l.lease = d
+	l.lock.Unlock()
+}
+
+// AcquireLease is Acquire which returns the grant
+func (l *Node) AcquireLease(ctx context.Context, CSID string) (lease.Grant, error) {
+	if err := l.Acquire(ctx, CSID); err != nil {
+		return lease.Grant{}, err
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.grant, nil
+}
+
+// fence orders grants the way requests are ordered, by (time, id). ids must be
+// less than 1<<16.
+func fence(time uint, id int) uint64 {
+	return uint64(time)<<16 | uint64(id)
+}
+
+// startLease expects l.lock to be held
+func (l *Node) startLease() {
+	l.grant = lease.Grant{Fence: fence(l.requestTime, l.id)}
+	if l.lease == 0 {
+		return
+	}
+	l.grant.Expires = time.Now().Add(l.lease)
+	requestTime := l.requestTime
+	for _, id := range l.neighbours {
+		l.send(message{SenderID: l.id, ReceiverID: id, Message: "enter", Time: l.clock.Time(), RequestTime: requestTime})
+	}
+	time.AfterFunc(l.lease, func() {
+		l.lock.Lock()
+		defer l.lock.Unlock()
+		if !l.inCS || l.requestTime != requestTime {
+			return
+		}
+		l.log.Println("⌛️ lease expired. leaving CS")
+		l.clock.Tick()
+		l.inCS = false
+		l.expired = true
+		l.replyToDefered()
+		l.release()
+	})
+}
+
+// watchLease drops the request of a peer which entered CS if it is still
+// queued a lease later. Its lease started before m was sent, so the holder
+// has left CS by then, even if its release got lost. expects l.lock to be held
+func (l *Node) watchLease(m message) {
+	if l.lease == 0 {
+		return
+	}
+	entered := message{SenderID: m.SenderID, Time: m.RequestTime}
+	time.AfterFunc(l.lease+lease.Grace, func() {
+		l.lock.Lock()
+		defer l.lock.Unlock()
+		for e := l.queue.Front(); e != nil; e = e.Next() {
+			if !sameRequest(e.Value.(message), entered) {
+				continue
+			}
+			l.log.Printf("⌛️ lease of %d expired. dropping its request", m.SenderID)
+			l.queue.Remove(e)
+			if l.requesting {
+				// it may have deferred our reply
+				l.replied[m.SenderID] = true
+			}
+			l.notify()
+			return
+		}
+	})
+}
+
+// sameRequest tells if a and b are the same request. a node has one request at
+// a time, so sender and time tell requests apart
+func sameRequest(a message, b message) bool {
+	return a.SenderID == b.SenderID && a.Time == b.Time
+}
@@ -0,0 +1,46 @@
+package lamport
+
+import (
+	"context"
+	"distributed-lock-example/lease"
+	"testing"
+	"time"
+)
+
+func TestExpiredHolderIsForcedOut(t *testing.T) {
+	nodes := newNodes(t, 2)
+	for _, n := range nodes {
+		n.SetLease(100 * time.Millisecond)
+	}
+	guard := lease.NewGuard()
+	first, err := nodes[0].AcquireLease(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Expires.IsZero() {
+		t.Fatal("no expiry in lease mode")
+	}
+	if err := guard.Check(first.Fence); err != nil {
+		t.Fatal(err)
+	}
+
+	// node 0 never releases
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	second, err := nodes[1].AcquireLease(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nodes[0].InCS() {
+		t.Fatal("expired holder is still in CS")
+	}
+	if err := nodes[0].Release(); err != lease.ErrExpired {
+		t.Fatalf("release after lease ran out: %v", err)
+	}
+	if err := guard.Check(second.Fence); err != nil {
+		t.Fatalf("fence of the new holder: %v", err)
+	}
+	if err := guard.Check(first.Fence); err != lease.ErrStaleFence {
+		t.Fatalf("fence of the expired holder: %v", err)
+	}
+}
@@ -0,0 +1,72 @@
+package lamport
+
+// RemovePeer excludes a dead peer, as told by a failure detector or an admin.
+// Its requests and the replies deferred to it are dropped, and permission is
+// checked again against the remaining peers. Later messages from it are
+// ignored. If the peer is alive after all, both sides may enter CS together,
+// so only remove peers which are known to be dead.
+func (l *Node) RemovePeer(id int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if !l.isNeighbour(id) {
+		return
+	}
+	l.log.Println("💀 removing peer ", id)
+
+	neighbours := make([]int, 0, len(l.neighbours)-1)
+	for _, n := range l.neighbours {
+		if n != id {
+			neighbours = append(neighbours, n)
+		}
+	}
+	l.neighbours = neighbours
+
+	for e := l.queue.Front(); e != nil; {
+		next := e.Next()
+		if e.Value.(message).SenderID == id {
+			l.queue.Remove(e)
+		}
+		e = next
+	}
+	for e := l.defered.Front(); e != nil; {
+		next := e.Next()
+		if e.Value.(message).ReceiverID == id {
+			l.defered.Remove(e)
+		}
+		e = next
+	}
+	delete(l.replied, id)
+	l.notify()
+}
+
+// AddPeer includes a new peer. A pending request is sent to it as well, so
+// permission now also needs its reply.
+func (l *Node) AddPeer(id int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if id == l.id || l.isNeighbour(id) {
+		return
+	}
+	l.log.Println("🤝 adding peer ", id)
+	l.neighbours = append(l.neighbours, id)
+	if l.requesting {
+		l.send(message{SenderID: l.id, ReceiverID: id, Message: "request", Time: l.requestTime, Vector: l.requestVector})
+	}
+}
+
+// Neighbours returns ids of peers which are not removed
+func (l *Node) Neighbours() []int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return append([]int{}, l.neighbours...)
+}
+
+// isNeighbour expects l.lock to be held
+func (l *Node) isNeighbour(id int) bool {
+	for _, n := range l.neighbours {
+		if n == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,33 @@
+package lamport
+
+// Status is a snapshot of node's state
+type Status struct {
+	ID         int   `json:"id"`
+	Clock      uint  `json:"clock"`
+	Queue      []int `json:"queue"` // ids of requesters in (time, id) order. head is in CS or about to enter
+	Requesting bool  `json:"requesting"`
+	InCS       bool  `json:"inCS"`
+	Holder     int   `json:"holder"` // node known to be in CS, -1 if none. peers tell only in lease mode
+}
+
+func (l *Node) Status() Status {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	s := Status{ID: l.id, Clock: l.clock.Time(), Queue: []int{}, Requesting: l.requesting, InCS: l.inCS, Holder: -1}
+	for e := l.queue.Front(); e != nil; e = e.Next() {
+		s.Queue = append(s.Queue, e.Value.(message).SenderID)
+	}
+	if l.inCS {
+		s.Holder = l.id
+	} else if head := l.queue.Front(); head != nil && sameRequest(head.Value.(message), l.entered) {
+		s.Holder = l.entered.SenderID
+	}
+	return s
+}
+
+// RequestTime is logical time of current or last request
+func (l *Node) RequestTime() uint {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.requestTime
+}
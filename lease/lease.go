@@ -0,0 +1,53 @@
+// Package lease describes time limited grants of a lock. Every grant carries a
+// fencing token which is larger than the token of any earlier grant of the
+// same lock. A resource guarded by the lock remembers the largest token it has
+// seen and rejects requests carrying a smaller one, so a holder whose lease
+// ran out can't overwrite the work of the next holder.
+package lease
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Grace is how long peers wait past a lease before they consider the holder
+// released. It must be longer than a message takes to reach any peer, so the
+// holder's own lease always runs out first.
+var Grace = time.Second
+
+var ErrExpired = errors.New("lease expired")
+var ErrStaleFence = errors.New("stale fencing token")
+
+// Grant is what a node gets on entering CS
+type Grant struct {
+	Fence   uint64    `json:"fence"`
+	Expires time.Time `json:"expires"` // zero if lease mode is off
+}
+
+// Valid reports whether the lease is not over yet
+func (g Grant) Valid() bool {
+	return g.Expires.IsZero() || time.Now().Before(g.Expires)
+}
+
+// Guard sits in front of a resource and lets through fencing tokens which
+// are not older than the newest one seen so far.
+type Guard struct {
+	lock *sync.Mutex
+	last uint64
+}
+
+func NewGuard() *Guard {
+	return &Guard{lock: &sync.Mutex{}}
+}
+
+// Check returns ErrStaleFence if a newer fence was checked before
+func (g *Guard) Check(fence uint64) error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if fence < g.last {
+		return ErrStaleFence
+	}
+	g.last = fence
+	return nil
+}
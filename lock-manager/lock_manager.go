@@ -0,0 +1,206 @@
+package lockmanager
+
+import (
+	"context"
+	"distributed-lock-example/lamport"
+	"distributed-lock-example/lease"
+	"distributed-lock-example/logger"
+	"distributed-lock-example/raymond"
+	"distributed-lock-example/transport"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrClosed = errors.New("lock manager is closed")
+var ErrUnknownLock = errors.New("unknown lock")
+
+// Lock is the state machine of a single named lock
+type Lock interface {
+	Acquire(ctx context.Context, CSID string) error
+	AcquireLease(ctx context.Context, CSID string) (lease.Grant, error)
+	TryAcquire(CSID string) (bool, error)
+	Release() error
+	Close() error
+	Start()
+	SetLease(d time.Duration)
+	Status() Status
+}
+
+// Status of a lock as seen by this node
+type Status struct {
+	Name   string `json:"name"`
+	InCS   bool   `json:"inCS"`   // this node holds the lock
+	Holder int    `json:"holder"` // -1 if the lock is free, or held by a peer this node doesn't know of
+	Queue  []int  `json:"queue"`
+	Clock  uint   `json:"clock,omitempty"`
+}
+
+// lamportLock reports the node in CS as holder. The head of lamport's queue
+// may still be waiting for replies, so a peer counts as holder only once it
+// told it entered, which it does in lease mode.
+type lamportLock struct {
+	*lamport.Node
+}
+
+func (l lamportLock) Status() Status {
+	s := l.Node.Status()
+	return Status{InCS: s.InCS, Holder: s.Holder, Queue: s.Queue, Clock: s.Clock}
+}
+
+// raymondLock reports raymond's holder, which is this node if it has the
+// token or the neighbour towards the token otherwise.
+type raymondLock struct {
+	*raymond.Node
+}
+
+func (r raymondLock) Status() Status {
+	s := r.Node.Status()
+	return Status{InCS: s.InCS, Holder: s.Holder, Queue: s.Queue}
+}
+
+// NewLock creates the lock called name, talking to peers over t
+type NewLock func(name string, t transport.Transport) Lock
+
+// LockManager holds any number of named locks shared by the same set of
+// peers. Every lock runs its own algorithm instance on a channel of one
+// transport.Mux, so all of them share one socket. A lock is created the first
+// time it is used here or the first time a peer sends a message about it.
+// All peers must use the same kind of lock.
+type LockManager struct {
+	id      int
+	newLock NewLock
+	mux     *transport.Mux
+	locks   map[string]Lock
+	lease   time.Duration
+	closed  bool
+	lock    *sync.Mutex
+	log     *logger.Logger
+}
+
+// New creates a lock manager whose locks are made by newLock. Every lock gets
+// leaseDuration before it starts, 0 turns lease mode off.
+func New(id int, t transport.Transport, leaseDuration time.Duration, newLock NewLock) *LockManager {
+	m := &LockManager{id: id, newLock: newLock,
+		locks: map[string]Lock{},
+		lease: leaseDuration,
+		lock:  &sync.Mutex{},
+		log:   &logger.Logger{Prefix: fmt.Sprintf("[%d]", id)},
+	}
+	m.mux = transport.NewMux(t, func(name string) {
+		m.get(name)
+	})
+	return m
+}
+
+// NewLamport creates a lock manager whose locks are lamport nodes
+func NewLamport(id int, neighbourIDs []int, leaseDuration time.Duration, t transport.Transport) *LockManager {
+	return New(id, t, leaseDuration, func(_ string, t transport.Transport) Lock {
+		return lamportLock{lamport.NewNode(id, neighbourIDs, t)}
+	})
+}
+
+// NewRaymond creates a lock manager whose locks are raymond nodes. The token of
+// every lock starts at holder.
+func NewRaymond(id int, neighbourIDs []int, holder int, leaseDuration time.Duration, t transport.Transport) *LockManager {
+	return New(id, t, leaseDuration, func(_ string, t transport.Transport) Lock {
+		return raymondLock{raymond.NewNode(id, neighbourIDs, holder, t)}
+	})
+}
+
+func (m *LockManager) ID() int {
+	return m.id
+}
+
+// get returns the lock called name, creating and starting it if needed
+func (m *LockManager) get(name string) (Lock, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.closed {
+		return nil, ErrClosed
+	}
+	if l, ok := m.locks[name]; ok {
+		return l, nil
+	}
+	m.log.Println("🔒 new lock ", name)
+	l := m.newLock(name, m.mux.Channel(name))
+	l.SetLease(m.lease)
+	m.locks[name] = l
+	go l.Start()
+	return l, nil
+}
+
+// Acquire blocks until this node holds lock name, or ctx is done
+func (m *LockManager) Acquire(ctx context.Context, name string) error {
+	l, err := m.get(name)
+	if err != nil {
+		return err
+	}
+	return l.Acquire(ctx, name)
+}
+
+// AcquireLease is Acquire which returns the grant with its fencing token
+func (m *LockManager) AcquireLease(ctx context.Context, name string) (lease.Grant, error) {
+	l, err := m.get(name)
+	if err != nil {
+		return lease.Grant{}, err
+	}
+	return l.AcquireLease(ctx, name)
+}
+
+func (m *LockManager) TryAcquire(name string) (bool, error) {
+	l, err := m.get(name)
+	if err != nil {
+		return false, err
+	}
+	return l.TryAcquire(name)
+}
+
+func (m *LockManager) Release(name string) error {
+	m.lock.Lock()
+	l, ok := m.locks[name]
+	m.lock.Unlock()
+	if !ok {
+		return ErrUnknownLock
+	}
+	return l.Release()
+}
+
+// Status returns state of lock name
+func (m *LockManager) Status(name string) (Status, error) {
+	m.lock.Lock()
+	l, ok := m.locks[name]
+	m.lock.Unlock()
+	if !ok {
+		return Status{}, ErrUnknownLock
+	}
+	s := l.Status()
+	s.Name = name
+	return s, nil
+}
+
+// Locks returns names of known locks, sorted
+func (m *LockManager) Locks() []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	names := make([]string, 0, len(m.locks))
+	for name := range m.locks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Close closes every lock and the transport
+func (m *LockManager) Close() error {
+	m.lock.Lock()
+	m.closed = true
+	locks := m.locks
+	m.lock.Unlock()
+	for _, l := range locks {
+		l.Close()
+	}
+	return m.mux.Close()
+}
@@ -0,0 +1,150 @@
+package lockmanager
+
+import (
+	"context"
+	"distributed-lock-example/transport"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(ioutil.Discard) // locks log every message
+	os.Exit(m.Run())
+}
+
+func others(id int, n int) []int {
+	ids := []int{}
+	for other := 0; other < n; other++ {
+		if other != id {
+			ids = append(ids, other)
+		}
+	}
+	return ids
+}
+
+// newManagers creates managers 0..n-1, each on a single transport of one
+// network. They are closed when the test ends.
+func newManagers(t *testing.T, n int, create func(id int, t transport.Transport) *LockManager) []*LockManager {
+	network := transport.NewNetwork()
+	managers := []*LockManager{}
+	for id := 0; id < n; id++ {
+		managers = append(managers, create(id, network.Join(id)))
+	}
+	t.Cleanup(func() {
+		for _, m := range managers {
+			m.Close()
+		}
+	})
+	return managers
+}
+
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal(what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestLocksShareOneTransport(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		create func(id int, t transport.Transport) *LockManager
+	}{
+		{"lamport", func(id int, t transport.Transport) *LockManager { return NewLamport(id, others(id, 3), 0, t) }},
+		{"raymond", func(id int, t transport.Transport) *LockManager {
+			if id == 0 {
+				return NewRaymond(id, []int{1, 2}, 0, 0, t)
+			}
+			return NewRaymond(id, []int{0}, 0, 0, t)
+		}},
+	} {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			m := newManagers(t, 3, c.create)
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			if err := m[1].Acquire(ctx, "a"); err != nil {
+				t.Fatal(err)
+			}
+			// peers create "a" when its first message arrives, and only "a"
+			eventually(t, "lock a never created at 0", func() bool { return fmt.Sprint(m[0].Locks()) == "[a]" })
+			if _, err := m[2].Status("b"); err != ErrUnknownLock {
+				t.Fatalf("status of b before anyone used it: %v", err)
+			}
+
+			// "a" being held doesn't hold up "b"
+			if err := m[2].Acquire(ctx, "b"); err != nil {
+				t.Fatal(err)
+			}
+			if ok, err := m[0].TryAcquire("a"); ok || err != nil {
+				t.Fatalf("acquired a held lock: %v, %v", ok, err)
+			}
+			if ok, err := m[0].TryAcquire("c"); !ok || err != nil {
+				t.Fatalf("free lock c not acquired: %v, %v", ok, err)
+			}
+			for _, name := range []string{"a", "b", "c"} {
+				s, err := m[0].Status(name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if s.InCS != (name == "c") {
+					t.Fatalf("lock %s in CS: %v", name, s.InCS)
+				}
+			}
+
+			if err := m[1].Release("a"); err != nil {
+				t.Fatal(err)
+			}
+			if err := m[0].Acquire(ctx, "a"); err != nil {
+				t.Fatal(err)
+			}
+			if err := m[1].Release("d"); err != ErrUnknownLock {
+				t.Fatalf("release of a lock never used here: %v", err)
+			}
+		})
+	}
+}
+
+func TestLamportHolderIsInCS(t *testing.T) {
+	// node 2 never joins, so node 1 never gets its reply and can't enter
+	m := newManagers(t, 2, func(id int, t transport.Transport) *LockManager { return NewLamport(id, others(id, 3), 0, t) })
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go m[1].Acquire(ctx, "a")
+	eventually(t, "request of 1 never reached 0", func() bool {
+		s, err := m[0].Status("a")
+		return err == nil && fmt.Sprint(s.Queue) == "[1]"
+	})
+	for _, manager := range m {
+		if s, _ := manager.Status("a"); s.Holder != -1 || s.InCS {
+			t.Fatalf("holder at %d is %d before anyone entered", manager.ID(), s.Holder)
+		}
+	}
+
+	m = newManagers(t, 2, func(id int, t transport.Transport) *LockManager { return NewLamport(id, others(id, 2), time.Minute, t) })
+	if err := m[1].Acquire(context.Background(), "a"); err != nil {
+		t.Fatal(err)
+	}
+	if s, _ := m[1].Status("a"); s.Holder != 1 || !s.InCS {
+		t.Fatalf("holder at 1 is %d", s.Holder)
+	}
+	// in lease mode the holder tells it entered
+	eventually(t, "0 never learned 1 entered", func() bool {
+		s, _ := m[0].Status("a")
+		return s.Holder == 1
+	})
+	m[1].Release("a")
+	eventually(t, "0 still sees 1 as holder", func() bool {
+		s, _ := m[0].Status("a")
+		return s.Holder == -1
+	})
+}
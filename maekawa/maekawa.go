@@ -0,0 +1,328 @@
+package maekawa
+
+import (
+	"distributed-lock-example/lamport"
+	"distributed-lock-example/logger"
+	"distributed-lock-example/transport"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+)
+
+var MessageRequest string = "request"
+var MessageLocked string = "locked"
+var MessageFailed string = "failed"
+var MessageInquire string = "inquire"
+var MessageRelinquish string = "relinquish"
+var MessageRelease string = "release"
+
+type message struct {
+	SenderID   int    `json:"senderId"`
+	ReceiverID int    `json:"receiverId"`
+	Message    string `json:"message"`
+	Time       uint   `json:"time"`
+}
+
+type request struct {
+	ID   int
+	Time uint
+}
+
+// before tells whether r has higher priority than o. lower time wins, ties are broken by id
+func (r request) before(o request) bool {
+	return r.Time < o.Time || (r.Time == o.Time && r.ID < o.ID)
+}
+
+// Quorum arranges ids in a ceil(sqrt(N)) wide grid and returns the row and
+// the column which id sits in. Any two quorums have at least one node in common.
+func Quorum(id int, ids []int) []int {
+	sorted := append([]int{}, ids...)
+	sort.Ints(sorted)
+	k := int(math.Ceil(math.Sqrt(float64(len(sorted)))))
+	pos := sort.SearchInts(sorted, id)
+	row, col := pos/k, pos%k
+
+	quorum := []int{}
+	for i, member := range sorted {
+		if i/k == row || i%k == col {
+			quorum = append(quorum, member)
+		}
+	}
+	return quorum
+}
+
+// Node implements maekawa's algorithm. A node needs votes of its quorum only,
+// about 2*sqrt(N) nodes, instead of every node. Every node is also an arbiter
+// which votes for one request at a time.
+//
+// Plain voting can deadlock when requests reach arbiters in different orders.
+// An arbiter which voted for a request asks the voter to give the vote back
+// (INQUIRE) when a higher priority request arrives. The requester gives it back
+// (RELINQUISH) once it knows it can't get all votes yet, which it learns from a
+// FAILED reply of some other arbiter.
+type Node struct {
+	id     int
+	quorum []int
+	clock  *lamport.Clock
+
+	// requester state
+	requesting bool
+	request    request
+	votes      map[int]bool
+	failed     bool
+	inquiries  map[int]bool // arbiters which asked for their vote back
+	using      bool         // got all votes, in CS or about to enter
+	inCS       bool
+
+	// arbiter state
+	locked     *request
+	inquired   bool
+	waiting    []request // sorted by priority
+	failedSent map[int]bool
+
+	local     []message // messages to itself, handled after the current one
+	waitCh    chan struct{}
+	log       *logger.Logger
+	lock      *sync.Mutex
+	transport transport.Transport
+}
+
+// NewNode creates a node. its quorum is built from its own id and neighbourIDs,
+// every node must be given the same set of nodes.
+func NewNode(id int, neighbourIDs []int, t transport.Transport) *Node {
+	return &Node{id: id,
+		quorum:     Quorum(id, append([]int{id}, neighbourIDs...)),
+		clock:      &lamport.Clock{},
+		votes:      map[int]bool{},
+		inquiries:  map[int]bool{},
+		failedSent: map[int]bool{},
+		waitCh:     make(chan struct{}, 1),
+		log:        &logger.Logger{Prefix: fmt.Sprintf("[%d]", id)},
+		lock:       &sync.Mutex{},
+		transport:  t,
+	}
+}
+
+func (n *Node) ID() int {
+	return n.id
+}
+
+func (n *Node) send(to int, msg string) {
+	m := message{SenderID: n.id, ReceiverID: to, Message: msg, Time: n.clock.Time()}
+	if to == n.id {
+		n.local = append(n.local, m)
+		return
+	}
+	b, _ := json.Marshal(m)
+	if err := n.transport.Send(to, b); err != nil {
+		n.log.Println("❗️ ", err)
+	}
+	n.log.Println("->> ", string(b))
+}
+
+// flush handles messages a node sent to itself
+func (n *Node) flush() {
+	for len(n.local) > 0 {
+		m := n.local[0]
+		n.local = n.local[1:]
+		n.handle(m)
+	}
+}
+
+func (n *Node) ProcessMessage(b []byte) {
+	var m message
+	if err := json.Unmarshal(b, &m); err != nil {
+		n.log.Println("❗️", err)
+		return
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	n.clock.Receive(m.Time)
+	n.handle(m)
+	n.flush()
+}
+
+func (n *Node) handle(m message) {
+	switch m.Message {
+	// arbiter side
+	case MessageRequest:
+		n.onRequest(request{ID: m.SenderID, Time: m.Time})
+	case MessageRelinquish:
+		if n.locked != nil && n.locked.ID == m.SenderID {
+			n.enqueue(*n.locked)
+			n.vote()
+		}
+	case MessageRelease:
+		if n.locked != nil && n.locked.ID == m.SenderID {
+			n.locked = nil
+			n.vote()
+		}
+
+	// requester side
+	case MessageLocked:
+		if !n.requesting {
+			return
+		}
+		n.votes[m.SenderID] = true
+		if len(n.votes) == len(n.quorum) {
+			n.log.Println("got votes of whole quorum")
+			n.using = true
+			n.inquiries = map[int]bool{}
+			select {
+			case n.waitCh <- struct{}{}:
+			default:
+			}
+		}
+	case MessageFailed:
+		if !n.requesting || n.using {
+			return
+		}
+		n.failed = true
+		// in id order, so a run replays the same way every time
+		arbiters := []int{}
+		for arbiter := range n.inquiries {
+			arbiters = append(arbiters, arbiter)
+		}
+		sort.Ints(arbiters)
+		for _, arbiter := range arbiters {
+			n.relinquish(arbiter)
+		}
+	case MessageInquire:
+		if !n.requesting || n.using || !n.votes[m.SenderID] {
+			return // vote was already given back or will be released on exit
+		}
+		if n.failed {
+			n.relinquish(m.SenderID)
+		} else {
+			n.inquiries[m.SenderID] = true
+		}
+	}
+}
+
+func (n *Node) relinquish(arbiter int) {
+	n.log.Println("giving vote back to ", arbiter)
+	delete(n.votes, arbiter)
+	delete(n.inquiries, arbiter)
+	n.send(arbiter, MessageRelinquish)
+}
+
+func (n *Node) enqueue(r request) {
+	i := sort.Search(len(n.waiting), func(i int) bool { return r.before(n.waiting[i]) })
+	n.waiting = append(n.waiting, request{})
+	copy(n.waiting[i+1:], n.waiting[i:])
+	n.waiting[i] = r
+}
+
+// vote locks arbiter for the highest priority waiting request
+func (n *Node) vote() {
+	n.locked = nil
+	n.inquired = false
+	if len(n.waiting) == 0 {
+		return
+	}
+	r := n.waiting[0]
+	n.waiting = n.waiting[1:]
+	delete(n.failedSent, r.ID)
+	n.locked = &r
+	n.send(r.ID, MessageLocked)
+}
+
+func (n *Node) onRequest(r request) {
+	if n.locked == nil {
+		n.locked = &r
+		n.inquired = false
+		n.send(r.ID, MessageLocked)
+		return
+	}
+
+	n.enqueue(r)
+	if n.locked.before(r) || n.waiting[0] != r {
+		n.failedSent[r.ID] = true
+		n.send(r.ID, MessageFailed)
+		return
+	}
+
+	// r is ahead of everyone. requests it overtook can't count on this vote
+	for _, w := range n.waiting[1:] {
+		if !n.failedSent[w.ID] {
+			n.failedSent[w.ID] = true
+			n.send(w.ID, MessageFailed)
+		}
+	}
+	if !n.inquired {
+		n.inquired = true
+		n.send(n.locked.ID, MessageInquire)
+	}
+}
+
+func (n *Node) InCS() bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.inCS
+}
+
+func (n *Node) EnterCS() {
+	n.log.Println("entering to CS")
+	n.lock.Lock()
+	n.clock.Tick()
+	n.inCS = true
+	n.lock.Unlock()
+}
+
+func (n *Node) ExitCS() {
+	n.log.Println("exiting CS")
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	n.clock.Tick()
+	n.inCS = false
+	n.using = false
+	n.requesting = false
+	n.votes = map[int]bool{}
+	for _, id := range n.quorum {
+		n.send(id, MessageRelease)
+	}
+	n.flush()
+}
+
+func (n *Node) AskToEnterCS(_ string /* just to satisfy interface */) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	n.clock.Tick()
+	n.requesting = true
+	n.request = request{ID: n.id, Time: n.clock.Time()}
+	n.votes = map[int]bool{}
+	n.inquiries = map[int]bool{}
+	n.failed = false
+	for _, id := range n.quorum {
+		n.send(id, MessageRequest)
+	}
+	n.flush()
+}
+
+func (n *Node) WaitForCS() {
+	<-n.waitCh
+}
+
+// TryWaitForCS is WaitForCS which doesn't block. It reports whether CS was
+// granted.
+func (n *Node) TryWaitForCS() bool {
+	select {
+	case <-n.waitCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// Start handles messages one at a time, in the order the transport delivers them
+func (n *Node) Start() {
+	for b := range n.transport.Receive() {
+		n.log.Println("<<- ", string(b))
+		n.ProcessMessage(b)
+	}
+}
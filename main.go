@@ -1,19 +1,28 @@
 package main
 
 import (
+	"context"
+	"distributed-lock-example/detector"
+	"distributed-lock-example/discovery"
+	"distributed-lock-example/dlock"
+	"distributed-lock-example/faults"
+	"distributed-lock-example/joung"
 	"distributed-lock-example/lamport"
 	lamport_K_entry "distributed-lock-example/lamport-K-entry"
+	"distributed-lock-example/maekawa"
+	"distributed-lock-example/membership"
+	"distributed-lock-example/peers"
 	"distributed-lock-example/raymond"
 	raymond_K_entry "distributed-lock-example/raymond-K-entry"
+	ricart_agrawala "distributed-lock-example/ricart-agrawala"
+	suzuki_kasami "distributed-lock-example/suzuki-kasami"
+	"distributed-lock-example/transport"
 	udpclient "distributed-lock-example/udpclient"
 	"encoding/json"
-	"errors"
 	"flag"
 	"log"
 	"math/rand"
 	"os"
-	"strconv"
-	"strings"
 	"time"
 )
 
@@ -37,6 +46,36 @@ var _ Algorithm = &raymond.Node{}
 var _ Algorithm = &lamport.Node{}
 var _ Algorithm = &lamport_K_entry.Node{}
 var _ Algorithm = &raymond_K_entry.Node{}
+var _ Algorithm = &ricart_agrawala.Node{}
+var _ Algorithm = &suzuki_kasami.Node{}
+var _ Algorithm = &maekawa.Node{}
+var _ Algorithm = &joung.Node{}
+
+// Locker is the error returning, cancellable way to use an algorithm
+type Locker interface {
+	// Acquire blocks until in CS. request is withdrawn if ctx is done first
+	Acquire(ctx context.Context, CSID string) error
+	TryAcquire(CSID string) (bool, error)
+	Release() error
+	Close() error
+}
+
+var _ Locker = &raymond.Node{}
+var _ Locker = &lamport.Node{}
+var _ Locker = &lamport_K_entry.Node{}
+var _ Locker = &raymond_K_entry.Node{}
+
+// PeerRemover can exclude a dead peer and keep going without it
+type PeerRemover interface {
+	RemovePeer(id int)
+}
+
+var _ PeerRemover = &lamport.Node{}
+var _ PeerRemover = &lamport_K_entry.Node{}
+var _ PeerRemover = &raymond.Node{}
+
+var _ membership.Peer = &lamport.Node{}
+var _ membership.Peer = &lamport_K_entry.Node{}
 
 type guiMessage struct {
 	SenderID int      `json:"senderId"`
@@ -57,6 +96,8 @@ type car struct {
 	gui       *udpclient.Client
 	direction Direction
 	algo      Algorithm
+	lock      *dlock.Mutex
+	bridge    *dlock.Mutex // lock for current direction. set while on bridge
 }
 
 func (c *car) start() {
@@ -67,15 +108,20 @@ func (c *car) onBridge() bool {
 	return c.algo.InCS()
 }
 
-func (c *car) enterBridge() {
+func (c *car) enterBridge(d Direction) {
+	log.Println("asking to enter bridge")
+	c.bridge = c.lock.WithCSID(string(d))
+	c.bridge.Lock()
 	log.Println("entering bridge...")
-	c.algo.EnterCS()
-
 }
 
 func (c *car) leaveBridge() {
 	log.Println("leaving bridge...")
-	c.algo.ExitCS()
+	if !c.onBridge() {
+		log.Println("❗️ crossed the bridge without being in CS")
+	}
+	c.bridge.Unlock()
+	c.bridge = nil
 	if c.direction == DirectionEast {
 		c.direction = DirectionWest
 	} else {
@@ -91,24 +137,12 @@ func (c *car) leavingBridge(pos int, direction Direction) bool {
 	return pos == bridgeStartEndIndices[direction][1]
 }
 
-func (c *car) askToEnterBridge(d Direction) {
-	log.Println("asking to enter bridge")
-	c.algo.AskToEnterCS(string(d))
-}
-
-func (c *car) waitForReply() {
-	log.Println("waiting for permission...")
-	c.algo.WaitForCS()
-}
-
 func (c *car) startMovement(startPos int) {
 	for i := startPos; i < len(travellingPath); i++ {
 		pos := position{X: travellingPath[i][0], Y: travellingPath[i][1]}
 
 		if c.enteringBridge(i, c.direction) {
-			go c.askToEnterBridge(c.direction)
-			c.waitForReply()
-			c.enterBridge()
+			c.enterBridge(c.direction)
 		} else if c.leavingBridge(i, c.direction) {
 			c.leaveBridge()
 		}
@@ -133,29 +167,6 @@ func (c *car) startMovement(startPos int) {
 
 type strs []string
 
-type neighboursFlag map[int]string
-
-func (i *neighboursFlag) String() string {
-	return ""
-}
-
-func (i *neighboursFlag) Set(value string) error {
-	splitted := strings.SplitN(value, ":", 2)
-	if len(splitted) != 2 {
-		return errors.New("must be in format of <id>:<addr>")
-	}
-	id, err := strconv.Atoi(splitted[0])
-	if err != nil {
-		return err
-	}
-	if *i == nil {
-		*i = map[int]string{}
-	}
-	(*i)[id] = splitted[1]
-	// *i = append(*i, value)
-	return nil
-}
-
 func (i *strs) String() string {
 	return ""
 }
@@ -172,16 +183,38 @@ func main() {
 	var listenAddr string
 	var guiAddr string
 
-	var neighbours neighboursFlag
+	var neighbours peers.Flag
 	var holder int
 	var tokens int
+	var reliable bool
+	var transportName string
+	var detect bool
+	var join int
+	var leave bool
+	var seed string
+	var bootstrap bool
+	var discover bool
+	var discoverIface string
+	var nodes int
+	var faultsPath string
 	flag.IntVar(&id, "id", -1, "id of car")
-	flag.IntVar(&holder, "holder", -1, "initial holder of token") // applicable to raymond and raymond-K-entry
-	flag.IntVar(&tokens, "tokens", 0, "num of tokens")            // applicable only to ramond-K-entry
-	flag.StringVar(&algorithm, "algorithm", "lamport", "raymond or lamport")
+	flag.IntVar(&holder, "holder", -1, "initial holder of token")                    // applicable to raymond, raymond-K-entry and suzuki-kasami
+	flag.IntVar(&tokens, "tokens", 1, "max num of cars on bridge in same direction") // applicable only to raymond-K-entry
+	flag.StringVar(&algorithm, "algorithm", "lamport", "raymond, lamport, lamport-K-entry, raymond-K-entry, ricart-agrawala, suzuki-kasami, maekawa or joung")
 	flag.StringVar(&listenAddr, "listen", "", "own listening address")
 	flag.StringVar(&guiAddr, "gui", "", "address of GUI")
 	flag.Var(&neighbours, "neighbour", "neighbour ids")
+	flag.BoolVar(&reliable, "reliable", false, "retransmit lost messages and drop duplicates")
+	flag.StringVar(&transportName, "transport", "udp", "udp or tcp")
+	flag.BoolVar(&detect, "detect", false, "send heartbeats and drop peers which go silent. a live peer dropped by mistake may enter CS together with others. all nodes must agree on it")
+	flag.IntVar(&join, "join", -1, "join a running tree under this neighbour") // applicable only to raymond
+	flag.BoolVar(&leave, "leave", false, "leave the tree or cluster and exit when done")
+	flag.StringVar(&seed, "seed", "", "join a running cluster through the car at this address") // applicable to lamport and lamport-K-entry
+	flag.BoolVar(&bootstrap, "bootstrap", false, "start a new cluster which others join with --seed")
+	flag.BoolVar(&discover, "discover", false, "find neighbours by multicast instead of --neighbour")
+	flag.StringVar(&discoverIface, "discover-iface", "", "interface to multicast on. loopback if empty")
+	flag.IntVar(&nodes, "nodes", len(carStartIndices), "num of cars to wait for with --discover")
+	flag.StringVar(&faultsPath, "faults", "", "scenario file of network faults to inject")
 	flag.Parse()
 	rand.Seed(time.Now().UnixNano() + int64(id))
 
@@ -199,27 +232,115 @@ func main() {
 		carDirection = DirectionEast
 	}
 
+	if discover {
+		if len(neighbours) > 0 || seed != "" || bootstrap {
+			log.Fatalln("--discover finds neighbours itself")
+		}
+		neighbours, holder, err = discoverNeighbours(id, listenAddr, algorithm, discoverIface, nodes)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	var scenario *faults.Scenario
+	if faultsPath != "" {
+		scenario, err = faults.Load(faultsPath)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+	t, err := peers.NewTransport(id, transportName, listenAddr, neighbours, reliable, scenario)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	dynamic := seed != "" || bootstrap
+	if dynamic && detect {
+		log.Fatalln("--detect needs peers given with --neighbour")
+	}
+	var d *detector.Detector
+	var membershipT transport.Transport
+	if detect || dynamic {
+		// heartbeats and membership share the socket with the algorithm
+		mux := transport.NewMux(t, nil)
+		t = mux.Channel("algorithm")
+		if detect {
+			d = detector.New(id, neighbours.IDs(), mux.Channel("heartbeat"), detector.Config{Timeout: 3 * time.Second})
+		}
+		membershipT = mux.Channel("membership")
+	}
+
 	var algo Algorithm
 	switch algorithm {
 	case "raymond":
-		algo = raymond.NewNode(id, listenAddr, neighbours, holder)
+		algo = raymond.NewNode(id, neighbours.IDs(), holder, t)
 	case "lamport-K-entry":
-		algo = lamport_K_entry.NewNode(id, listenAddr, neighbours)
+		algo = lamport_K_entry.NewNode(id, neighbours.IDs(), t)
 	case "raymond-K-entry":
-		algo = raymond_K_entry.NewNode(id, listenAddr, neighbours, holder, tokens)
+		algo = raymond_K_entry.NewNode(id, neighbours.IDs(), holder, tokens, t)
+	case "ricart-agrawala":
+		algo = ricart_agrawala.NewNode(id, neighbours.IDs(), t)
+	case "suzuki-kasami":
+		algo = suzuki_kasami.NewNode(id, neighbours.IDs(), holder, t)
+	case "maekawa":
+		algo = maekawa.NewNode(id, neighbours.IDs(), t)
+	case "joung":
+		algo = joung.NewNode(id, neighbours.IDs(), t)
 	default:
-		algo = lamport.NewNode(id, listenAddr, neighbours)
+		algo = lamport.NewNode(id, neighbours.IDs(), t)
+	}
+
+	if d != nil {
+		if r, ok := algo.(PeerRemover); ok {
+			d.Subscribe(func(e detector.Event) {
+				if e.Type == detector.EventSuspect {
+					r.RemovePeer(e.Peer)
+				}
+			})
+		}
+		go d.Start()
+	}
+
+	var members *membership.Service
+	if dynamic {
+		p, ok := algo.(membership.Peer)
+		if !ok {
+			log.Fatalln("--seed and --bootstrap work with lamport and lamport-K-entry only")
+		}
+		members = membership.New(id, listenAddr, membershipT, p)
+		go members.Start()
 	}
 
 	c := car{gui: gui,
 		direction: carDirection,
 		algo:      algo,
+		lock:      dlock.New(algo),
 	}
 
 	go c.start()
 
+	tree, _ := algo.(*raymond.Node)
+	if tree != nil && join != -1 {
+		if err := tree.Join(join, listenAddr); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
 	doneCh := make(chan struct{})
-	time.Sleep(time.Duration((rand.Intn(6) + 6)) * time.Second) // wait for others to join
+	switch {
+	case bootstrap:
+		if err := members.Bootstrap(); err != nil {
+			log.Fatalln(err)
+		}
+	case seed != "":
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		err := members.Join(ctx, seed)
+		cancel()
+		if err != nil {
+			log.Fatalln(err)
+		}
+	default:
+		time.Sleep(time.Duration((rand.Intn(6) + 6)) * time.Second) // wait for others to join
+	}
 
 	for i := 0; i < iterations; i++ {
 		if i == 0 {
@@ -230,5 +351,51 @@ func main() {
 		}
 	}
 	log.Println("✅ DONE")
+	if leave && (tree != nil || members != nil) {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if tree != nil {
+			err = tree.Leave(ctx)
+		} else {
+			err = members.Leave(ctx)
+		}
+		if err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
 	<-doneCh // donot exit program. because it still needs to respond other unfinished peers
 }
+
+// discoverNeighbours waits for the other cars to announce themselves. Tree
+// algorithms get a star around the car with the lowest id, which starts with
+// the token.
+func discoverNeighbours(id int, listenAddr string, algorithm string, iface string, nodes int) (peers.Flag, int, error) {
+	d, err := discovery.New(id, listenAddr, algorithm, iface)
+	if err != nil {
+		return nil, -1, err
+	}
+	go d.Start() // keeps announcing for cars which start later
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	found, err := d.Wait(ctx, nodes-1)
+	if err != nil {
+		return nil, -1, err
+	}
+	neighbours := peers.Flag(found)
+
+	root := id
+	for _, n := range neighbours.IDs() {
+		if n < root {
+			root = n
+		}
+	}
+	switch algorithm {
+	case "raymond", "raymond-K-entry":
+		if id != root {
+			neighbours = peers.Flag{root: found[root]}
+		}
+	}
+	return neighbours, root, nil
+}
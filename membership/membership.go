@@ -0,0 +1,493 @@
+// Package membership lets nodes of all-to-all algorithms like lamport join and
+// leave a running cluster. A new node only needs the address of one member,
+// the seed, and learns every other member from it.
+//
+// Members agree on views. A view is the list of members in the order they
+// joined, and every change makes a new view with the next epoch. Changes are
+// made one at a time by the coordinator, the oldest member. Other members
+// forward join and leave requests to it.
+//
+// A join takes three steps, so no request of the algorithm is lost:
+//
+//  1. prepare: the joiner installs the new view and acks. It knows every member
+//     now and accepts their messages, but doesn't ask for CS yet.
+//  2. install: the other members install the view and ack. A member which is
+//     waiting for CS sends its request to the joiner too and waits for its
+//     reply as well.
+//  3. commit: Join returns and the joiner may ask for CS. Every member accepts
+//     its messages by then.
+//
+// A leaving node must not be waiting for CS or be in it. Members install the
+// view without it, and Leave returns once all of them did. The coordinator
+// keeps the node reachable until it acks the commit. A node which left may
+// join again.
+//
+// Messages must not get lost, wrap lossy transports with transport.Reliable.
+// Only join and leave requests are retried.
+package membership
+
+import (
+	"context"
+	"distributed-lock-example/logger"
+	"distributed-lock-example/transport"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var MessageJoin string = "join"
+var MessageLeave string = "leave"
+var MessagePrepare string = "prepare"
+var MessageInstall string = "install"
+var MessageAck string = "ack"
+var MessageCommit string = "commit"
+
+// RetryInterval is how often join and leave requests are sent again until they
+// are done
+var RetryInterval = time.Second
+
+var ErrNotMember = errors.New("node is not a member")
+var ErrMember = errors.New("node is already a member")
+
+// seed addresses the seed before its id is known
+const seed = -1
+
+type Member struct {
+	ID   int    `json:"id"`
+	Addr string `json:"addr"`
+}
+
+// View is the set of members of an epoch, oldest first
+type View struct {
+	Epoch   uint64   `json:"epoch"`
+	Members []Member `json:"members"`
+}
+
+// IDs returns ids of members, oldest first
+func (v View) IDs() []int {
+	ids := []int{}
+	for _, m := range v.Members {
+		ids = append(ids, m.ID)
+	}
+	return ids
+}
+
+func (v View) Has(id int) bool {
+	for _, m := range v.Members {
+		if m.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (v View) coordinator() int {
+	if len(v.Members) == 0 {
+		return seed
+	}
+	return v.Members[0].ID
+}
+
+func (v View) with(m Member) View {
+	members := append([]Member{}, v.Members...)
+	return View{Epoch: v.Epoch + 1, Members: append(members, m)}
+}
+
+func (v View) without(id int) View {
+	members := []Member{}
+	for _, m := range v.Members {
+		if m.ID != id {
+			members = append(members, m)
+		}
+	}
+	return View{Epoch: v.Epoch + 1, Members: members}
+}
+
+// Peer is told about members joining and leaving. lamport and lamport-K-entry
+// nodes implement it.
+type Peer interface {
+	AddPeer(id int)
+	RemovePeer(id int)
+}
+
+type message struct {
+	SenderID   int    `json:"senderId"`
+	ReceiverID int    `json:"receiverId"`
+	Message    string `json:"message"`
+	ID         int    `json:"id"`              // joining or leaving node
+	Addr       string `json:"addr,omitempty"`  // of joining node
+	View       *View  `json:"view,omitempty"`  // in prepare, install and commit
+	Epoch      uint64 `json:"epoch,omitempty"` // of the view an ack is for
+}
+
+// change is the view change the coordinator is making
+type change struct {
+	request  message
+	view     View
+	prepared bool         // joiner installed the view
+	waiting  map[int]bool // members which haven't installed the view yet
+}
+
+type Service struct {
+	id        int
+	addr      string
+	view      View
+	change    *change
+	pending   []message      // requests waiting for the change in progress
+	leaving   map[int]uint64 // epoch of the commit sent to nodes which left, until they ack it
+	joined    chan struct{}  // closed while a member, made again on leaving
+	left      chan struct{}  // closed while not a member, made again on joining
+	log       *logger.Logger
+	lock      *sync.Mutex
+	transport transport.Transport
+	peer      Peer
+}
+
+// New creates the membership service of node id, reachable at addr. t should
+// be a channel of the node's transport, see transport.Mux.
+func New(id int, addr string, t transport.Transport, p Peer) *Service {
+	return &Service{id: id, addr: addr,
+		leaving:   map[int]uint64{},
+		joined:    make(chan struct{}),
+		left:      make(chan struct{}),
+		log:       &logger.Logger{Prefix: fmt.Sprintf("[%d]", id)},
+		lock:      &sync.Mutex{},
+		transport: t,
+		peer:      p,
+	}
+}
+
+// View returns the current view. It is empty before the node joined.
+func (s *Service) View() View {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return View{Epoch: s.view.Epoch, Members: append([]Member{}, s.view.Members...)}
+}
+
+func (s *Service) send(m message) {
+	b, _ := json.Marshal(m)
+	if err := s.transport.Send(m.ReceiverID, b); err != nil {
+		s.log.Println("❗️ ", err)
+	}
+	s.log.Println("->> ", string(b))
+}
+
+// Bootstrap makes this node the only member of a new cluster
+func (s *Service) Bootstrap() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.view.Has(s.id) {
+		return ErrMember
+	}
+	s.view = View{Epoch: 1, Members: []Member{{ID: s.id, Addr: s.addr}}}
+	s.setJoined()
+	s.log.Println("🌱 started cluster")
+	return nil
+}
+
+// setJoined closes joined and makes left for the next Leave. It reports false
+// if the node had joined already. expects s.lock to be held
+func (s *Service) setJoined() bool {
+	select {
+	case <-s.joined:
+		return false
+	default:
+	}
+	close(s.joined)
+	s.left = make(chan struct{})
+	return true
+}
+
+// setLeft closes left and makes joined for the next Join or Bootstrap. It
+// reports false if the node had left already. expects s.lock to be held
+func (s *Service) setLeft() bool {
+	select {
+	case <-s.left:
+		return false
+	default:
+	}
+	close(s.left)
+	s.joined = make(chan struct{})
+	return true
+}
+
+// Join asks the member at seedAddr to add this node and blocks until every
+// member knows it, or ctx is done.
+func (s *Service) Join(ctx context.Context, seedAddr string) error {
+	s.lock.Lock()
+	member := s.view.Has(s.id)
+	joined := s.joined
+	s.lock.Unlock()
+	if member {
+		return ErrMember
+	}
+	if err := transport.AddPeer(s.transport, seed, seedAddr); err != nil {
+		return err
+	}
+	return s.retry(ctx, joined, message{SenderID: s.id, ReceiverID: seed, Message: MessageJoin, ID: s.id, Addr: s.addr})
+}
+
+// Leave asks the coordinator to remove this node and blocks until every other
+// member removed it, or ctx is done. The node must not ask for CS anymore.
+func (s *Service) Leave(ctx context.Context) error {
+	s.lock.Lock()
+	member := s.view.Has(s.id)
+	left := s.left
+	s.lock.Unlock()
+	if !member {
+		return ErrNotMember
+	}
+	return s.retry(ctx, left, message{SenderID: s.id, Message: MessageLeave, ID: s.id})
+}
+
+// retry sends request every RetryInterval until done is closed
+func (s *Service) retry(ctx context.Context, done chan struct{}, request message) error {
+	ticker := time.NewTicker(RetryInterval)
+	defer ticker.Stop()
+	for {
+		s.lock.Lock()
+		if request.Message == MessageLeave {
+			request.ReceiverID = s.view.coordinator()
+		}
+		if request.ReceiverID == s.id {
+			s.onRequest(request)
+		} else {
+			s.send(request)
+		}
+		s.lock.Unlock()
+
+		select {
+		case <-done:
+			return nil
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// install applies view v, telling peer who joined and who left. It returns
+// ids of members which left. The caller removes them from the transport once
+// it sent what they still need.
+func (s *Service) install(v View) []int {
+	if v.Epoch <= s.view.Epoch {
+		return nil
+	}
+	for _, m := range v.Members {
+		if m.ID != s.id && !s.view.Has(m.ID) {
+			if err := transport.AddPeer(s.transport, m.ID, m.Addr); err != nil {
+				s.log.Println("❗️", err)
+			}
+			s.peer.AddPeer(m.ID)
+		}
+	}
+	var left []int
+	for _, m := range s.view.Members {
+		if m.ID != s.id && !v.Has(m.ID) {
+			s.peer.RemovePeer(m.ID)
+			left = append(left, m.ID)
+		}
+	}
+	s.log.Printf("👥 view %d: %v", v.Epoch, v.IDs())
+	s.view = v
+	return left
+}
+
+func (s *Service) forget(ids []int) {
+	for _, id := range ids {
+		transport.RemovePeer(s.transport, id)
+	}
+}
+
+// onRequest handles join and leave requests. Only the coordinator makes
+// changes, others pass requests on to it.
+func (s *Service) onRequest(m message) {
+	coordinator := s.view.coordinator()
+	if coordinator == seed {
+		return // not a member yet
+	}
+	if coordinator != s.id {
+		m.SenderID, m.ReceiverID = s.id, coordinator
+		s.send(m)
+		return
+	}
+
+	// requests are sent again until they are done, so they can be duplicates
+	if c := s.change; c != nil && c.request.ID == m.ID && c.request.Message == m.Message {
+		if m.Message == MessageJoin && !c.prepared {
+			s.send(message{SenderID: s.id, ReceiverID: m.ID, Message: MessagePrepare, View: &c.view})
+		}
+		return
+	}
+	for _, p := range s.pending {
+		if p.ID == m.ID && p.Message == m.Message {
+			return
+		}
+	}
+	if s.change != nil {
+		s.pending = append(s.pending, m)
+		return
+	}
+	s.startChange(m)
+}
+
+// startChange expects s.lock to be held and no change in progress
+func (s *Service) startChange(m message) {
+	switch m.Message {
+	case MessageJoin:
+		if s.view.Has(m.ID) {
+			v := s.view
+			s.send(message{SenderID: s.id, ReceiverID: m.ID, Message: MessageCommit, View: &v})
+			return
+		}
+		if err := transport.AddPeer(s.transport, m.ID, m.Addr); err != nil {
+			s.log.Println("❗️", err)
+			return
+		}
+		delete(s.leaving, m.ID) // came back before it acked leaving
+		s.change = &change{request: m, view: s.view.with(Member{ID: m.ID, Addr: m.Addr}), waiting: map[int]bool{}}
+		s.log.Printf("👥 adding %d in view %d", m.ID, s.change.view.Epoch)
+		s.send(message{SenderID: s.id, ReceiverID: m.ID, Message: MessagePrepare, View: &s.change.view})
+	case MessageLeave:
+		if !s.view.Has(m.ID) {
+			v := s.view
+			s.send(message{SenderID: s.id, ReceiverID: m.ID, Message: MessageCommit, View: &v})
+			return
+		}
+		s.change = &change{request: m, view: s.view.without(m.ID), prepared: true, waiting: map[int]bool{}}
+		s.log.Printf("👥 removing %d in view %d", m.ID, s.change.view.Epoch)
+		s.installEverywhere()
+	}
+}
+
+// installEverywhere sends the view of the change to members
+func (s *Service) installEverywhere() {
+	c := s.change
+	for _, id := range c.view.IDs() {
+		if id != s.id && id != c.request.ID {
+			c.waiting[id] = true
+			s.send(message{SenderID: s.id, ReceiverID: id, Message: MessageInstall, View: &c.view})
+		}
+	}
+	if c.request.Message == MessageJoin {
+		s.install(c.view)
+	}
+	s.maybeCommit()
+}
+
+func (s *Service) onAck(m message) {
+	if epoch, ok := s.leaving[m.SenderID]; ok && m.Epoch >= epoch {
+		delete(s.leaving, m.SenderID)
+		s.forget([]int{m.SenderID})
+		return
+	}
+	c := s.change
+	if c == nil || m.Epoch != c.view.Epoch {
+		return
+	}
+	if !c.prepared {
+		if m.SenderID != c.request.ID {
+			return
+		}
+		c.prepared = true
+		s.installEverywhere()
+		return
+	}
+	delete(c.waiting, m.SenderID)
+	s.maybeCommit()
+}
+
+// maybeCommit finishes the change once all members installed its view
+func (s *Service) maybeCommit() {
+	c := s.change
+	if len(c.waiting) > 0 {
+		return
+	}
+	s.change = nil
+	if c.request.ID == s.id {
+		// coordinator itself left. the next oldest member takes over
+		s.view = c.view
+		s.setLeft()
+		s.log.Println("👋 left")
+	} else {
+		s.send(message{SenderID: s.id, ReceiverID: c.request.ID, Message: MessageCommit, View: &c.view})
+		left := []int{}
+		for _, id := range s.install(c.view) {
+			if id == c.request.ID {
+				// a lost commit is sent again, or the retried request is
+				// answered, only while the node is reachable
+				s.leaving[id] = c.view.Epoch
+				continue
+			}
+			left = append(left, id)
+		}
+		s.forget(left)
+	}
+
+	pending := s.pending
+	s.pending = nil
+	for _, p := range pending {
+		s.onRequest(p)
+	}
+}
+
+// onView handles prepare, install and commit from the coordinator
+func (s *Service) onView(m message) {
+	if m.View == nil {
+		return
+	}
+	switch m.Message {
+	case MessagePrepare, MessageInstall:
+		left := s.install(*m.View)
+		s.send(message{SenderID: s.id, ReceiverID: m.SenderID, Message: MessageAck, Epoch: m.View.Epoch})
+		s.forget(left)
+	case MessageCommit:
+		if m.View.Epoch < s.view.Epoch {
+			return // of a membership which ended
+		}
+		if m.View.Has(s.id) {
+			s.install(*m.View)
+			if s.setJoined() {
+				transport.RemovePeer(s.transport, seed)
+				s.log.Println("🤝 joined")
+			}
+			return
+		}
+		// the coordinator keeps this node reachable until it acks
+		s.send(message{SenderID: s.id, ReceiverID: m.SenderID, Message: MessageAck, Epoch: m.View.Epoch})
+		if s.view.Has(s.id) {
+			// requests which still arrive are passed on to the members
+			s.view = *m.View
+			s.setLeft()
+			s.log.Println("👋 left")
+		}
+	}
+}
+
+func (s *Service) ProcessMessage(b []byte) {
+	var m message
+	if err := json.Unmarshal(b, &m); err != nil {
+		s.log.Println("❗️", err)
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	switch m.Message {
+	case MessageJoin, MessageLeave:
+		s.onRequest(m)
+	case MessageAck:
+		s.onAck(m)
+	case MessagePrepare, MessageInstall, MessageCommit:
+		s.onView(m)
+	}
+}
+
+// Start handles messages one at a time, in the order the transport delivers them
+func (s *Service) Start() {
+	for b := range s.transport.Receive() {
+		s.log.Println("<<- ", string(b))
+		s.ProcessMessage(b)
+	}
+}
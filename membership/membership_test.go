@@ -0,0 +1,129 @@
+package membership
+
+import (
+	"context"
+	"distributed-lock-example/transport"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(ioutil.Discard)
+	RetryInterval = 50 * time.Millisecond
+	transport.RetryInterval = 20 * time.Millisecond
+	os.Exit(m.Run())
+}
+
+type nopPeer struct{}
+
+func (nopPeer) AddPeer(id int)    {}
+func (nopPeer) RemovePeer(id int) {}
+
+// lossy drops the next commit sent to a node once armed
+type lossy struct {
+	*transport.UDP
+	lock *sync.Mutex
+	drop map[int]bool
+}
+
+func (l *lossy) Send(nodeID int, b []byte) error {
+	l.lock.Lock()
+	if l.drop[nodeID] && strings.Contains(string(b), `"message":"commit"`) {
+		delete(l.drop, nodeID)
+		l.lock.Unlock()
+		return nil
+	}
+	l.lock.Unlock()
+	return l.UDP.Send(nodeID, b)
+}
+
+func (l *lossy) dropCommit(nodeID int) {
+	l.lock.Lock()
+	l.drop[nodeID] = true
+	l.lock.Unlock()
+}
+
+type node struct {
+	*Service
+	addr string
+	link *lossy
+}
+
+func newNode(t *testing.T, id int) *node {
+	probe, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := probe.LocalAddr().String()
+	probe.Close()
+	u, err := transport.NewUDP(addr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := &lossy{UDP: u, lock: &sync.Mutex{}, drop: map[int]bool{}}
+	r := transport.NewReliable(id, link)
+	t.Cleanup(func() { r.Close() })
+	n := &node{Service: New(id, addr, r, nopPeer{}), addr: addr, link: link}
+	go n.Start()
+	return n
+}
+
+func within(t *testing.T, what string, f func(ctx context.Context) error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := f(ctx); err != nil {
+		t.Fatalf("%s: %v", what, err)
+	}
+}
+
+func wantIDs(t *testing.T, n *node, want ...int) {
+	got := n.View().IDs()
+	if len(got) != len(want) {
+		t.Fatalf("view of %d is %v, want %v", n.id, got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("view of %d is %v, want %v", n.id, got, want)
+		}
+	}
+}
+
+func TestLeaveWhenCommitIsLost(t *testing.T) {
+	a, b := newNode(t, 0), newNode(t, 1)
+	if err := a.Bootstrap(); err != nil {
+		t.Fatal(err)
+	}
+	within(t, "join", func(ctx context.Context) error { return b.Join(ctx, a.addr) })
+
+	a.link.dropCommit(1)
+	within(t, "leave", b.Leave)
+	wantIDs(t, a, 0)
+}
+
+func TestJoinAgainAfterLeaving(t *testing.T) {
+	a, b, c := newNode(t, 0), newNode(t, 1), newNode(t, 2)
+	if err := a.Bootstrap(); err != nil {
+		t.Fatal(err)
+	}
+	within(t, "join", func(ctx context.Context) error { return b.Join(ctx, a.addr) })
+	within(t, "join", func(ctx context.Context) error { return c.Join(ctx, a.addr) })
+	for i := 0; i < 3; i++ {
+		within(t, "leave", c.Leave)
+		wantIDs(t, a, 0, 1)
+		within(t, "join", func(ctx context.Context) error { return c.Join(ctx, b.addr) })
+		wantIDs(t, c, 0, 1, 2)
+	}
+
+	// a node which left may start a cluster of its own
+	within(t, "leave", c.Leave)
+	if err := c.Bootstrap(); err != nil {
+		t.Fatal(err)
+	}
+	wantIDs(t, c, 2)
+}
@@ -0,0 +1,110 @@
+package modelcheck
+
+import (
+	"encoding/binary"
+	"hash"
+	"hash/fnv"
+	"math"
+	"reflect"
+	"time"
+)
+
+var skipTypes = map[reflect.Type]bool{
+	reflect.TypeOf(transport{}):  true, // points back to the whole system
+	reflect.TypeOf(time.Timer{}): true, // fires on the wall clock
+}
+
+// hash fingerprints the state of the system: what every node has in its
+// fields, where it is in its iterations and which messages are in flight. Two
+// states with same hash are treated as the same state.
+func (s *system) hash() uint64 {
+	h := fnv.New64a()
+	for _, n := range s.nodes {
+		writeInt(h, int64(n.phase))
+		writeInt(h, int64(n.iteration))
+		hashValue(h, reflect.ValueOf(n.Algorithm), map[uintptr]int{})
+	}
+	for _, l := range s.sortedLinks() {
+		writeInt(h, int64(l.from))
+		writeInt(h, int64(l.to))
+		for _, b := range s.links[l] {
+			writeInt(h, int64(len(b)))
+			h.Write(b)
+		}
+	}
+	return h.Sum64()
+}
+
+func writeInt(h hash.Hash64, i int64) {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], uint64(i))
+	h.Write(b[:])
+}
+
+// hashValue walks v deeply, unexported fields too. seen numbers pointers
+// already walked, so cycles like those of container/list end and shared
+// pointers hash the same every time.
+func hashValue(h hash.Hash64, v reflect.Value, seen map[uintptr]int) {
+	writeInt(h, int64(v.Kind()))
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			writeInt(h, 1)
+		} else {
+			writeInt(h, 0)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		writeInt(h, v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		writeInt(h, int64(v.Uint()))
+	case reflect.Float32, reflect.Float64:
+		writeInt(h, int64(math.Float64bits(v.Float())))
+	case reflect.String:
+		writeInt(h, int64(v.Len()))
+		h.Write([]byte(v.String()))
+	case reflect.Ptr:
+		if v.IsNil() || skipTypes[v.Type().Elem()] {
+			return
+		}
+		if i, ok := seen[v.Pointer()]; ok {
+			writeInt(h, int64(i))
+			return
+		}
+		seen[v.Pointer()] = len(seen)
+		hashValue(h, v.Elem(), seen)
+	case reflect.Interface:
+		if v.IsNil() {
+			return
+		}
+		h.Write([]byte(v.Elem().Type().String()))
+		hashValue(h, v.Elem(), seen)
+	case reflect.Struct:
+		if skipTypes[v.Type()] {
+			return
+		}
+		for i := 0; i < v.NumField(); i++ {
+			hashValue(h, v.Field(i), seen)
+		}
+	case reflect.Slice, reflect.Array:
+		writeInt(h, int64(v.Len()))
+		for i := 0; i < v.Len(); i++ {
+			hashValue(h, v.Index(i), seen)
+		}
+	case reflect.Map:
+		// entries are hashed on their own and summed up, which doesn't depend
+		// on the order maps are iterated in
+		writeInt(h, int64(v.Len()))
+		var sum uint64
+		iter := v.MapRange()
+		for iter.Next() {
+			e := fnv.New64a()
+			hashValue(e, iter.Key(), map[uintptr]int{})
+			hashValue(e, iter.Value(), map[uintptr]int{})
+			sum += e.Sum64()
+		}
+		writeInt(h, int64(sum))
+	case reflect.Chan:
+		// buffered signals, like a granted CS waiting to be picked up
+		writeInt(h, int64(v.Len()))
+	}
+}
@@ -0,0 +1,236 @@
+// Package modelcheck explores the ways a run of a few nodes can interleave and
+// checks every one of them. Nodes are never started: one goroutine hands them
+// messages, lets them ask for CS, polls them for a grant and lets them exit, so
+// scheduling is decided by the model checker alone. Every such choice is a
+// Step, and a run is a Trace of steps.
+//
+// The default search is breadth first, so the first violation found comes with
+// a shortest trace. States are told apart by a hash of all fields of every
+// node and the messages in flight, and each is explored once. For bigger
+// clusters, Walks samples random runs instead and shrinks the trace of a
+// violation before returning it.
+//
+// Nodes are created anew for every replayed trace, so they must not start
+// wall clock timers. Set raymond.TokenTimeout to 0 and don't use leases.
+//
+// Nodes run no goroutines and WaitForCS is never called, grants are polled
+// with TryWaitForCS. Races between WaitForCS and message processing are left
+// to the cluster tests.
+package modelcheck
+
+import (
+	"distributed-lock-example/checker"
+	dtransport "distributed-lock-example/transport"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+)
+
+type Algorithm interface {
+	ID() int
+	ProcessMessage(b []byte)
+	AskToEnterCS(CSID string)
+	TryWaitForCS() bool
+	EnterCS()
+	ExitCS()
+}
+
+var ErrDeadlock = errors.New("deadlock: nodes wait for CS and nothing can happen anymore")
+
+// MaxSteps bounds a random walk, in case nodes exchange messages forever
+var MaxSteps = 10000
+
+type Config struct {
+	Nodes      int                                            // 2 to 4 keep exhaustive search fast
+	Iterations int                                            // CS entries per node. defaults to 1
+	NewNode    func(id int, t dtransport.Transport) Algorithm // called for every replay
+	CSID       func(id int, i int) string                     // of i-th request of node id. defaults to ""
+	Check      checker.Config                                 // invariants to check besides deadlock freedom
+	Unordered  bool                                           // links may reorder messages, like UDP
+	MaxStates  int                                            // exhaustive search gives up after. 0 means no limit
+	Walks      int                                            // sample this many random runs instead of searching all
+	Seed       int64                                          // of random walks
+}
+
+type Result struct {
+	States   int      // distinct states seen
+	Complete bool     // every reachable state was checked
+	Trace    Trace    // run which broke an invariant
+	Log      []string // what every step of Trace did
+}
+
+func (r Result) String() string {
+	var sb strings.Builder
+	for i, line := range r.Log {
+		fmt.Fprintf(&sb, "%3d. %s\n", i+1, line)
+	}
+	return sb.String()
+}
+
+// Run checks the cluster described by config. It returns the first violation
+// found, with the trace leading to it in Result.
+func Run(config Config) (Result, error) {
+	if config.Iterations == 0 {
+		config.Iterations = 1
+	}
+	if config.CSID == nil {
+		config.CSID = func(id int, i int) string { return "" }
+	}
+	if config.Walks > 0 {
+		return sample(&config)
+	}
+	return search(&config)
+}
+
+// search explores states breadth first. a state is reached by the trace
+// leading to it, which is replayed on fresh nodes.
+func search(config *Config) (Result, error) {
+	initial, _ := replay(config, nil)
+	visited := map[uint64]bool{initial.hash(): true}
+	result := Result{States: 1}
+	queue := []Trace{{}}
+	for len(queue) > 0 {
+		trace := queue[0]
+		queue = queue[1:]
+
+		s, _ := replay(config, trace)
+		done := s.done()
+		steps := s.enabled()
+		progress := false
+		for _, step := range steps {
+			// nodes can't be copied. a step which changed s is undone by
+			// replaying the parent again, only when another step needs it
+			if s == nil {
+				s, _ = replay(config, trace)
+			}
+			changed, err := s.take(step)
+			child := append(append(Trace{}, trace...), step)
+			if err != nil {
+				return counterexample(config, result, child, err)
+			}
+			if !changed {
+				continue // polled node wasn't granted CS yet, s is still the parent
+			}
+			progress = true
+			h := s.hash()
+			s = nil
+			if visited[h] {
+				continue
+			}
+			visited[h] = true
+			result.States++
+			if config.MaxStates > 0 && result.States >= config.MaxStates {
+				return result, nil
+			}
+			queue = append(queue, child)
+		}
+		if !progress && !done {
+			return counterexample(config, result, trace, ErrDeadlock)
+		}
+	}
+	result.Complete = true
+	return result, nil
+}
+
+// sample takes random walks from the initial state until all nodes are done
+func sample(config *Config) (Result, error) {
+	r := rand.New(rand.NewSource(config.Seed))
+	visited := map[uint64]bool{}
+	result := Result{}
+	for walk := 0; walk < config.Walks; walk++ {
+		s := newSystem(config)
+		trace := Trace{}
+		for len(trace) < MaxSteps {
+			if h := s.hash(); !visited[h] {
+				visited[h] = true
+				result.States++
+			}
+			steps := s.enabled()
+			progress := false
+			for _, i := range r.Perm(len(steps)) {
+				changed, err := s.take(steps[i])
+				if err != nil {
+					return counterexample(config, result, shrink(config, append(trace, steps[i]), err), err)
+				}
+				if changed {
+					trace = append(trace, steps[i])
+					progress = true
+					break
+				}
+			}
+			if !progress {
+				if !s.done() {
+					return counterexample(config, result, shrink(config, trace, ErrDeadlock), ErrDeadlock)
+				}
+				break
+			}
+		}
+	}
+	return result, nil
+}
+
+// shrink drops steps from trace as long as it still ends in the same kind of
+// violation
+func shrink(config *Config, trace Trace, want error) Trace {
+	for i := 0; i < len(trace); {
+		candidate := append(append(Trace{}, trace[:i]...), trace[i+1:]...)
+		if failing, ok := fails(config, candidate, want); ok {
+			trace = failing
+		} else {
+			i++
+		}
+	}
+	return trace
+}
+
+// fails replays trace and reports whether it breaks the same invariant as
+// want. It returns the trace up to the violation.
+func fails(config *Config, trace Trace, want error) (Trace, bool) {
+	s := newSystem(config)
+	for i, step := range trace {
+		_, err := s.take(step)
+		if errors.Is(err, errDisabled) {
+			return nil, false
+		}
+		if err != nil {
+			return trace[:i+1], sameKind(err, want)
+		}
+	}
+	return trace, want == ErrDeadlock && deadlocked(config, trace)
+}
+
+func sameKind(err error, want error) bool {
+	for _, kind := range []error{checker.ErrMutualExclusion, checker.ErrGroupExclusion, checker.ErrStarvation, checker.ErrOrder} {
+		if errors.Is(want, kind) {
+			return errors.Is(err, kind)
+		}
+	}
+	return false
+}
+
+// deadlocked tells if nothing can happen after trace, while nodes still wait
+func deadlocked(config *Config, trace Trace) bool {
+	s, err := replay(config, trace)
+	if err != nil || s.done() {
+		return false
+	}
+	for _, step := range s.enabled() {
+		child, _ := replay(config, trace)
+		if changed, _ := child.take(step); changed {
+			return false
+		}
+	}
+	return true
+}
+
+// counterexample replays trace once more to describe its steps
+func counterexample(config *Config, result Result, trace Trace, err error) (Result, error) {
+	s, _ := replay(config, trace)
+	result.Trace = trace
+	result.Log = s.log
+	if v, ok := err.(checker.Violation); ok {
+		err = fmt.Errorf("%w: %s", v.Err, v.Detail)
+	}
+	return result, fmt.Errorf("after %d steps: %w", len(s.log), err)
+}
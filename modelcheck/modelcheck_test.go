@@ -0,0 +1,103 @@
+package modelcheck
+
+import (
+	"distributed-lock-example/checker"
+	"distributed-lock-example/lamport"
+	"distributed-lock-example/raymond"
+	ricart_agrawala "distributed-lock-example/ricart-agrawala"
+	dtransport "distributed-lock-example/transport"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(ioutil.Discard) // nodes log every message
+	raymond.TokenTimeout = 0      // nodes are created for every replay
+	os.Exit(m.Run())
+}
+
+func newLamport(n int) func(id int, t dtransport.Transport) Algorithm {
+	return func(id int, t dtransport.Transport) Algorithm {
+		return lamport.NewNode(id, others(id, n), t)
+	}
+}
+
+func others(id int, n int) []int {
+	ids := []int{}
+	for i := 0; i < n; i++ {
+		if i != id {
+			ids = append(ids, i)
+		}
+	}
+	return ids
+}
+
+// Over links which reorder messages, a reply can overtake the request sent
+// before it, and lamport lets a later request in first
+func TestFindsUnorderedLamportViolation(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		walks int
+	}{
+		{"search", 0},
+		{"walks", 100},
+	} {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			result, err := Run(Config{Nodes: 2, NewNode: newLamport(2), Check: checker.Config{Ordered: true},
+				Unordered: true, Walks: c.walks, Seed: 1})
+			if !errors.Is(err, checker.ErrOrder) {
+				t.Fatalf("got %v", err)
+			}
+			// request, request, reply overtaking request, reply, enter
+			if len(result.Trace) != 5 || len(result.Log) != len(result.Trace) || result.Complete {
+				t.Fatalf("trace of %d steps: %s", len(result.Trace), result)
+			}
+		})
+	}
+}
+
+func TestCompletesCorrectCluster(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		config  Config
+		atLeast int // states
+	}{
+		{"lamport", Config{Nodes: 2, Iterations: 2, NewNode: newLamport(2), Check: checker.Config{Ordered: true}}, 1000},
+		{"ricart-agrawala", Config{Nodes: 2, Iterations: 2, Check: checker.Config{Ordered: true},
+			NewNode: func(id int, t dtransport.Transport) Algorithm {
+				return ricart_agrawala.NewNode(id, others(id, 2), t)
+			}}, 200},
+		{"raymond", Config{Nodes: 3, Iterations: 1,
+			NewNode: func(id int, t dtransport.Transport) Algorithm {
+				if id == 0 {
+					return raymond.NewNode(0, []int{1, 2}, 0, t)
+				}
+				return raymond.NewNode(id, []int{0}, 0, t)
+			}}, 50},
+	} {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			result, err := Run(c.config)
+			if err != nil {
+				t.Fatalf("%v\n%s", err, result)
+			}
+			if !result.Complete || result.States < c.atLeast {
+				t.Fatalf("complete: %v after %d states", result.Complete, result.States)
+			}
+		})
+	}
+}
+
+func TestMaxStatesStopsSearch(t *testing.T) {
+	result, err := Run(Config{Nodes: 2, Iterations: 2, NewNode: newLamport(2), MaxStates: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Complete || result.States != 100 {
+		t.Fatalf("complete: %v after %d states", result.Complete, result.States)
+	}
+}
@@ -0,0 +1,227 @@
+package modelcheck
+
+import (
+	"distributed-lock-example/checker"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// errDisabled means a step can't be taken in the state the system is in
+var errDisabled = errors.New("step is not enabled")
+
+type StepKind string
+
+const (
+	StepAsk     StepKind = "ask"
+	StepEnter   StepKind = "enter"
+	StepExit    StepKind = "exit"
+	StepDeliver StepKind = "deliver"
+)
+
+// Step is one choice of the scheduler. Enter asks node whether it was granted
+// CS, like WaitForCS does when it wakes up, and enters it if so. Deliver hands
+// the Index-th message in flight from From to Node.
+type Step struct {
+	Kind  StepKind
+	Node  int
+	From  int
+	Index int
+}
+
+// Trace is a sequence of steps from the initial state
+type Trace []Step
+
+// link is the one way connection from a node to another
+type link struct {
+	from int
+	to   int
+}
+
+type phase int
+
+const (
+	idle phase = iota
+	waiting
+	inCS
+)
+
+type node struct {
+	Algorithm
+	phase     phase
+	iteration int
+	csid      string
+	time      uint // logical time of last request
+}
+
+// system is one replay of a trace. nodes can't be copied, so every state is
+// reached by creating fresh nodes and replaying the steps leading to it.
+type system struct {
+	config  *Config
+	nodes   []*node
+	links   map[link][][]byte
+	checker *checker.Checker
+	log     []string // what each step did, for printing counterexamples
+}
+
+func newSystem(config *Config) *system {
+	s := &system{config: config, links: map[link][][]byte{}, checker: checker.New(config.Check)}
+	for id := 0; id < config.Nodes; id++ {
+		s.nodes = append(s.nodes, &node{})
+	}
+	for id := 0; id < config.Nodes; id++ {
+		s.nodes[id].Algorithm = config.NewNode(id, &transport{system: s, id: id})
+	}
+	return s
+}
+
+// replay creates a fresh system and takes steps of trace. It stops at the first
+// violation and returns it.
+func replay(config *Config, trace Trace) (*system, error) {
+	s := newSystem(config)
+	for _, step := range trace {
+		if _, err := s.take(step); err != nil {
+			return s, err
+		}
+	}
+	return s, nil
+}
+
+func (s *system) send(from int, to int, b []byte) error {
+	if to < 0 || to >= len(s.nodes) {
+		return fmt.Errorf("unknown peer %d", to)
+	}
+	c := make([]byte, len(b))
+	copy(c, b)
+	l := link{from, to}
+	s.links[l] = append(s.links[l], c)
+	return nil
+}
+
+// take takes step and reports whether it changed anything. A step which
+// can't be taken returns errDisabled, one which breaks an invariant returns
+// the violation.
+func (s *system) take(step Step) (bool, error) {
+	if step.Node < 0 || step.Node >= len(s.nodes) {
+		return false, errDisabled
+	}
+	n := s.nodes[step.Node]
+	at := time.Duration(len(s.log)) // checker records steps, not time
+	switch step.Kind {
+	case StepAsk:
+		if n.phase != idle || n.iteration >= s.config.Iterations {
+			return false, errDisabled
+		}
+		n.csid = s.config.CSID(step.Node, n.iteration)
+		n.AskToEnterCS(n.csid)
+		n.time = checker.RequestTime(n.Algorithm)
+		n.phase = waiting
+		s.log = append(s.log, fmt.Sprintf("%d asks for CS %q", step.Node, n.csid))
+		return true, s.checker.Request(step.Node, n.csid, n.time, at)
+	case StepEnter:
+		if n.phase != waiting {
+			return false, errDisabled
+		}
+		if !n.TryWaitForCS() {
+			return false, nil
+		}
+		n.EnterCS()
+		n.phase = inCS
+		s.log = append(s.log, fmt.Sprintf("%d enters CS %q", step.Node, n.csid))
+		return true, s.checker.Enter(step.Node, n.csid, n.time, at)
+	case StepExit:
+		if n.phase != inCS {
+			return false, errDisabled
+		}
+		err := s.checker.Exit(step.Node, n.csid, n.time, at)
+		n.ExitCS()
+		n.phase = idle
+		n.iteration++
+		s.log = append(s.log, fmt.Sprintf("%d exits CS %q", step.Node, n.csid))
+		return true, err
+	case StepDeliver:
+		l := link{step.From, step.Node}
+		queue := s.links[l]
+		if step.Index < 0 || step.Index >= len(queue) || (step.Index > 0 && !s.config.Unordered) {
+			return false, errDisabled
+		}
+		b := queue[step.Index]
+		s.links[l] = append(queue[:step.Index:step.Index], queue[step.Index+1:]...)
+		n.ProcessMessage(b)
+		s.log = append(s.log, fmt.Sprintf("%d -> %d %s", step.From, step.Node, b))
+		return true, nil
+	}
+	return false, errDisabled
+}
+
+// enabled lists steps which can be taken, always in the same order
+func (s *system) enabled() []Step {
+	steps := []Step{}
+	for id, n := range s.nodes {
+		switch {
+		case n.phase == idle && n.iteration < s.config.Iterations:
+			steps = append(steps, Step{Kind: StepAsk, Node: id})
+		case n.phase == waiting:
+			steps = append(steps, Step{Kind: StepEnter, Node: id})
+		case n.phase == inCS:
+			steps = append(steps, Step{Kind: StepExit, Node: id})
+		}
+	}
+	for _, l := range s.sortedLinks() {
+		count := 1
+		if s.config.Unordered {
+			count = len(s.links[l])
+		}
+		for i := 0; i < count; i++ {
+			steps = append(steps, Step{Kind: StepDeliver, Node: l.to, From: l.from, Index: i})
+		}
+	}
+	return steps
+}
+
+// sortedLinks returns links with messages in flight
+func (s *system) sortedLinks() []link {
+	links := []link{}
+	for l, queue := range s.links {
+		if len(queue) > 0 {
+			links = append(links, l)
+		}
+	}
+	sort.Slice(links, func(i, j int) bool {
+		if links[i].from != links[j].from {
+			return links[i].from < links[j].from
+		}
+		return links[i].to < links[j].to
+	})
+	return links
+}
+
+// done tells if every node entered CS Config.Iterations times
+func (s *system) done() bool {
+	for _, n := range s.nodes {
+		if n.iteration < s.config.Iterations {
+			return false
+		}
+	}
+	return true
+}
+
+// transport puts messages on the links of the system. They stay there until
+// the scheduler delivers them.
+type transport struct {
+	system *system
+	id     int
+}
+
+func (t *transport) Send(nodeID int, b []byte) error {
+	return t.system.send(t.id, nodeID, b)
+}
+
+func (t *transport) Receive() <-chan []byte {
+	return nil
+}
+
+func (t *transport) Close() error {
+	return nil
+}
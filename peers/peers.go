@@ -0,0 +1,70 @@
+package peers
+
+import (
+	"distributed-lock-example/faults"
+	"distributed-lock-example/transport"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Flag collects repeated `--neighbour <id>:<addr>` flags
+type Flag map[int]string
+
+func (i *Flag) String() string {
+	return ""
+}
+
+func (i *Flag) Set(value string) error {
+	splitted := strings.SplitN(value, ":", 2)
+	if len(splitted) != 2 {
+		return errors.New("must be in format of <id>:<addr>")
+	}
+	id, err := strconv.Atoi(splitted[0])
+	if err != nil {
+		return err
+	}
+	if *i == nil {
+		*i = map[int]string{}
+	}
+	(*i)[id] = splitted[1]
+	return nil
+}
+
+// IDs returns neighbour ids in ascending order
+func (i Flag) IDs() []int {
+	ids := []int{}
+	for id := range i {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// NewTransport listens on listenAddr with transport kind "udp" or "tcp" and
+// wraps it with transport.Reliable if reliable is set. If scenario is not nil,
+// its faults are injected below Reliable.
+func NewTransport(id int, kind string, listenAddr string, neighbours Flag, reliable bool, scenario *faults.Scenario) (transport.Transport, error) {
+	var t transport.Transport
+	var err error
+	switch kind {
+	case "tcp":
+		t, err = transport.NewTCP(listenAddr, neighbours)
+	case "udp":
+		t, err = transport.NewUDP(listenAddr, neighbours)
+	default:
+		return nil, fmt.Errorf("unknown transport %q", kind)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if scenario != nil {
+		t = faults.New(id, t, scenario)
+	}
+	if reliable {
+		t = transport.NewReliable(id, t)
+	}
+	return t, nil
+}
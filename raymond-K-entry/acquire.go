@@ -0,0 +1,83 @@
+package raymod
+
+import (
+	"context"
+	"distributed-lock-example/acquire"
+)
+
+// Acquire asks for CS and blocks until this node is in CS, or ctx is done. In
+// the latter case the request is taken off the request queues along the path
+// to the token and ctx.Err() is returned.
+func (r *Node) Acquire(ctx context.Context, CSID string) error {
+	r.mutex.Lock()
+	if r.closed {
+		r.mutex.Unlock()
+		return acquire.ErrClosed
+	}
+	if r.requesting || r.using {
+		r.mutex.Unlock()
+		return acquire.ErrBusy
+	}
+	r.askToEnterCS(CSID)
+	r.mutex.Unlock()
+
+	select {
+	case <-r.enterCSCh:
+		r.EnterCS()
+		return nil
+	case <-ctx.Done():
+	}
+
+	r.log.Println("giving up on CS: ", ctx.Err())
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.requesting = false
+	select {
+	case <-r.enterCSCh:
+		// admitted meanwhile. leave right away
+		r.using = false
+		r.groupID = ""
+		r.release(r.nodeID)
+	default:
+		r.groupID = ""
+		r.remove(r.nodeID)
+		r.cancelRequest()
+	}
+	return ctx.Err()
+}
+
+// cancelRequest withdraws the request made to holder if nobody in the queue
+// needs the token anymore. expects r.mutex to be held
+func (r *Node) cancelRequest() {
+	if r.token != nil {
+		// the retracted request may have been blocking the ones behind it
+		r.assignPrivilege()
+		return
+	}
+	if r.asked && r.requestQueue.Len() == 0 {
+		r.send(message{SenderID: r.nodeID, ReceiverID: r.holder, Message: MessageCancel})
+		r.asked = false
+	}
+}
+
+// TryAcquire is Acquire with a short timeout, acquire.TryTimeout. It returns
+// false if CS was not granted in time.
+func (r *Node) TryAcquire(CSID string) (bool, error) {
+	return acquire.Try(func(ctx context.Context) error { return r.Acquire(ctx, CSID) })
+}
+
+func (r *Node) Release() error {
+	if !r.InCS() {
+		return acquire.ErrNotInCS
+	}
+	r.ExitCS()
+	return nil
+}
+
+// Close stops the node. Start returns once the transport is closed.
+func (r *Node) Close() error {
+	r.mutex.Lock()
+	r.closed = true
+	r.mutex.Unlock()
+	return r.transport.Close()
+}
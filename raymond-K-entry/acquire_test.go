@@ -0,0 +1,182 @@
+package raymod
+
+import (
+	"context"
+	"distributed-lock-example/transport"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(ioutil.Discard) // nodes log every message
+	os.Exit(m.Run())
+}
+
+// newStar creates node 0 with the token and nodes 1..n-1 around it. Nodes are
+// not started, they are closed when the test ends.
+func newStar(t *testing.T, n int, tokens int) []*Node {
+	network := transport.NewNetwork()
+	children := []int{}
+	for id := 1; id < n; id++ {
+		children = append(children, id)
+	}
+	nodes := []*Node{NewNode(0, children, 0, tokens, network.Join(0))}
+	for id := 1; id < n; id++ {
+		nodes = append(nodes, NewNode(id, []int{0}, 0, tokens, network.Join(id)))
+	}
+	t.Cleanup(func() {
+		for _, n := range nodes {
+			n.Close()
+		}
+	})
+	return nodes
+}
+
+type snapshot struct {
+	holder int
+	token  *token
+	queue  []int
+	asked  bool
+}
+
+func (r *Node) snapshot() snapshot {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	s := snapshot{holder: r.holder, asked: r.asked, queue: []int{}}
+	if r.token != nil {
+		t := *r.token
+		t.Active = append([]int{}, r.token.Active...)
+		s.token = &t
+	}
+	for e := r.requestQueue.Front(); e != nil; e = e.Next() {
+		s.queue = append(s.queue, e.Value.(int))
+	}
+	return s
+}
+
+func start(nodes ...*Node) {
+	for _, n := range nodes {
+		go n.Start()
+	}
+}
+
+func acquireAsync(ctx context.Context, n *Node, CSID string) <-chan error {
+	errCh := make(chan error, 1)
+	go func() { errCh <- n.Acquire(ctx, CSID) }()
+	return errCh
+}
+
+func waitAcquired(t *testing.T, n *Node, errCh <-chan error) {
+	t.Helper()
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatalf("node %d: %v", n.nodeID, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("node %d never entered CS", n.nodeID)
+	}
+}
+
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal(what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// tokens returns ids of nodes which have the token
+func tokens(nodes []*Node) []int {
+	ids := []int{}
+	for _, n := range nodes {
+		if n.snapshot().token != nil {
+			ids = append(ids, n.nodeID)
+		}
+	}
+	return ids
+}
+
+func TestCancelledAcquireLeavesQueues(t *testing.T) {
+	nodes := newStar(t, 3, 1)
+	start(nodes...)
+	if err := nodes[0].Acquire(context.Background(), "a"); err != nil {
+		t.Fatal(err)
+	}
+	// 2 takes the token and waits for 0 to leave
+	errCh := acquireAsync(context.Background(), nodes[2], "b")
+	eventually(t, "token never reached 2", func() bool { return nodes[2].snapshot().token != nil })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := nodes[1].Acquire(ctx, "a"); err != context.DeadlineExceeded {
+		t.Fatalf("acquire while the bridge is in use: %v", err)
+	}
+	eventually(t, "cancelled request still queued", func() bool {
+		s0, s2 := nodes[0].snapshot(), nodes[2].snapshot()
+		return fmt.Sprint(s0.queue) == "[]" && !s0.asked && fmt.Sprint(s2.queue) == "[2]"
+	})
+
+	nodes[0].Release()
+	waitAcquired(t, nodes[2], errCh)
+	if nodes[1].InCS() {
+		t.Fatal("cancelled node got CS")
+	}
+	errCh = acquireAsync(context.Background(), nodes[1], "a")
+	nodes[2].Release()
+	waitAcquired(t, nodes[1], errCh)
+	if ids := tokens(nodes); len(ids) != 1 {
+		t.Fatalf("token is at %v", ids)
+	}
+}
+
+// The token is handed to node 1 after its Acquire gave up waiting, but before
+// it took its request back. Node 1 must leave the bridge and pass the token on.
+func TestTokenArrivingWhileCancellingIsPassedOn(t *testing.T) {
+	nodes := newStar(t, 3, 1)
+	start(nodes[0], nodes[2]) // messages to 1 are handled by the test
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled := acquireAsync(ctx, nodes[1], "a")
+	eventually(t, "token never sent to 1", func() bool { return nodes[0].snapshot().holder == 1 })
+	errCh := acquireAsync(context.Background(), nodes[2], "a")
+	eventually(t, "request of 2 never forwarded to 1", func() bool { return nodes[0].snapshot().asked })
+
+	var m message
+	if err := json.Unmarshal(<-nodes[1].transport.Receive(), &m); err != nil || m.Message != MessagePrivilege {
+		t.Fatalf("node 1 got %+v, %v", m, err)
+	}
+	n := nodes[1]
+	n.mutex.Lock()
+	cancel()
+	time.Sleep(50 * time.Millisecond) // Acquire sees ctx done and waits for the mutex
+	// what ProcessMessage does with a privilege
+	n.holder = n.nodeID
+	n.token = m.Token
+	n.asked = false
+	n.assignPrivilege()
+	n.mutex.Unlock()
+
+	if err := <-cancelled; err != context.Canceled {
+		t.Fatalf("cancelled acquire returned %v", err)
+	}
+	start(n) // request of 0 on behalf of 2
+	waitAcquired(t, nodes[2], errCh)
+	if n.InCS() {
+		t.Fatal("cancelled node is in CS")
+	}
+	if ids := tokens(nodes); fmt.Sprint(ids) != "[2]" {
+		t.Fatalf("token is at %v", ids)
+	}
+	if active := nodes[2].snapshot().token.Active; fmt.Sprint(active) != "[2]" {
+		t.Fatalf("on the bridge: %v", active)
+	}
+}
@@ -2,161 +2,181 @@ package raymod
 
 import (
 	"container/list"
-	udpclient "distributed-lock-example/udpclient"
+	"distributed-lock-example/logger"
+	"distributed-lock-example/transport"
 	"encoding/json"
 	"fmt"
-	"log"
-	"net"
+	"sync"
 )
 
 var MessageRequest string = "request"
 var MessagePrivilege string = "privilege"
+var MessageRelease string = "release"
+var MessageCancel string = "cancel"
 
-type message struct {
-	SenderID     int    `json:"senderId"`
-	ReceiverAddr string `json:"receiverAddr"`
-	Message      string `json:"message"`
-	CSID         string `json:"csId"`
+// token is passed along the tree like raymond's privilege. It lets up to
+// Capacity nodes of the same CSID be in CS at once. Nodes which are in CS don't
+// need the token to stay with them, their release is routed to the token.
+type token struct {
+	CSID     string `json:"csId"`   // ex: car moving from east->west belongs to group `0`, west->east belongs to group `1` and so on
+	Active   []int  `json:"active"` // nodes in CS
+	Capacity int    `json:"capacity"`
 }
 
-type request struct {
-	ID   int
-	CSID string
+func (t *token) admits(CSID string) bool {
+	return len(t.Active) == 0 || (t.CSID == CSID && len(t.Active) < t.Capacity)
 }
 
-type Node struct {
-	nodeID       int
-	neighbourIDs map[int]string
-	using        bool
-	requestQueue *list.List
-	enterCSCh    chan struct{}
-	tdb          *list.List // size will equal to number of tokens in system
-	groupID      string     // ex: car moving from east->west belongs to group `0`, west->east belongs to group `1` and so on
-	listenAddr   string
+func (t *token) admit(id int, CSID string) {
+	t.CSID = CSID
+	t.Active = append(t.Active, id)
 }
 
-func NewNode(ID int, listenAddr string, neighbourIDs map[int]string, holder int, tokens int) *Node {
-	tdb := list.New()
-	for i := 0; i < tokens; i++ {
-		r := request{ID: holder, CSID: ""}
-		tdb.PushBack(r)
+func (t *token) release(id int) {
+	for i, a := range t.Active {
+		if a == id {
+			t.Active = append(t.Active[:i], t.Active[i+1:]...)
+			break
+		}
 	}
-
-	return &Node{
-		nodeID: ID, neighbourIDs: neighbourIDs, requestQueue: list.New(), enterCSCh: make(chan struct{}, 1),
-		tdb:        tdb,
-		listenAddr: listenAddr,
+	if len(t.Active) == 0 {
+		t.CSID = ""
 	}
 }
 
-func (r *Node) deleteFromTDB(id int) {
-	log.Println("deleting ", id, "from tdb. len: ", r.tdb.Len())
-	for e := r.tdb.Front(); e != nil; e = e.Next() {
-		if e.Value.(request).ID == id {
-			r.tdb.Remove(e)
-			break
-		}
-	}
-	log.Println("deleted from tdb. len: ", r.tdb.Len())
+type message struct {
+	SenderID   int    `json:"senderId"`
+	ReceiverID int    `json:"receiverId"`
+	Message    string `json:"message"`
+	Origin     int    `json:"origin"` // node leaving CS. only in release
+	Token      *token `json:"token,omitempty"`
 }
 
-func (r *Node) getOtherHolder() int {
-	for e := r.tdb.Front(); e != nil; e = e.Next() {
-		log.Println("getOtherHolder e.Value ", e.Value)
-		if e.Value.(request).ID != r.nodeID {
-			return e.Value.(request).ID
+// Node implements raymond's tree algorithm for K entries. A node asks its holder
+// for the token exactly like in raymond's algorithm. A node which has the
+// token lets itself in if the bridge is empty, or used in its own direction
+// with less than K nodes on it, and then passes the token on to the next
+// requester. If the bridge is used in other direction, the token waits until
+// the nodes on the bridge release it. Requests are served in the order they
+// arrive, so requests of one direction can't starve the other.
+type Node struct {
+	nodeID       int
+	neighbourIDs []int
+	using        bool
+	requestQueue *list.List // ids of neighbours which asked for the token, or own id
+	holder       int
+	asked        bool
+	requesting   bool
+	closed       bool
+	token        *token // non nil only when holder == nodeID
+	groupID      string // CSID of own request
+	enterCSCh    chan struct{}
+	log          *logger.Logger
+	mutex        *sync.Mutex
+	transport    transport.Transport
+}
+
+// NewNode creates a node. node with ID == holder starts with the token which
+// admits up to `tokens` nodes of the same CSID.
+func NewNode(ID int, neighbourIDs []int, holder int, tokens int, t transport.Transport) *Node {
+	r := &Node{
+		nodeID: ID, neighbourIDs: neighbourIDs, requestQueue: list.New(), enterCSCh: make(chan struct{}, 1),
+		holder:    holder,
+		log:       &logger.Logger{Prefix: fmt.Sprintf("[%d]", ID)},
+		mutex:     &sync.Mutex{},
+		transport: t,
+	}
+	if holder == ID {
+		if tokens < 1 {
+			tokens = 1
 		}
+		r.token = &token{Active: []int{}, Capacity: tokens}
 	}
-	return -1
+	return r
 }
 
 func (r *Node) ID() int {
 	return r.nodeID
 }
 
-func (r *Node) makeRequest(CSID string) {
+func (r *Node) send(m message) {
+	b, _ := json.Marshal(m)
+	if err := r.transport.Send(m.ReceiverID, b); err != nil {
+		r.log.Println("❗️ ", err)
+	}
+	r.log.Println("->> ", string(b))
+}
 
-	if !r.hasToken(CSID) && r.tdb.Len() > 0 && r.requestQueue.Len() > 0 {
-		holder := r.getOtherHolder()
-		m := message{SenderID: r.nodeID, Message: MessageRequest, CSID: CSID, ReceiverAddr: r.neighbourIDs[holder]}
-		log.Println("request for CSID ", CSID, " to ", holder)
-		b, _ := json.Marshal(m)
-		if err := udpclient.SendMessage(m.ReceiverAddr, b); err != nil {
-			// r.asked = true
-			r.deleteFromTDB(holder)
+func (r *Node) enqueue(id int) {
+	for e := r.requestQueue.Front(); e != nil; e = e.Next() {
+		if e.Value.(int) == id {
+			return
 		}
 	}
+	r.requestQueue.PushBack(id)
 }
 
-func (r *Node) hasToken(CSID string) bool {
-	hasToken := false
-	for e := r.tdb.Front(); e != nil; e = e.Next() {
-		if e.Value.(request).ID == r.nodeID && (r.groupID == "" || r.groupID == CSID) {
-			hasToken = true
-			break
+func (r *Node) remove(id int) bool {
+	for e := r.requestQueue.Front(); e != nil; e = e.Next() {
+		if e.Value.(int) == id {
+			r.requestQueue.Remove(e)
+			return true
 		}
 	}
-	if !hasToken {
-		log.Println("I dont have token for CSID: ", CSID, ". My CSID: ", r.groupID)
+	return false
+}
+
+// makeRequest and assignPrivilege expect r.mutex to be held by the caller
+func (r *Node) makeRequest() {
+	if r.holder != r.nodeID && !r.asked && r.requestQueue.Len() > 0 {
+		r.send(message{SenderID: r.nodeID, ReceiverID: r.holder, Message: MessageRequest})
+		r.asked = true
 	}
-	return hasToken
-}
-
-func (r *Node) assignPrivilege(CSID string) {
-	log.Println("assign privilege called with CSID: ", CSID)
-	log.Println("r.requestQueue.Len() ", r.requestQueue.Len())
-	if r.hasToken(CSID) && r.requestQueue.Len() > 0 {
-		log.Println("I have token")
-
-		for e := r.requestQueue.Front(); e != nil; e = e.Next() {
-			var nextHolder *request
-			req := e.Value.(request)
-			for e := r.tdb.Front(); e != nil; e = e.Next() {
-				log.Println("r.tdb", e.Value)
-				// t := e.Value.(request)
-
-				if (CSID != "" && req.CSID == CSID) || (CSID == "") {
-					nextHolder = &req
-					break
-				}
-			}
+}
 
-			if nextHolder == nil {
-				continue
+func (r *Node) assignPrivilege() {
+	for r.token != nil && r.requestQueue.Len() > 0 {
+		e := r.requestQueue.Front()
+		next := e.Value.(int)
+		if next == r.nodeID {
+			if !r.token.admits(r.groupID) {
+				r.log.Printf("bridge is used by %v in direction %s. waiting for them to leave", r.token.Active, r.token.CSID)
+				return
 			}
-
-			log.Println("next holder: ", nextHolder)
-
 			r.requestQueue.Remove(e)
-			r.deleteFromTDB(r.nodeID)
-			if nextHolder.ID == r.nodeID {
-				log.Println("using token for myself. CSID: ", nextHolder.CSID)
-				r.using = true
-				r.groupID = nextHolder.CSID
-				r.tdb.PushBack(*nextHolder)
-				r.enterCSCh <- struct{}{}
-			} else {
-				log.Println("giving privilege to ", nextHolder)
-				m := message{SenderID: r.nodeID, Message: MessagePrivilege, CSID: nextHolder.CSID, ReceiverAddr: r.neighbourIDs[nextHolder.ID]}
-				b, _ := json.Marshal(m)
-				if err := udpclient.SendMessage(m.ReceiverAddr, b); err != nil {
-				} else {
-					r.groupID = nextHolder.CSID
-					r.tdb.PushBack(*nextHolder)
-					log.Println("new holder is ", nextHolder.ID)
-				}
-			}
+			r.token.admit(r.nodeID, r.groupID)
+			r.log.Println("using token for myself. CSID: ", r.groupID)
+			r.using = true
+			r.enterCSCh <- struct{}{}
+			continue
 		}
+
+		r.requestQueue.Remove(e)
+		r.log.Println("giving privilege to ", next)
+		t := r.token
+		r.token = nil
+		r.holder = next
+		r.asked = false
+		r.send(message{SenderID: r.nodeID, ReceiverID: next, Message: MessagePrivilege, Token: t})
+		// request token back if anyone else is waiting
+		r.makeRequest()
 	}
 }
 
 func (r *Node) AskToEnterCS(CSID string) {
-	request := request{ID: r.nodeID, CSID: CSID}
-	r.requestQueue.PushBack(request)
-	if r.hasToken(CSID) {
-		r.assignPrivilege(CSID)
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.askToEnterCS(CSID)
+}
+
+func (r *Node) askToEnterCS(CSID string) {
+	r.requesting = true
+	r.groupID = CSID
+	r.enqueue(r.nodeID)
+	if r.holder == r.nodeID {
+		r.assignPrivilege()
 	} else {
-		r.makeRequest(CSID)
+		r.makeRequest()
 	}
 }
 
@@ -164,62 +184,84 @@ func (r *Node) WaitForCS() {
 	<-r.enterCSCh
 }
 
+// TryWaitForCS is WaitForCS which doesn't block. It reports whether CS was
+// granted.
+func (r *Node) TryWaitForCS() bool {
+	select {
+	case <-r.enterCSCh:
+		return true
+	default:
+		return false
+	}
+}
+
 func (r *Node) InCS() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
 	return r.using
 }
 
 func (r *Node) EnterCS() {
+	r.mutex.Lock()
 	r.using = true
+	r.requesting = false
+	r.mutex.Unlock()
 }
+
 func (r *Node) ExitCS() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
 	r.using = false
 	r.groupID = ""
-	r.assignPrivilege("")
+	r.release(r.nodeID)
+}
+
+// release frees the place of origin on the bridge, or routes it towards the token
+func (r *Node) release(origin int) {
+	if r.token != nil {
+		r.token.release(origin)
+		r.assignPrivilege()
+		return
+	}
+	r.send(message{SenderID: r.nodeID, ReceiverID: r.holder, Message: MessageRelease, Origin: origin})
 }
 
 func (r *Node) ProcessMessage(b []byte) {
 	var m message
-	json.Unmarshal(b, &m)
+	if err := json.Unmarshal(b, &m); err != nil {
+		r.log.Println("❗️", err)
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
 	switch m.Message {
 	case MessageRequest:
-		request := request{ID: m.SenderID, CSID: m.CSID}
-		r.requestQueue.PushBack(request)
-		if r.hasToken(m.CSID) {
-			r.assignPrivilege(m.CSID)
-		} else if r.getOtherHolder() != -1 && r.getOtherHolder() != m.SenderID {
-			r.makeRequest(m.CSID)
+		r.enqueue(m.SenderID)
+		if r.holder == r.nodeID {
+			r.assignPrivilege()
 		} else {
-			log.Println("❗️ message got ignored")
+			r.makeRequest()
 		}
 	case MessagePrivilege:
-		req := request{ID: r.nodeID, CSID: m.CSID}
-		r.tdb.PushBack(req)
-		r.assignPrivilege(m.CSID)
+		r.holder = r.nodeID
+		r.token = m.Token
+		r.asked = false
+		r.assignPrivilege()
+	case MessageRelease:
+		r.release(m.Origin)
+	case MessageCancel:
+		if r.remove(m.SenderID) {
+			r.cancelRequest()
+		}
 	}
 }
 
+// Start handles messages one at a time, in the order the transport delivers them
 func (r *Node) Start() {
-
-	s, err := net.ResolveUDPAddr("udp4", r.listenAddr)
-	if err != nil {
-		log.Fatalln(err)
-	}
-
-	conn, err := net.ListenUDP("udp4", s)
-	if err != nil {
-		log.Fatalln(err)
-	}
-	defer conn.Close()
-
-	for {
-		buffer := make([]byte, 1024)
-		n, _, err := conn.ReadFromUDP(buffer)
-		if err != nil {
-			log.Println("failed to read from udp: ", err)
-			break
-		}
-		b := buffer[0 : n-1]
-		log.Println(fmt.Sprintf("[%d]", r.ID()), "<<- ", string(b))
-		go r.ProcessMessage(b)
+	for b := range r.transport.Receive() {
+		r.log.Println("<<- ", string(b))
+		r.ProcessMessage(b)
 	}
 }
@@ -0,0 +1,98 @@
+package raymond
+
+import (
+	"context"
+	"distributed-lock-example/acquire"
+	"distributed-lock-example/lease"
+)
+
+// Acquire asks for the token and blocks until this node is in CS, or ctx is
+// done. In the latter case the request is taken off the request queues along
+// the path to the holder and ctx.Err() is returned.
+func (r *Node) Acquire(ctx context.Context, _ string) error {
+	r.mutex.Lock()
+	if r.closed {
+		r.mutex.Unlock()
+		return acquire.ErrClosed
+	}
+	if r.leaving != nil {
+		r.mutex.Unlock()
+		return ErrLeaving
+	}
+	if r.requesting || r.using {
+		r.mutex.Unlock()
+		return acquire.ErrBusy
+	}
+	r.askToEnterCS()
+	r.mutex.Unlock()
+
+	select {
+	case <-r.enterCSCh:
+		r.EnterCS()
+		return nil
+	case <-ctx.Done():
+	}
+
+	r.log.Println("giving up on CS: ", ctx.Err())
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.requesting = false
+	select {
+	case <-r.enterCSCh:
+		// token arrived meanwhile. pass it on as if we just left CS
+		r.using = false
+		r.assignPrivilege()
+		r.maybeFinishElection()
+	default:
+		r.requestQueue.Remove(r.id)
+		r.cancelRequest()
+	}
+	return ctx.Err()
+}
+
+// cancelRequest withdraws the request made to holder if nobody in the queue
+// needs the token anymore. expects r.mutex to be held
+func (r *Node) cancelRequest() {
+	if r.holder == r.id {
+		// an earlier request may now be at the front
+		r.assignPrivilege()
+		return
+	}
+	if r.asked && r.requestQueue.Len() == 0 {
+		m := message{SenderID: r.id, Message: MessageCancel, ReceiverID: r.holder}
+		if err := r.send(m); err != nil {
+			r.log.Println("❗️", err)
+		}
+		r.asked = false
+	}
+}
+
+// TryAcquire is Acquire with a short timeout, acquire.TryTimeout. It returns
+// false if the token did not arrive in time.
+func (r *Node) TryAcquire(CSID string) (bool, error) {
+	return acquire.Try(func(ctx context.Context) error { return r.Acquire(ctx, CSID) })
+}
+
+// Release leaves CS. It returns lease.ErrExpired if the lease ran out before.
+func (r *Node) Release() error {
+	r.mutex.Lock()
+	using, expired := r.using, r.expired
+	r.expired = false
+	r.mutex.Unlock()
+	if !using {
+		if expired {
+			return lease.ErrExpired
+		}
+		return acquire.ErrNotInCS
+	}
+	r.ExitCS()
+	return nil
+}
+
+// Close stops the node. Start returns once the transport is closed.
+func (r *Node) Close() error {
+	r.mutex.Lock()
+	r.closed = true
+	r.mutex.Unlock()
+	return r.transport.Close()
+}
@@ -0,0 +1,87 @@
+package raymond
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestCancelledAcquireLeavesQueues(t *testing.T) {
+	noProbes(t)
+	nodes, _ := newTree(t, []int{-1, 0, 0})
+	start(nodes...)
+	if err := nodes[0].Acquire(context.Background(), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := nodes[1].Acquire(ctx, ""); err != context.DeadlineExceeded {
+		t.Fatalf("acquire while token is in use: %v", err)
+	}
+	eventually(t, "cancelled request still queued at the holder", func() bool {
+		return !contains(nodes[0].Status().Queue, 1)
+	})
+
+	errCh := acquireAsync(context.Background(), nodes[2])
+	eventually(t, "request of 2 never reached the holder", func() bool {
+		return contains(nodes[0].Status().Queue, 2)
+	})
+	if err := nodes[0].Release(); err != nil {
+		t.Fatal(err)
+	}
+	waitAcquired(t, nodes[2], errCh)
+	if nodes[1].InCS() {
+		t.Fatal("cancelled node got CS")
+	}
+
+	errCh = acquireAsync(context.Background(), nodes[1])
+	nodes[2].Release()
+	waitAcquired(t, nodes[1], errCh)
+	if h := holders(nodes); len(h) != 1 || h[0] != 1 {
+		t.Fatalf("token is at %v", h)
+	}
+}
+
+// The privilege is handed to node 1 after its Acquire gave up waiting, but
+// before it took its request back. The token must go on to the next requester.
+func TestTokenArrivingWhileCancellingIsPassedOn(t *testing.T) {
+	noProbes(t)
+	nodes, _ := newTree(t, []int{-1, 0, 0})
+	start(nodes[0], nodes[2]) // messages to 1 are handled by the test
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled := acquireAsync(ctx, nodes[1])
+	eventually(t, "privilege never sent to 1", func() bool { return nodes[0].Status().Holder == 1 })
+	errCh := acquireAsync(context.Background(), nodes[2])
+	eventually(t, "request of 2 never forwarded to 1", func() bool { return nodes[0].Status().Asked })
+
+	var m message
+	for m.Message != MessagePrivilege {
+		if err := json.Unmarshal(<-nodes[1].transport.Receive(), &m); err != nil || m.Message != MessageDegree && m.Message != MessagePrivilege {
+			t.Fatalf("node 1 got %+v, %v", m, err)
+		}
+	}
+	n := nodes[1]
+	n.mutex.Lock()
+	cancel()
+	time.Sleep(50 * time.Millisecond) // Acquire sees ctx done and waits for the mutex
+	// what ProcessMessage does with a privilege
+	n.holder = n.id
+	n.assignPrivilege()
+	n.mutex.Unlock()
+
+	if err := <-cancelled; err != context.Canceled {
+		t.Fatalf("cancelled acquire returned %v", err)
+	}
+	start(n) // request of 0 on behalf of 2
+	waitAcquired(t, nodes[2], errCh)
+	if n.InCS() {
+		t.Fatal("cancelled node is in CS")
+	}
+	if h := holders(nodes); fmt.Sprint(h) != "[2]" {
+		t.Fatalf("token is at %v", h)
+	}
+}
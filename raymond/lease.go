@@ -0,0 +1,50 @@
+package raymond
+
+import (
+	"context"
+	"distributed-lock-example/lease"
+	"time"
+)
+
+// SetLease turns lease mode on. A node which stays in CS longer than d leaves
+// CS by itself and passes the token on. 0 turns lease mode off. Only the
+// holder times its lease, so the token of a holder which crashes in CS is
+// recovered only by regeneration, after its neighbours remove it.
+func (r *Node) SetLease(d time.Duration) {
+	r.mutex.Lock()
+	r.lease = d
+	r.mutex.Unlock()
+}
+
+// AcquireLease is Acquire which returns the grant
+func (r *Node) AcquireLease(ctx context.Context, CSID string) (lease.Grant, error) {
+	if err := r.Acquire(ctx, CSID); err != nil {
+		return lease.Grant{}, err
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.grant, nil
+}
+
+// startLease counts the grant on the token. expects r.mutex to be held
+func (r *Node) startLease() {
+	r.fence++
+	r.grant = lease.Grant{Fence: r.fence}
+	if r.lease == 0 {
+		return
+	}
+	r.grant.Expires = time.Now().Add(r.lease)
+	fence := r.fence
+	time.AfterFunc(r.lease, func() {
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		if !r.using || r.fence != fence {
+			return
+		}
+		r.log.Println("⌛️ lease expired. leaving CS")
+		r.using = false
+		r.expired = true
+		r.assignPrivilege()
+		r.maybeFinishElection()
+	})
+}
@@ -35,3 +35,27 @@ func (q *Queue) Dequeue() interface{} {
 	q.lock.Unlock()
 	return v
 }
+
+// Remove deletes first occurrence of v. returns false if v is not in queue
+func (q *Queue) Remove(v interface{}) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for e := q.q.Front(); e != nil; e = e.Next() {
+		if e.Value == v {
+			q.q.Remove(e)
+			return true
+		}
+	}
+	return false
+}
+
+// Values returns queued values from front to back
+func (q *Queue) Values() []interface{} {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	vs := make([]interface{}, 0, q.q.Len())
+	for e := q.q.Front(); e != nil; e = e.Next() {
+		vs = append(vs, e.Value)
+	}
+	return vs
+}
@@ -1,44 +1,75 @@
 package raymond
 
 import (
+	"distributed-lock-example/lease"
 	"distributed-lock-example/logger"
-	udpclient "distributed-lock-example/udpclient"
+	"distributed-lock-example/transport"
 	"encoding/json"
 	"fmt"
-	"log"
-	"net"
 	"sync"
+	"time"
 )
 
 var MessageRequest string = "request"
 var MessagePrivilege string = "privilege"
+var MessageCancel string = "cancel"
 
 type message struct {
-	SenderID     int    `json:"senderId"`
-	ReceiverID   int    `json:"receiverId"`
-	ReceiverAddr string `json:"receiverAddr"`
-	Message      string `json:"message"`
+	SenderID   int    `json:"senderId"`
+	ReceiverID int    `json:"receiverId"`
+	Message    string `json:"message"`
+	Fence      uint64 `json:"fence,omitempty"` // in privilege and elected
+	Epoch      uint64 `json:"epoch"`           // incremented on every token regeneration
+	Candidate  int    `json:"candidate"`       // only in election and elected
+	Path       []int  `json:"path,omitempty"`  // only in probe and alive
+
+	// joining and leaving
+	Addr      string         `json:"addr,omitempty"`      // in join, rejoin and reparent
+	Successor int            `json:"successor,omitempty"` // in rejoin and reparent
+	Children  []int          `json:"children,omitempty"`  // in leave
+	Queue     []int          `json:"queue,omitempty"`     // in leave
+	Addrs     map[int]string `json:"addrs,omitempty"`     // in leave
+	Token     bool           `json:"token,omitempty"`     // in leave
+	InFlight  bool           `json:"inFlight,omitempty"`  // in left
+
+	Degree int `json:"degree,omitempty"` // in degree
 }
 
 type Node struct {
 	id           int
-	neighbours   map[int]string
+	neighbours   []int
 	using        bool
 	requestQueue *Queue
 	holder       int
 	asked        bool
+	requesting   bool
+	closed       bool
+	fence        uint64 // fencing token of the latest grant. travels with the privilege
+	lease        time.Duration
+	grant        lease.Grant
+	expired      bool        // lease ran out before ExitCS
+	epoch        uint64      // messages of other epochs are stale
+	degrees      map[int]int // num of neighbours of each neighbour, as it last told
+	election     *election
+	watchSeq     int  // invalidates older token watches
+	probeMisses  int  // consecutive probes without answer
+	probeAcked   bool // last probe was answered
+	joining      bool
+	addr         string // own address, told to the parent on join
+	leaving      *leaving
 	enterCSCh    chan struct{}
 	log          logger.Logger
 	mutex        *sync.Mutex
-	listenAddr   string
+	transport    transport.Transport
 }
 
-func NewNode(ID int, listenAddr string, neighbourIDs map[int]string, holder int) *Node {
+func NewNode(ID int, neighbourIDs []int, holder int, t transport.Transport) *Node {
 	return &Node{id: ID,
 		neighbours: neighbourIDs, requestQueue: NewQueue(), holder: holder, enterCSCh: make(chan struct{}, 1),
-		log:        logger.Logger{Prefix: fmt.Sprintf("[%d]", ID)},
-		mutex:      &sync.Mutex{},
-		listenAddr: listenAddr,
+		degrees:   map[int]int{},
+		log:       logger.Logger{Prefix: fmt.Sprintf("[%d]", ID)},
+		mutex:     &sync.Mutex{},
+		transport: t,
 	}
 }
 
@@ -46,16 +77,19 @@ func (r *Node) ID() int {
 	return r.id
 }
 
+func (r *Node) send(m message) error {
+	m.Epoch = r.epoch
+	b, _ := json.Marshal(m)
+	r.log.Println("->> ", string(b))
+	return r.transport.Send(m.ReceiverID, b)
+}
+
+// makeRequest and assignPrivilege expect r.mutex to be held by the caller
 func (r *Node) makeRequest() {
-	var holderID int
-	r.mutex.Lock()
-	holderID = r.holder
-	r.mutex.Unlock()
-	if holderID != r.id && !r.asked && r.requestQueue.Len() > 0 {
-		m := message{SenderID: r.id, Message: MessageRequest, ReceiverID: holderID, ReceiverAddr: r.neighbours[holderID]}
-		b, _ := json.Marshal(m)
-		r.log.Println("->> ", string(b))
-		if err := udpclient.SendMessage(m.ReceiverAddr, b); err != nil {
+	holderID := r.holder
+	if holderID != r.id && holderID != noHolder && !r.asked && r.requestQueue.Len() > 0 {
+		m := message{SenderID: r.id, Message: MessageRequest, ReceiverID: holderID}
+		if err := r.send(m); err != nil {
 			r.log.Fatalln("❗️", err)
 		}
 		r.asked = true
@@ -65,10 +99,7 @@ func (r *Node) makeRequest() {
 }
 
 func (r *Node) assignPrivilege() {
-	var holderID int
-	r.mutex.Lock()
-	holderID = r.holder
-	r.mutex.Unlock()
+	holderID := r.holder
 	if holderID == r.id && !r.using && r.requestQueue.Len() > 0 {
 
 		nextHolder := r.requestQueue.Dequeue().(int)
@@ -83,16 +114,12 @@ func (r *Node) assignPrivilege() {
 			r.using = true
 		} else {
 			r.log.Println("giving privilege to ", nextHolder)
-			m := message{SenderID: r.id, Message: MessagePrivilege, ReceiverAddr: r.neighbours[nextHolder]}
-			b, _ := json.Marshal(m)
-			r.log.Println("->> ", string(b))
-			if err := udpclient.SendMessage(m.ReceiverAddr, b); err != nil {
+			m := message{SenderID: r.id, Message: MessagePrivilege, ReceiverID: nextHolder, Fence: r.fence}
+			if err := r.send(m); err != nil {
 				r.log.Fatalln("❗️", err)
 			}
-			r.mutex.Lock()
 			r.asked = false
 			r.holder = nextHolder
-			r.mutex.Unlock()
 			r.log.Println("new holder is ", r.holder)
 			// 3.4 section of raymond publication paper states:
 			// "If the privilege is passed to another node, MAKE_REQUEST may request that the privilege be returned."
@@ -103,6 +130,14 @@ func (r *Node) assignPrivilege() {
 }
 
 func (r *Node) AskToEnterCS(_ string /* just to statisfy interface */) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.askToEnterCS()
+}
+
+func (r *Node) askToEnterCS() {
+	r.requesting = true
+	r.expired = false
 	// r.requestQueue.PushBack(r.nodeID)
 	r.requestQueue.Enqueue(r.id)
 	if r.holder == r.id {
@@ -110,6 +145,7 @@ func (r *Node) AskToEnterCS(_ string /* just to statisfy interface */) {
 	} else {
 		r.log.Println("asking holder for token...")
 		r.makeRequest()
+		r.watchToken()
 	}
 }
 
@@ -117,16 +153,36 @@ func (r *Node) WaitForCS() {
 	<-r.enterCSCh
 }
 
+// TryWaitForCS is WaitForCS which doesn't block. It reports whether CS was
+// granted.
+func (r *Node) TryWaitForCS() bool {
+	select {
+	case <-r.enterCSCh:
+		return true
+	default:
+		return false
+	}
+}
+
 func (r *Node) InCS() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
 	return r.using
 }
 
 func (r *Node) EnterCS() {
+	r.mutex.Lock()
 	r.using = true
+	r.requesting = false
+	r.startLease()
+	r.mutex.Unlock()
 }
 func (r *Node) ExitCS() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
 	r.using = false
 	r.assignPrivilege()
+	r.maybeFinishElection()
 }
 func (r *Node) ProcessMessage(b []byte) {
 	var m message
@@ -134,6 +190,19 @@ func (r *Node) ProcessMessage(b []byte) {
 		r.log.Println("⚠️", err)
 		return
 	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.leaving != nil {
+		r.processWhileLeaving(m)
+		return
+	}
+	switch m.Message {
+	case MessageRequest, MessagePrivilege, MessageCancel:
+		if m.Epoch != r.epoch {
+			r.log.Printf("dropping %s of epoch %d. current epoch is %d", m.Message, m.Epoch, r.epoch)
+			return
+		}
+	}
 	switch m.Message {
 	case MessageRequest:
 		// r.requestQueue.PushBack(m.SenderID)
@@ -145,32 +214,47 @@ func (r *Node) ProcessMessage(b []byte) {
 		}
 	case MessagePrivilege:
 		r.holder = r.id
+		if m.Fence > r.fence {
+			r.fence = m.Fence
+		}
 		r.assignPrivilege()
+	case MessageCancel:
+		if r.requestQueue.Remove(m.SenderID) {
+			r.cancelRequest()
+		}
+	case MessageProbe:
+		r.onProbe(m)
+	case MessageAlive:
+		r.onAlive(m)
+	case MessageElection:
+		r.onElection(m)
+	case MessageElected:
+		r.onElected(m)
+	case MessageCoordinator:
+		r.onCoordinator(m)
+	case MessageJoin:
+		r.onJoin(m)
+	case MessageWelcome:
+		r.onWelcome(m)
+	case MessageRejoin:
+		r.onRejoin(m)
+	case MessageLeave:
+		r.onLeave(m)
+	case MessageReparent:
+		r.onReparent(m)
+	case MessageDegree:
+		r.degrees[m.SenderID] = m.Degree
 	}
 }
 
+// Start tells neighbours how many neighbours this node has, then handles
+// messages one at a time, in the order the transport delivers them
 func (r *Node) Start() {
-
-	s, err := net.ResolveUDPAddr("udp4", r.listenAddr)
-	if err != nil {
-		log.Fatalln(err)
-	}
-
-	conn, err := net.ListenUDP("udp4", s)
-	if err != nil {
-		log.Fatalln(err)
-	}
-	defer conn.Close()
-
-	for {
-		buffer := make([]byte, 1024)
-		n, _, err := conn.ReadFromUDP(buffer)
-		if err != nil {
-			log.Println("failed to read from udp: ", err)
-			break
-		}
-		b := buffer[0 : n-1]
-		log.Println(fmt.Sprintf("[%d]", r.ID()), "<<- ", string(b))
-		go r.ProcessMessage(b)
+	r.mutex.Lock()
+	r.tellDegree()
+	r.mutex.Unlock()
+	for b := range r.transport.Receive() {
+		r.log.Println("<<- ", string(b))
+		r.ProcessMessage(b)
 	}
 }
@@ -0,0 +1,109 @@
+package raymond
+
+import (
+	"context"
+	"distributed-lock-example/transport"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(ioutil.Discard) // nodes log every message
+	os.Exit(m.Run())
+}
+
+// newTree creates nodes 0..len(parents)-1. parents[i] is the parent of node i,
+// node 0 is the root and holds the token. Nodes are not started, they are
+// closed when the test ends.
+func newTree(t *testing.T, parents []int) ([]*Node, *transport.Network) {
+	network := transport.NewNetwork()
+	neighbours := make([][]int, len(parents))
+	for id, parent := range parents {
+		if id == 0 {
+			continue
+		}
+		neighbours[id] = append(neighbours[id], parent)
+		neighbours[parent] = append(neighbours[parent], id)
+	}
+	nodes := []*Node{}
+	for id := range parents {
+		holder := 0
+		if id != 0 {
+			holder = parents[id]
+		}
+		nodes = append(nodes, NewNode(id, neighbours[id], holder, network.Join(id)))
+	}
+	t.Cleanup(func() {
+		for _, n := range nodes {
+			n.Close()
+		}
+	})
+	return nodes, network
+}
+
+func start(nodes ...*Node) {
+	for _, n := range nodes {
+		go n.Start()
+	}
+}
+
+// acquireAsync runs Acquire in the background
+func acquireAsync(ctx context.Context, n *Node) <-chan error {
+	errCh := make(chan error, 1)
+	go func() { errCh <- n.Acquire(ctx, "") }()
+	return errCh
+}
+
+func waitAcquired(t *testing.T, n *Node, errCh <-chan error) {
+	t.Helper()
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatalf("node %d: %v", n.id, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("node %d never entered CS", n.id)
+	}
+}
+
+// eventually polls cond until it holds, or fails the test
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal(what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// holders returns ids of nodes which have the token
+func holders(nodes []*Node) []int {
+	ids := []int{}
+	for _, n := range nodes {
+		if s := n.Status(); s.Holder == s.ID {
+			ids = append(ids, s.ID)
+		}
+	}
+	return ids
+}
+
+func contains(ids []int, id int) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+// noProbes turns token probing off for the test
+func noProbes(t *testing.T) {
+	timeout := TokenTimeout
+	TokenTimeout = 0
+	t.Cleanup(func() { TokenTimeout = timeout })
+}
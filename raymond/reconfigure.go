@@ -0,0 +1,310 @@
+package raymond
+
+import (
+	"context"
+	"distributed-lock-example/acquire"
+	"distributed-lock-example/transport"
+	"errors"
+	"sort"
+)
+
+// Joining and leaving a running tree.
+//
+// A joining node attaches under a parent as a leaf, pointing at the parent as
+// holder. The parent answers with the current epoch, and the new node may ask
+// for the token from then on.
+//
+// A leaving node hands everything to a successor: the neighbour towards the
+// token, or any neighbour if it has the token itself. The successor adopts the
+// other neighbours, requests queued at the leaving node, and the token if
+// there is one. The other neighbours replace the leaving node with the
+// successor. Until everyone has switched over, the leaving node forwards
+// requests and a privilege still on its way to it.
+
+var MessageJoin string = "join"
+var MessageWelcome string = "welcome"
+var MessageRejoin string = "rejoin"
+var MessageLeave string = "leave"
+var MessageLeft string = "left"
+var MessageReparent string = "reparent"
+var MessageReparented string = "reparented"
+
+var ErrLeaving = errors.New("node is leaving the tree")
+
+type leaving struct {
+	successor int
+	waiting   map[int]bool // neighbours which haven't switched over yet
+	inFlight  bool         // successor has sent the token here
+	forwarded bool         // token which was on its way was passed to successor
+	done      chan struct{}
+}
+
+func (l *leaving) finished() bool {
+	return len(l.waiting) == 0 && (!l.inFlight || l.forwarded)
+}
+
+// Join attaches this node to a running tree under parent. addr is where other
+// nodes reach this node. The transport must already reach parent.
+func (r *Node) Join(parent int, addr string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.leaving != nil {
+		return ErrLeaving
+	}
+	r.log.Println("🤝 joining under ", parent)
+	r.neighbours = []int{parent}
+	r.holder = noHolder
+	r.joining = true
+	r.addr = addr
+	return r.send(message{SenderID: r.id, ReceiverID: parent, Message: MessageJoin, Addr: addr})
+}
+
+func (r *Node) onJoin(m message) {
+	if err := transport.AddPeer(r.transport, m.SenderID, m.Addr); err != nil {
+		r.log.Println("❗️", err)
+		return
+	}
+	r.log.Println("🤝 adopting ", m.SenderID)
+	if !r.isNeighbour(m.SenderID) {
+		r.neighbours = append(r.neighbours, m.SenderID)
+		sort.Ints(r.neighbours)
+	}
+	r.send(message{SenderID: r.id, ReceiverID: m.SenderID, Message: MessageWelcome})
+	r.tellDegree()
+}
+
+func (r *Node) onWelcome(m message) {
+	if !r.joining {
+		return
+	}
+	r.joining = false
+	r.epoch = m.Epoch
+	r.neighbours = []int{m.SenderID}
+	r.holder = m.SenderID
+	r.tellDegree()
+	r.resume()
+}
+
+// onRejoin is the answer of a parent which is leaving itself
+func (r *Node) onRejoin(m message) {
+	if !r.joining {
+		return
+	}
+	if err := transport.AddPeer(r.transport, m.Successor, m.Addr); err != nil {
+		r.log.Println("❗️", err)
+		return
+	}
+	r.log.Println("🤝 joining under ", m.Successor, " instead")
+	r.neighbours = []int{m.Successor}
+	r.send(message{SenderID: r.id, ReceiverID: m.Successor, Message: MessageJoin, Addr: r.addr})
+}
+
+// Leave hands this node's part of the tree over to a neighbour and returns once
+// nothing depends on this node anymore. The node must not be requesting or in
+// CS. After Leave it only forwards stray messages and can be closed.
+func (r *Node) Leave(ctx context.Context) error {
+	r.mutex.Lock()
+	if r.leaving != nil {
+		r.mutex.Unlock()
+		return ErrLeaving
+	}
+	if r.requesting || r.using || r.joining || r.election != nil || r.holder == noHolder {
+		r.mutex.Unlock()
+		return acquire.ErrBusy
+	}
+	l := &leaving{waiting: map[int]bool{}, done: make(chan struct{})}
+	r.leaving = l
+	if len(r.neighbours) == 0 {
+		close(l.done)
+		r.mutex.Unlock()
+		return nil
+	}
+
+	hasToken := r.holder == r.id
+	l.successor = r.holder
+	if hasToken {
+		l.successor = r.neighbours[0]
+	}
+	r.log.Println("👋 leaving. handing over to ", l.successor)
+
+	var children []int
+	addrs := map[int]string{}
+	for _, id := range r.neighbours {
+		l.waiting[id] = true
+		if id != l.successor {
+			children = append(children, id)
+			addrs[id], _ = transport.PeerAddr(r.transport, id)
+		}
+	}
+	var queue []int
+	for _, v := range r.requestQueue.Values() {
+		if id := v.(int); id != l.successor && id != r.id {
+			queue = append(queue, id)
+		}
+	}
+	r.send(message{SenderID: r.id, ReceiverID: l.successor, Message: MessageLeave,
+		Children: children, Queue: queue, Addrs: addrs, Token: hasToken, Fence: r.fence})
+	successorAddr, _ := transport.PeerAddr(r.transport, l.successor)
+	for _, id := range children {
+		r.send(message{SenderID: r.id, ReceiverID: id, Message: MessageReparent, Successor: l.successor, Addr: successorAddr})
+	}
+	r.holder = l.successor
+	r.asked = false
+	r.requestQueue = NewQueue()
+	r.watchSeq++
+	r.mutex.Unlock()
+
+	select {
+	case <-l.done:
+		r.log.Println("👋 left")
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// onLeave takes over neighbours, queued requests and maybe the token of a
+// leaving neighbour
+func (r *Node) onLeave(m message) {
+	leaver := m.SenderID
+	for _, id := range m.Children {
+		if err := transport.AddPeer(r.transport, id, m.Addrs[id]); err != nil {
+			r.log.Println("❗️", err)
+		}
+		if !r.isNeighbour(id) {
+			r.neighbours = append(r.neighbours, id)
+		}
+	}
+	r.removeNeighbour(leaver)
+	sort.Ints(r.neighbours)
+	r.tellDegree()
+	r.log.Printf("👋 taking over %v from %d", m.Children, leaver)
+
+	inFlight := false
+	switch {
+	case m.Token:
+		r.holder = r.id
+		r.asked = false
+		if m.Fence > r.fence {
+			r.fence = m.Fence
+		}
+		r.requestQueue.Remove(leaver)
+		for _, id := range m.Queue {
+			r.requestQueue.Enqueue(id)
+		}
+	case r.holder == leaver:
+		// token is on its way to leaver, which passes it back
+		inFlight = true
+		r.asked = true
+		r.requestQueue.Remove(leaver)
+		for _, id := range m.Queue {
+			r.requestQueue.Enqueue(id)
+		}
+	default:
+		// requests of leaver's subtree take the place of leaver's own request
+		queue := r.requestQueue.Values()
+		r.requestQueue = NewQueue()
+		replaced := false
+		for _, v := range queue {
+			if v.(int) != leaver {
+				r.requestQueue.Enqueue(v)
+				continue
+			}
+			replaced = true
+			for _, id := range m.Queue {
+				r.requestQueue.Enqueue(id)
+			}
+		}
+		if !replaced {
+			for _, id := range m.Queue {
+				r.requestQueue.Enqueue(id)
+			}
+		}
+	}
+	r.send(message{SenderID: r.id, ReceiverID: leaver, Message: MessageLeft, InFlight: inFlight})
+	if r.holder == r.id {
+		r.assignPrivilege()
+	} else {
+		r.makeRequest()
+	}
+}
+
+func (r *Node) onReparent(m message) {
+	leaver := m.SenderID
+	if err := transport.AddPeer(r.transport, m.Successor, m.Addr); err != nil {
+		r.log.Println("❗️", err)
+	}
+	r.removeNeighbour(leaver)
+	if !r.isNeighbour(m.Successor) {
+		r.neighbours = append(r.neighbours, m.Successor)
+		sort.Ints(r.neighbours)
+	}
+	if r.holder == leaver {
+		r.holder = m.Successor
+	}
+	if r.requestQueue.Remove(leaver) {
+		r.requestQueue.Enqueue(m.Successor)
+	}
+	r.log.Printf("👋 %d left. new neighbour is %d", leaver, m.Successor)
+	r.send(message{SenderID: r.id, ReceiverID: leaver, Message: MessageReparented})
+	r.tellDegree()
+}
+
+// processWhileLeaving forwards what still arrives at a leaving node
+func (r *Node) processWhileLeaving(m message) {
+	l := r.leaving
+	switch m.Message {
+	case MessagePrivilege:
+		if m.Epoch != r.epoch {
+			return
+		}
+		r.log.Println("👋 passing token on to ", l.successor)
+		r.send(message{SenderID: r.id, ReceiverID: l.successor, Message: MessagePrivilege, Fence: m.Fence})
+		l.forwarded = true
+	case MessageRequest, MessageCancel:
+		if m.SenderID == l.successor || m.Epoch != r.epoch {
+			return
+		}
+		// on behalf of the sender, which is successor's neighbour now
+		r.send(message{SenderID: m.SenderID, ReceiverID: l.successor, Message: m.Message})
+	case MessageJoin:
+		addr, _ := transport.PeerAddr(r.transport, l.successor)
+		r.send(message{SenderID: r.id, ReceiverID: m.SenderID, Message: MessageRejoin, Successor: l.successor, Addr: addr})
+	case MessageElection:
+		// nothing is behind a leaving node
+		r.send(message{SenderID: r.id, ReceiverID: m.SenderID, Message: MessageElected, Candidate: m.Candidate, Fence: r.fence})
+	case MessageLeft:
+		l.inFlight = m.InFlight
+		delete(l.waiting, m.SenderID)
+	case MessageReparented:
+		delete(l.waiting, m.SenderID)
+	}
+	if l.finished() {
+		select {
+		case <-l.done:
+		default:
+			close(l.done)
+		}
+	}
+}
+
+// isNeighbour expects r.mutex to be held
+func (r *Node) isNeighbour(id int) bool {
+	for _, n := range r.neighbours {
+		if n == id {
+			return true
+		}
+	}
+	return false
+}
+
+// removeNeighbour expects r.mutex to be held
+func (r *Node) removeNeighbour(id int) {
+	neighbours := make([]int, 0, len(r.neighbours))
+	for _, n := range r.neighbours {
+		if n != id {
+			neighbours = append(neighbours, n)
+		}
+	}
+	r.neighbours = neighbours
+}
@@ -0,0 +1,180 @@
+package raymond
+
+import (
+	"context"
+	"distributed-lock-example/transport"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// newJoiner creates node id outside the tree, started
+func newJoiner(t *testing.T, network *transport.Network, id int) *Node {
+	n := NewNode(id, nil, noHolder, network.Join(id))
+	t.Cleanup(func() { n.Close() })
+	start(n)
+	return n
+}
+
+func leave(t *testing.T, n *Node) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := n.Leave(ctx); err != nil {
+		t.Fatalf("node %d: leave: %v", n.id, err)
+	}
+}
+
+// checkTree checks neighbours and holder pointers of nodes, -1 in holders
+// for a node with the token
+func checkTree(t *testing.T, nodes []*Node, neighbours []string, holders []int) {
+	t.Helper()
+	for i, n := range nodes {
+		s := n.Status()
+		holder := holders[i]
+		if holder == -1 {
+			holder = s.ID
+		}
+		if fmt.Sprint(s.Neighbours) != neighbours[i] || s.Holder != holder {
+			t.Errorf("node %d: neighbours %v, holder %d. want %s, %d", s.ID, s.Neighbours, s.Holder, neighbours[i], holder)
+		}
+	}
+}
+
+func TestJoin(t *testing.T) {
+	noProbes(t)
+	nodes, network := newTree(t, []int{-1, 0})
+	start(nodes...)
+	n := newJoiner(t, network, 2)
+	if err := n.Join(1, ""); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "node 2 never welcomed", func() bool { return n.Status().Holder == 1 })
+	nodes = append(nodes, n)
+	checkTree(t, nodes, []string{"[1]", "[0 2]", "[1]"}, []int{-1, 0, 1})
+
+	if err := n.Acquire(context.Background(), ""); err != nil {
+		t.Fatal(err)
+	}
+	if h := holders(nodes); fmt.Sprint(h) != "[2]" {
+		t.Fatalf("token is at %v", h)
+	}
+}
+
+// Node 1 has left when node 2 asks to join under it. Node 1 sends it on to
+// its successor.
+func TestJoinUnderLeftNodeIsRedirected(t *testing.T) {
+	noProbes(t)
+	nodes, network := newTree(t, []int{-1, 0})
+	start(nodes...)
+	leave(t, nodes[1])
+
+	n := newJoiner(t, network, 2)
+	if err := n.Join(1, ""); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "node 2 never welcomed", func() bool { return n.Status().Holder == 0 })
+	checkTree(t, []*Node{nodes[0], n}, []string{"[2]", "[0]"}, []int{-1, 0})
+
+	if err := n.Acquire(context.Background(), ""); err != nil {
+		t.Fatal(err)
+	}
+	if h := holders([]*Node{nodes[0], n}); fmt.Sprint(h) != "[2]" {
+		t.Fatalf("token is at %v", h)
+	}
+}
+
+func TestLeaveOfHolder(t *testing.T) {
+	noProbes(t)
+	nodes, _ := newTree(t, []int{-1, 0, 0})
+	start(nodes...)
+	leave(t, nodes[0])
+
+	// node 1 is the successor and takes the token and node 2
+	checkTree(t, nodes[1:], []string{"[2]", "[1]"}, []int{-1, 1})
+	if err := nodes[2].Acquire(context.Background(), ""); err != nil {
+		t.Fatal(err)
+	}
+	if h := holders(nodes[1:]); fmt.Sprint(h) != "[2]" {
+		t.Fatalf("token is at %v", h)
+	}
+}
+
+// Node 1 leaves while the privilege it asked for on behalf of node 2 is on
+// its way to it. Node 1 passes it on to its successor, node 0, which gives it
+// to node 2.
+func TestLeaveWithPrivilegeInFlight(t *testing.T) {
+	noProbes(t)
+	nodes, _ := newTree(t, []int{-1, 0, 1})
+	start(nodes[0], nodes[2]) // messages to 1 are handled by the test until it leaves
+	n := nodes[1]
+
+	errCh := acquireAsync(context.Background(), nodes[2])
+	for {
+		n.ProcessMessage(<-n.transport.Receive())
+		if n.Status().Asked {
+			break // request of 2 went on to 0
+		}
+	}
+	eventually(t, "privilege never sent to 1", func() bool { return nodes[0].Status().Holder == 1 })
+
+	left := make(chan error, 1)
+	go func() { left <- n.Leave(context.Background()) }()
+	eventually(t, "node 1 never started leaving", func() bool {
+		n.mutex.Lock()
+		defer n.mutex.Unlock()
+		return n.leaving != nil
+	})
+	start(n)
+	select {
+	case err := <-left:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("leave never returned")
+	}
+	n.mutex.Lock()
+	inFlight, forwarded := n.leaving.inFlight, n.leaving.forwarded
+	n.mutex.Unlock()
+	if !inFlight || !forwarded {
+		t.Fatalf("in flight: %v, forwarded: %v", inFlight, forwarded)
+	}
+
+	waitAcquired(t, nodes[2], errCh)
+	rest := []*Node{nodes[0], nodes[2]}
+	checkTree(t, rest, []string{"[2]", "[0]"}, []int{2, -1})
+	if h := holders(rest); fmt.Sprint(h) != "[2]" {
+		t.Fatalf("token is at %v", h)
+	}
+}
+
+// Nodes 2 and 3 wait behind node 1 when it leaves. Their requests are queued
+// at node 0 in place of the request of node 1.
+func TestLeaveKeepsQueuedRequests(t *testing.T) {
+	noProbes(t)
+	nodes, _ := newTree(t, []int{-1, 0, 1, 1})
+	start(nodes...)
+	if err := nodes[0].Acquire(context.Background(), ""); err != nil {
+		t.Fatal(err)
+	}
+	second := acquireAsync(context.Background(), nodes[2])
+	eventually(t, "request of 2 never queued at 1", func() bool { return fmt.Sprint(nodes[1].Status().Queue) == "[2]" })
+	third := acquireAsync(context.Background(), nodes[3])
+	eventually(t, "request of 3 never queued at 1", func() bool { return fmt.Sprint(nodes[1].Status().Queue) == "[2 3]" })
+
+	leave(t, nodes[1])
+	rest := []*Node{nodes[0], nodes[2], nodes[3]}
+	checkTree(t, rest, []string{"[2 3]", "[0]", "[0]"}, []int{-1, 0, 0})
+	if q := nodes[0].Status().Queue; fmt.Sprint(q) != "[2 3]" {
+		t.Fatalf("queue of 0: %v", q)
+	}
+
+	nodes[0].Release()
+	waitAcquired(t, nodes[2], second)
+	nodes[2].Release()
+	waitAcquired(t, nodes[3], third)
+	if h := holders(rest); fmt.Sprint(h) != "[3]" {
+		t.Fatalf("token is at %v", h)
+	}
+}
@@ -0,0 +1,285 @@
+package raymond
+
+import (
+	"time"
+)
+
+// Token loss and regeneration.
+//
+// A node waiting for the token probes along holder pointers every
+// TokenTimeout. The holder answers along the same path. A probe gets no answer
+// if a node on the path is dead, or if a privilege was lost and two nodes
+// point at each other. After ProbeRetries unanswered probes, the waiting node
+// starts an election for the next epoch.
+//
+// The election floods the tree and echoes back. Of concurrent candidates the
+// one with the highest epoch, then the lowest id, wins. Every node joining the
+// election moves to the new epoch and forgets the old token, its requests and
+// holder pointer. Messages of older epochs are dropped from then on, so a
+// token which was only delayed can't show up again. A node in CS answers only
+// after leaving CS. Once all answers reach the winner, it creates the new
+// token and floods the tree with coordinator, so that every holder pointer
+// leads to it. Waiting nodes then ask for the token again.
+//
+// Dead neighbours must be removed with RemovePeer. Only a dead leaf can be
+// removed. Without a node which has other neighbours the tree would split, and
+// each part would elect a token of its own. Neighbours tell each other how
+// many neighbours they have whenever that changes, so that RemovePeer can
+// tell a leaf apart.
+
+var MessageProbe string = "probe"
+var MessageAlive string = "alive"
+var MessageElection string = "election"
+var MessageElected string = "elected"
+var MessageCoordinator string = "coordinator"
+var MessageDegree string = "degree"
+
+// TokenTimeout is how long a node waits for the token between probes. 0 turns
+// probing off, the token is then never considered lost.
+var TokenTimeout = time.Second
+
+// ProbeRetries is how many probes in a row may go unanswered before the token
+// is considered lost
+var ProbeRetries = 3
+
+// noHolder is holder of a node which doesn't know where the token is
+const noHolder = -1
+
+type election struct {
+	epoch     uint64
+	candidate int
+	parent    int          // neighbour the election came from. noHolder for the candidate
+	pending   map[int]bool // neighbours which haven't answered yet
+	fence     uint64       // largest fence seen in this subtree
+	answered  bool
+}
+
+// better reports whether candidacy (epoch, candidate) beats the running one
+func (el *election) better(epoch uint64, candidate int) bool {
+	return epoch > el.epoch || (epoch == el.epoch && candidate < el.candidate)
+}
+
+// watchToken probes for the token while this node waits for it. expects
+// r.mutex to be held
+func (r *Node) watchToken() {
+	r.watchSeq++
+	r.probeMisses = 0
+	r.probeAcked = true
+	seq := r.watchSeq
+	if TokenTimeout == 0 {
+		return
+	}
+	time.AfterFunc(TokenTimeout, func() { r.checkToken(seq) })
+}
+
+func (r *Node) checkToken(seq int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if seq != r.watchSeq || r.closed || !r.requesting || r.using || r.holder == r.id || r.election != nil || r.joining {
+		return
+	}
+	if r.probeAcked {
+		r.probeMisses = 0
+	} else {
+		r.probeMisses++
+	}
+	if r.probeMisses >= ProbeRetries {
+		r.log.Printf("❓ %d probes unanswered. token is lost", r.probeMisses)
+		r.startElection()
+		return
+	}
+	r.probeAcked = false
+	r.send(message{SenderID: r.id, ReceiverID: r.holder, Message: MessageProbe, Path: []int{r.id}})
+	time.AfterFunc(TokenTimeout, func() { r.checkToken(seq) })
+}
+
+func (r *Node) onProbe(m message) {
+	if m.Epoch != r.epoch || r.election != nil {
+		return
+	}
+	if r.holder == r.id || r.using {
+		r.send(message{SenderID: r.id, ReceiverID: m.Path[len(m.Path)-1], Message: MessageAlive, Path: m.Path})
+		return
+	}
+	if r.holder == noHolder {
+		return
+	}
+	for _, id := range m.Path {
+		if id == r.holder {
+			return // pointers form a loop. token is in flight or lost
+		}
+	}
+	r.send(message{SenderID: r.id, ReceiverID: r.holder, Message: MessageProbe, Path: append(m.Path, r.id)})
+}
+
+// onAlive passes the answer to a probe back along its path
+func (r *Node) onAlive(m message) {
+	if m.Epoch != r.epoch || len(m.Path) == 0 || m.Path[len(m.Path)-1] != r.id {
+		return
+	}
+	path := m.Path[:len(m.Path)-1]
+	if len(path) == 0 {
+		r.probeAcked = true
+		return
+	}
+	r.send(message{SenderID: r.id, ReceiverID: path[len(path)-1], Message: MessageAlive, Path: path})
+}
+
+// startElection makes this node a candidate for the next epoch
+func (r *Node) startElection() {
+	epoch := r.epoch + 1
+	if r.election != nil && r.election.epoch >= epoch {
+		epoch = r.election.epoch + 1
+	}
+	r.log.Println("🗳 starting election for epoch ", epoch)
+	r.join(epoch, r.id, noHolder)
+}
+
+// join enters the election of candidate and passes it on to the rest of the tree
+func (r *Node) join(epoch uint64, candidate int, parent int) {
+	r.epoch = epoch
+	r.election = &election{epoch: epoch, candidate: candidate, parent: parent, pending: map[int]bool{}, fence: r.fence}
+	r.holder = noHolder
+	r.asked = false
+	r.requestQueue = NewQueue()
+	r.watchSeq++
+	for _, id := range r.neighbours {
+		if id != parent {
+			r.election.pending[id] = true
+			r.send(message{SenderID: r.id, ReceiverID: id, Message: MessageElection, Candidate: candidate})
+		}
+	}
+	r.maybeFinishElection()
+}
+
+func (r *Node) onElection(m message) {
+	if r.election != nil && !r.election.better(m.Epoch, m.Candidate) {
+		return
+	}
+	if r.election == nil && m.Epoch <= r.epoch {
+		return
+	}
+	r.log.Printf("🗳 joining election of %d for epoch %d", m.Candidate, m.Epoch)
+	r.join(m.Epoch, m.Candidate, m.SenderID)
+}
+
+func (r *Node) onElected(m message) {
+	el := r.election
+	if el == nil || el.epoch != m.Epoch || el.candidate != m.Candidate {
+		return
+	}
+	delete(el.pending, m.SenderID)
+	if m.Fence > el.fence {
+		el.fence = m.Fence
+	}
+	r.maybeFinishElection()
+}
+
+// maybeFinishElection answers the parent once the whole subtree has answered
+// and this node is out of CS. The candidate wins at that point.
+func (r *Node) maybeFinishElection() {
+	el := r.election
+	if el == nil || el.answered || len(el.pending) > 0 || r.using {
+		return
+	}
+	el.answered = true
+	if el.parent != noHolder {
+		r.send(message{SenderID: r.id, ReceiverID: el.parent, Message: MessageElected, Candidate: el.candidate, Fence: el.fence})
+		return
+	}
+
+	r.log.Println("👑 won election. regenerating token for epoch ", el.epoch)
+	r.election = nil
+	r.holder = r.id
+	if el.fence > r.fence {
+		r.fence = el.fence
+	}
+	for _, id := range r.neighbours {
+		r.send(message{SenderID: r.id, ReceiverID: id, Message: MessageCoordinator})
+	}
+	r.resume()
+}
+
+// onCoordinator points holder at the new token and passes it on
+func (r *Node) onCoordinator(m message) {
+	if r.election == nil || r.election.epoch != m.Epoch {
+		return
+	}
+	r.election = nil
+	r.holder = m.SenderID
+	for _, id := range r.neighbours {
+		if id != m.SenderID {
+			r.send(message{SenderID: r.id, ReceiverID: id, Message: MessageCoordinator})
+		}
+	}
+	r.resume()
+}
+
+// resume asks for the new token again if this node or a neighbour still
+// waits for it
+func (r *Node) resume() {
+	if r.requesting && !r.using {
+		r.requestQueue.Remove(r.id)
+		r.askToEnterCS()
+		return
+	}
+	if r.holder == r.id {
+		r.assignPrivilege()
+	} else {
+		r.makeRequest()
+	}
+}
+
+// tellDegree tells neighbours how many neighbours this node has. expects
+// r.mutex to be held
+func (r *Node) tellDegree() {
+	for _, id := range r.neighbours {
+		if err := r.send(message{SenderID: r.id, ReceiverID: id, Message: MessageDegree, Degree: len(r.neighbours)}); err != nil {
+			r.log.Println("❗️", err)
+		}
+	}
+}
+
+// RemovePeer excludes a dead neighbour, as told by a failure detector or an
+// admin. If the token was beyond it, a new one is elected. A neighbour which
+// has other neighbours, or never told how many, is not removed: the tree
+// would split.
+func (r *Node) RemovePeer(id int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.isNeighbour(id) && r.degrees[id] != 1 {
+		r.log.Printf("❗️ not removing %d. it has %d neighbours, the tree would split", id, r.degrees[id])
+		return
+	}
+	neighbours := make([]int, 0, len(r.neighbours))
+	for _, n := range r.neighbours {
+		if n != id {
+			neighbours = append(neighbours, n)
+		}
+	}
+	if len(neighbours) == len(r.neighbours) {
+		return
+	}
+	r.log.Println("💀 removing peer ", id)
+	r.neighbours = neighbours
+	delete(r.degrees, id)
+	r.requestQueue.Remove(id)
+	r.tellDegree()
+
+	if el := r.election; el != nil {
+		if el.parent == id {
+			r.startElection()
+			return
+		}
+		delete(el.pending, id)
+		r.maybeFinishElection()
+		return
+	}
+	if r.holder == id {
+		r.startElection()
+		return
+	}
+	if r.holder == r.id {
+		r.assignPrivilege()
+	}
+}
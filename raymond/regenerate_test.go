@@ -0,0 +1,166 @@
+package raymond
+
+import (
+	"context"
+	"distributed-lock-example/transport"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// faults drops messages between the nodes of a test
+type faults struct {
+	mutex *sync.Mutex
+	dead  map[int]bool
+	drop  func(m message) bool // drops messages it returns true for, if set
+}
+
+// faultyTransport is the transport of one node, subject to faults
+type faultyTransport struct {
+	transport.Transport
+	id     int
+	faults *faults
+}
+
+func (f *faultyTransport) Send(nodeID int, b []byte) error {
+	var m message
+	json.Unmarshal(b, &m)
+	f.faults.mutex.Lock()
+	defer f.faults.mutex.Unlock()
+	if f.faults.dead[f.id] || f.faults.dead[nodeID] || f.faults.drop != nil && f.faults.drop(m) {
+		return nil
+	}
+	return f.Transport.Send(nodeID, b)
+}
+
+// withFaults puts the transports of nodes, not started yet, behind faults
+func withFaults(nodes []*Node) *faults {
+	fs := &faults{mutex: &sync.Mutex{}, dead: map[int]bool{}}
+	for _, n := range nodes {
+		n.transport = &faultyTransport{Transport: n.transport, id: n.id, faults: fs}
+	}
+	return fs
+}
+
+// kill cuts node id off. It keeps running, but nothing it sends or is sent
+// arrives.
+func (fs *faults) kill(id int) {
+	fs.mutex.Lock()
+	fs.dead[id] = true
+	fs.mutex.Unlock()
+}
+
+// fastProbes makes a lost token noticed within tens of milliseconds
+func fastProbes(t *testing.T) {
+	timeout := TokenTimeout
+	TokenTimeout = 20 * time.Millisecond
+	t.Cleanup(func() { TokenTimeout = timeout })
+}
+
+func degree(n *Node, of int) int {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.degrees[of]
+}
+
+func TestLostPrivilegeIsRegenerated(t *testing.T) {
+	fastProbes(t)
+	nodes, _ := newTree(t, []int{-1, 0, 0})
+	fs := withFaults(nodes)
+	dropped := 0
+	fs.drop = func(m message) bool {
+		if m.Message == MessagePrivilege && dropped == 0 {
+			dropped++
+			return true
+		}
+		return false
+	}
+	start(nodes...)
+
+	errCh := acquireAsync(context.Background(), nodes[1])
+	waitAcquired(t, nodes[1], errCh)
+	fs.mutex.Lock()
+	lost := dropped
+	fs.mutex.Unlock()
+	if lost != 1 || nodes[1].Status().Epoch == 0 {
+		t.Fatalf("node got in with %d privileges dropped, at epoch %d", lost, nodes[1].Status().Epoch)
+	}
+
+	// the new token moves on as usual
+	errCh = acquireAsync(context.Background(), nodes[2])
+	eventually(t, "request of 2 never reached 1", func() bool { return contains(nodes[1].Status().Queue, 0) })
+	if err := nodes[1].Release(); err != nil {
+		t.Fatal(err)
+	}
+	waitAcquired(t, nodes[2], errCh)
+	if h := holders(nodes); fmt.Sprint(h) != "[2]" {
+		t.Fatalf("token is at %v", h)
+	}
+	epoch := nodes[0].Status().Epoch
+	for _, n := range nodes {
+		if s := n.Status(); s.Epoch != epoch {
+			t.Fatalf("node %d is at epoch %d, node 0 at %d", s.ID, s.Epoch, epoch)
+		}
+	}
+}
+
+// Node 2, a leaf, dies with the token. Node 0 removes it and the token is
+// elected again.
+func TestDeadHolderIsRemoved(t *testing.T) {
+	fastProbes(t)
+	nodes, _ := newTree(t, []int{-1, 0, 0})
+	fs := withFaults(nodes)
+	start(nodes...)
+	if err := nodes[2].Acquire(context.Background(), ""); err != nil {
+		t.Fatal(err)
+	}
+	nodes[2].Release()
+	eventually(t, "node 0 never learnt that 2 is a leaf", func() bool { return degree(nodes[0], 2) == 1 })
+
+	fs.kill(2)
+	errCh := acquireAsync(context.Background(), nodes[1])
+	eventually(t, "request of 1 never forwarded to 2", func() bool { return nodes[0].Status().Asked })
+	nodes[0].RemovePeer(2)
+	waitAcquired(t, nodes[1], errCh)
+	if h := holders(nodes[:2]); fmt.Sprint(h) != "[1]" {
+		t.Fatalf("token is at %v", h)
+	}
+	if s := nodes[0].Status(); fmt.Sprint(s.Neighbours) != "[1]" {
+		t.Fatalf("neighbours of 0: %v", s.Neighbours)
+	}
+
+	// the new token moves on as usual
+	errCh = acquireAsync(context.Background(), nodes[0])
+	nodes[1].Release()
+	waitAcquired(t, nodes[0], errCh)
+	if h := holders(nodes[:2]); fmt.Sprint(h) != "[0]" {
+		t.Fatalf("token is at %v", h)
+	}
+}
+
+func TestRemovalWhichSplitsTreeIsRefused(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		parents []int
+		started int // nodes started
+	}{
+		{"neighbour has neighbours", []int{-1, 0, 1}, 3},
+		{"neighbour never told", []int{-1, 0}, 1},
+	} {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			noProbes(t)
+			nodes, _ := newTree(t, c.parents)
+			start(nodes[:c.started]...)
+			if c.started > 1 {
+				eventually(t, "node 0 never learnt the neighbours of 1", func() bool { return degree(nodes[0], 1) == 2 })
+			}
+			nodes[0].RemovePeer(1)
+			if s := nodes[0].Status(); fmt.Sprint(s.Neighbours) != "[1]" || s.Epoch != 0 || s.Holder != 0 {
+				t.Fatalf("node 0 after RemovePeer: %+v", s)
+			}
+		})
+	}
+}
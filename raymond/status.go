@@ -0,0 +1,23 @@
+package raymond
+
+// Status is a snapshot of node's state
+type Status struct {
+	ID         int    `json:"id"`
+	Holder     int    `json:"holder"` // own id if this node has the token, else neighbour towards it. -1 during election
+	Queue      []int  `json:"queue"`  // ids of neighbours which asked for the token, or own id
+	Asked      bool   `json:"asked"`
+	InCS       bool   `json:"inCS"`
+	Epoch      uint64 `json:"epoch"`
+	Neighbours []int  `json:"neighbours"`
+}
+
+func (r *Node) Status() Status {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	s := Status{ID: r.id, Holder: r.holder, Queue: []int{}, Asked: r.asked, InCS: r.using, Epoch: r.epoch,
+		Neighbours: append([]int{}, r.neighbours...)}
+	for _, v := range r.requestQueue.Values() {
+		s.Queue = append(s.Queue, v.(int))
+	}
+	return s
+}
@@ -1,14 +1,21 @@
 package main
 
 import (
+	"distributed-lock-example/checker"
 	"distributed-lock-example/lamport"
+	"distributed-lock-example/maekawa"
 	raymod "distributed-lock-example/raymond"
+	ricart_agrawala "distributed-lock-example/ricart-agrawala"
+	"distributed-lock-example/simulator"
+	suzuki_kasami "distributed-lock-example/suzuki-kasami"
+	"distributed-lock-example/transport"
 	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"math/rand"
-	"net"
+	"os"
 	"sort"
 	"strconv"
 	"sync"
@@ -94,11 +101,21 @@ type Algorithm interface {
 
 var _ Algorithm = &raymod.Node{}
 var _ Algorithm = &lamport.Node{}
+var _ Algorithm = &ricart_agrawala.Node{}
+var _ Algorithm = &suzuki_kasami.Node{}
+var _ Algorithm = &maekawa.Node{}
+
+var _ simulator.Algorithm = &raymod.Node{}
+var _ simulator.Algorithm = &lamport.Node{}
+var _ simulator.Algorithm = &ricart_agrawala.Node{}
+var _ simulator.Algorithm = &suzuki_kasami.Node{}
+var _ simulator.Algorithm = &maekawa.Node{}
 
 type TestNode struct {
 	numOfMessages int
 	Algorithm
-	endedCh chan struct{}
+	endedCh   chan struct{}
+	transport transport.Transport
 }
 
 func (n *TestNode) ProcessMessageDebug(b []byte) {
@@ -107,55 +124,65 @@ func (n *TestNode) ProcessMessageDebug(b []byte) {
 }
 
 func (t *TestNode) Start() {
-	listenAddr := fmt.Sprintf(":%d", 7000+t.ID())
-
-	s, err := net.ResolveUDPAddr("udp4", listenAddr)
-	if err != nil {
-		log.Fatalln(err)
-	}
-
-	conn, err := net.ListenUDP("udp4", s)
-	if err != nil {
-		log.Fatalln(err)
-	}
-	defer conn.Close()
-
 	go func() {
 		<-t.endedCh
-		conn.Close()
+		t.transport.Close()
 	}()
 
-	for {
-		buffer := make([]byte, 1024)
-		n, _, err := conn.ReadFromUDP(buffer)
-		if err != nil {
-			log.Println("failed to read from udp: ", err)
-			break
-		}
-		b := buffer[0 : n-1]
+	for b := range t.transport.Receive() {
 		log.Println(fmt.Sprintf("[%d]", t.ID()), "<<- ", string(b))
-		go t.ProcessMessageDebug(b)
+		t.ProcessMessageDebug(b)
 	}
 }
 
-func NewLamportNode(id int, neighbourIDs []int) *TestNode {
-	var neighbours map[int]string
+func newTransport(id int, neighbourIDs []int) transport.Transport {
+	neighbours := map[int]string{}
 	for _, id := range neighbourIDs {
 		neighbours[id] = fmt.Sprintf(":%d", 7000+id)
 	}
-	ln := lamport.NewNode(id, fmt.Sprintf(":%d", 7000+id), neighbours)
-	return &TestNode{0, ln, make(chan struct{}, 1)}
+	t, err := transport.NewUDP(fmt.Sprintf(":%d", 7000+id), neighbours)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return t
+}
+
+func NewLamportNode(id int, neighbourIDs []int) *TestNode {
+	t := newTransport(id, neighbourIDs)
+	ln := lamport.NewNode(id, neighbourIDs, t)
+	return &TestNode{0, ln, make(chan struct{}, 1), t}
 }
 
 func NewRaymondNode(id int, neighbourIDs []int, holderID int) *TestNode {
-	var neighbours map[int]string
-	for _, id := range neighbourIDs {
-		neighbours[id] = fmt.Sprintf(":%d", 7000+id)
-	}
-	rn := raymod.NewNode(id, fmt.Sprintf(":%d", 7000+id), neighbours, holderID)
-	return &TestNode{0, rn, make(chan struct{}, 1)}
+	t := newTransport(id, neighbourIDs)
+	rn := raymod.NewNode(id, neighbourIDs, holderID, t)
+	return &TestNode{0, rn, make(chan struct{}, 1), t}
+}
+
+func NewRicartAgrawalaNode(id int, neighbourIDs []int) *TestNode {
+	t := newTransport(id, neighbourIDs)
+	rn := ricart_agrawala.NewNode(id, neighbourIDs, t)
+	return &TestNode{0, rn, make(chan struct{}, 1), t}
+}
+
+func NewSuzukiKasamiNode(id int, neighbourIDs []int, holderID int) *TestNode {
+	t := newTransport(id, neighbourIDs)
+	sn := suzuki_kasami.NewNode(id, neighbourIDs, holderID, t)
+	return &TestNode{0, sn, make(chan struct{}, 1), t}
 }
 
+func NewMaekawaNode(id int, neighbourIDs []int) *TestNode {
+	t := newTransport(id, neighbourIDs)
+	mn := maekawa.NewNode(id, neighbourIDs, t)
+	return &TestNode{0, mn, make(chan struct{}, 1), t}
+}
+
+// every node enters CS iterations times. it thinks before asking and stays in
+// CS for csTime
+var iterations = 15
+var thinkTime = 1200 * time.Millisecond
+var csTime = 700 * time.Millisecond
+
 type resultT struct {
 	avgNumOfMessages int
 	avgCSWaitTime    float64 // in seconds
@@ -174,6 +201,12 @@ func Init(algo string, id int, numOfNodes int, neighbourIDs []int, holderID int)
 		node = NewRaymondNode(id, neighbourIDs, holderID)
 	case "lamport":
 		node = NewLamportNode(id, neighbourIDs)
+	case "ricart-agrawala":
+		node = NewRicartAgrawalaNode(id, neighbourIDs)
+	case "suzuki-kasami":
+		node = NewSuzukiKasamiNode(id, neighbourIDs, holderID)
+	case "maekawa":
+		node = NewMaekawaNode(id, neighbourIDs)
 	default:
 		return nil, errors.New("unknown algorithm specified")
 	}
@@ -185,16 +218,15 @@ func Init(algo string, id int, numOfNodes int, neighbourIDs []int, holderID int)
 
 	timeTakens := []float64{}
 	csWaitTimes := []float64{}
-	iterations := 15
 	for i := 0; i < iterations; i++ {
-		time.Sleep(1200 * time.Millisecond)
+		time.Sleep(thinkTime)
 		node.AskToEnterCS("")
 		waitStartTime := time.Now()
 		node.WaitForCS()
 		// result.avgCSWaitTime += float64(time.Now().Sub(waitStartTime)) / float64(iterations)
 		csWaitTimes = append(csWaitTimes, float64(time.Now().Sub(waitStartTime))/float64(iterations))
 		node.EnterCS()
-		time.Sleep(700 * time.Millisecond)
+		time.Sleep(csTime)
 		node.ExitCS()
 		timeTakens = append(timeTakens, float64(time.Now().Sub(waitStartTime)))
 	}
@@ -210,183 +242,207 @@ func Init(algo string, id int, numOfNodes int, neighbourIDs []int, holderID int)
 	return &result, nil
 }
 
+// Simulate runs numOfNodes nodes the way Init does, but over a simulated network
+// in virtual time. it takes seconds instead of minutes and same seed gives same
+// result.
+func Simulate(algo string, numOfNodes int, tree bool, seed int64) (*resultT, error) {
+	s := simulator.New(simulator.Config{
+		Seed:       seed,
+		Latency:    simulator.Uniform(100*time.Microsecond, time.Millisecond), // like UDP on localhost
+		Think:      simulator.Constant(thinkTime),
+		Hold:       simulator.Constant(csTime),
+		Iterations: iterations,
+	})
+	parentchild := getParentChildRelations(numOfNodes)
+	for id := 0; id < numOfNodes; id++ {
+		neighbourIDs, holderID := neighbours(id, numOfNodes, tree, parentchild)
+		t := s.Transport(id)
+		switch algo {
+		case "raymond":
+			s.Add(raymod.NewNode(id, neighbourIDs, holderID, t))
+		case "lamport":
+			s.Add(lamport.NewNode(id, neighbourIDs, t))
+		case "ricart-agrawala":
+			s.Add(ricart_agrawala.NewNode(id, neighbourIDs, t))
+		case "suzuki-kasami":
+			s.Add(suzuki_kasami.NewNode(id, neighbourIDs, holderID, t))
+		case "maekawa":
+			s.Add(maekawa.NewNode(id, neighbourIDs, t))
+		default:
+			return nil, errors.New("unknown algorithm specified")
+		}
+	}
+
+	c := checker.New(checker.Config{Ordered: algo == "lamport" || algo == "ricart-agrawala"})
+	s.Observe(c.Observe)
+
+	// algorithms log every message, which takes longer than simulating them
+	log.SetOutput(ioutil.Discard)
+	r, err := s.Run()
+	log.SetOutput(os.Stderr)
+	if err == nil {
+		err = c.Err()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s with %d nodes: %w", algo, numOfNodes, err)
+	}
+
+	result := resultT{}
+	for _, n := range r.Nodes {
+		timeTakens := []float64{}
+		csWaitTimes := []float64{}
+		for _, wait := range n.Waits {
+			csWaitTimes = append(csWaitTimes, float64(wait)/float64(iterations))
+			timeTakens = append(timeTakens, float64(wait+csTime))
+		}
+		result.avgCSWaitTime += calcMedian(csWaitTimes...) / float64(time.Second)
+		result.avgThroughput += calcMedian(timeTakens...) / float64(time.Second)
+		result.avgNumOfMessages += n.Received / iterations
+	}
+	return &result, nil
+}
+
+// neighbours returns neighbours and initial holder of node id. in a tree nodes
+// only know parent and children, otherwise they know everyone.
+func neighbours(id int, numOfNodes int, tree bool, parentchild map[int][]int) ([]int, int) {
+	neighbourIDs := []int{}
+	holderID := 0
+	if tree {
+		if id != 0 {
+			holderID = (id - 1) / 2
+			neighbourIDs = append(neighbourIDs, parentchild[id]...)
+			neighbourIDs = append(neighbourIDs, holderID) // holder is also a neighbour
+		}
+	} else {
+		for j := 0; j < numOfNodes; j++ {
+			if j != id {
+				neighbourIDs = append(neighbourIDs, j)
+			}
+		}
+	}
+	return neighbourIDs, holderID
+}
+
+// algorithms are benchmarked in this order. name is used in table and graphs
+var algorithms = []struct {
+	algo string
+	name string
+	tree bool // nodes only know parent and children. parent is holder initially
+}{
+	{"lamport", "Lamport", false},
+	{"raymond", "Raymond", true},
+	{"ricart-agrawala", "Ricart-Agrawala", false},
+	{"suzuki-kasami", "Suzuki-Kasami", false},
+	{"maekawa", "Maekawa", false},
+}
+
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
 	var id int
 	var numOfNodes int
+	var simulate bool
+	var seed int64
 
 	flag.IntVar(&id, "id", -1, "id of node")
 	flag.IntVar(&numOfNodes, "num-of-nodes", 0, "number of nodes in mesh")
+	flag.BoolVar(&simulate, "simulate", false, "run nodes over a simulated network in virtual time instead of UDP")
+	flag.Int64Var(&seed, "seed", 1, "seed of simulated network, same seed gives same results")
 	flag.Parse()
 
 	rand.Seed(time.Now().UnixNano() + int64(id))
+	if simulate {
+		raymod.TokenTimeout = 0 // its wall clock timer would make runs differ
+	}
 
 	nodes := []int{3, 6, 9, 12}
 	// nodes := []int{5, 10, 15, 20, 25, 30, 35}
 
-	result := map[int]*resultT{}
-	for _, numOfNodes := range nodes {
-		var wg sync.WaitGroup
-		res := resultT{}
-		for i := 0; i < numOfNodes; i++ {
-			wg.Add(1)
-			go func(id int, res *resultT, wg *sync.WaitGroup) {
-				defer wg.Done()
-
-				neighbourIDs := []int{}
-				for i := 0; i < numOfNodes; i++ {
-					if i != id {
-						neighbourIDs = append(neighbourIDs, i)
-					}
-				}
-
-				// incase of lamport, holderID is ignored
-				r, err := Init("lamport", id, numOfNodes, neighbourIDs, 0)
+	results := map[string]map[int]*resultT{}
+	for _, a := range algorithms {
+		results[a.algo] = map[int]*resultT{}
+		for _, numOfNodes := range nodes {
+			if simulate {
+				res, err := Simulate(a.algo, numOfNodes, a.tree, seed)
 				if err != nil {
 					log.Fatalln(err)
-
 				}
-
-				res.avgCSWaitTime += r.avgCSWaitTime
-				res.avgNumOfMessages += r.avgNumOfMessages
-				res.avgThroughput += r.avgThroughput
-			}(i, &res, &wg)
-		}
-		result[numOfNodes] = &res
-		wg.Wait()
-	}
-
-	result2 := map[int]*resultT{}
-	for _, numOfNodes := range nodes {
-		parentchild := getParentChildRelations(numOfNodes)
-		var wg sync.WaitGroup
-		res := resultT{}
-		for i := 0; i < numOfNodes; i++ {
-			neighourIDs := []int{}
-			holderID := 0
-			if i != 0 {
-				holderID = (i - 1) / 2
-				neighourIDs = append(neighourIDs, parentchild[i]...)
-				neighourIDs = append(neighourIDs, holderID) // holder is also a neighbour
+				results[a.algo][numOfNodes] = res
+				continue
 			}
-			wg.Add(1)
-			go func(id int, neighourIDs []int, holderID int, res *resultT, wg *sync.WaitGroup) {
-				defer wg.Done()
 
-				r, err := Init("raymond", id, numOfNodes, neighourIDs, holderID)
-				if err != nil {
-					log.Fatalln(err)
+			parentchild := getParentChildRelations(numOfNodes)
+			var wg sync.WaitGroup
+			res := resultT{}
+			for i := 0; i < numOfNodes; i++ {
+				neighbourIDs, holderID := neighbours(i, numOfNodes, a.tree, parentchild)
+				wg.Add(1)
+				go func(algo string, id int, neighbourIDs []int, holderID int, res *resultT, wg *sync.WaitGroup) {
+					defer wg.Done()
 
-				}
+					// holderID is ignored by algorithms which don't use token
+					r, err := Init(algo, id, numOfNodes, neighbourIDs, holderID)
+					if err != nil {
+						log.Fatalln(err)
+
+					}
 
-				res.avgCSWaitTime += r.avgCSWaitTime
-				res.avgNumOfMessages += r.avgNumOfMessages
-				res.avgThroughput += r.avgThroughput
-			}(i, neighourIDs, holderID, &res, &wg)
+					res.avgCSWaitTime += r.avgCSWaitTime
+					res.avgNumOfMessages += r.avgNumOfMessages
+					res.avgThroughput += r.avgThroughput
+				}(a.algo, i, neighbourIDs, holderID, &res, &wg)
+			}
+			results[a.algo][numOfNodes] = &res
+			wg.Wait()
 		}
-		result2[numOfNodes] = &res
-		wg.Wait()
 	}
 
 	log.Printf("Algo\t|Nodes\t|Messages (avg)\t|CS waiting time (median) (sec)\t|Time taken to complete CS (median) (sec)\n")
 	log.Println("-----|-------|--------------------|---------------|------------")
-	for _, numOfNodes := range nodes {
-		log.Printf("%s\t\t|%d\t\t|%d\t\t|%.2f\t\t|%.2f", "Lamport", numOfNodes, result[numOfNodes].avgNumOfMessages, result[numOfNodes].avgCSWaitTime, result[numOfNodes].avgThroughput)
-	}
-	for _, numOfNodes := range nodes {
-		log.Printf("%s\t\t|%d\t\t|%d\t\t|%.2f\t\t|%.2f", "Raymond", numOfNodes, result2[numOfNodes].avgNumOfMessages, result2[numOfNodes].avgCSWaitTime, result2[numOfNodes].avgThroughput)
+	for _, a := range algorithms {
+		for _, numOfNodes := range nodes {
+			r := results[a.algo][numOfNodes]
+			log.Printf("%s\t\t|%d\t\t|%d\t\t|%.2f\t\t|%.2f", a.name, numOfNodes, r.avgNumOfMessages, r.avgCSWaitTime, r.avgThroughput)
+		}
 	}
 
-	lamportResult := make(plotter.XYs, len(result))
-	raymondResult := make(plotter.XYs, len(result2))
-	for i, numOfNodes := range nodes {
-		lamportResult[i].X = float64(numOfNodes)
-		lamportResult[i].Y = float64(result[numOfNodes].avgNumOfMessages)
-
-		raymondResult[i].X = float64(numOfNodes)
-		raymondResult[i].Y = float64(result2[numOfNodes].avgNumOfMessages)
-	}
+	savePlot(results, nodes, "(num of msgs / num of nodes) vs num of nodes", "num of msgs ÷ num of nodes", "report/messages.png",
+		func(r *resultT) float64 { return float64(r.avgNumOfMessages) })
+	savePlot(results, nodes, "CS wait time vs num of nodes", "CS wait time (ms)", "report/response_time.png",
+		func(r *resultT) float64 { return r.avgCSWaitTime })
+	savePlot(results, nodes, "Throughput vs num of nodes", "throughput (num of CS enters per sec)", "report/throughput.png",
+		func(r *resultT) float64 { return r.avgThroughput })
+}
 
+// savePlot draws one line per algorithm with num of nodes on X axis and value(result) on Y axis
+func savePlot(results map[string]map[int]*resultT, nodes []int, title string, yLabel string, filename string, value func(r *resultT) float64) {
 	p, err := plot.New()
 	if err != nil {
 		panic(err)
 	}
 
-	p.Title.Text = "(num of msgs / num of nodes) vs num of nodes"
-	p.Y.Label.Text = "num of msgs ÷ num of nodes"
+	p.Title.Text = title
+	p.Y.Label.Text = yLabel
 	p.X.Label.Text = "num of nodes"
 
 	p.X.Tick.Marker = MyTicks{ticksAt: nodes}
 
-	err = plotutil.AddLinePoints(p, "Lamport", lamportResult, "Raymond", raymondResult)
-	if err != nil {
-		panic(err)
-	}
-
-	// Save the plot to a PNG file.
-	if err := p.Save(6*vg.Inch, 4*vg.Inch, "report/messages.png"); err != nil {
-		panic(err)
-	}
-
-	lamportResponseTimeResult := make(plotter.XYs, len(result))
-	raymondResponseTimeResult := make(plotter.XYs, len(result2))
-	for i, numOfNodes := range nodes {
-		lamportResponseTimeResult[i].X = float64(numOfNodes)
-		lamportResponseTimeResult[i].Y = float64(result[numOfNodes].avgCSWaitTime)
-
-		raymondResponseTimeResult[i].X = float64(numOfNodes)
-		raymondResponseTimeResult[i].Y = float64(result2[numOfNodes].avgCSWaitTime)
-	}
-
-	pp, err := plot.New()
-	if err != nil {
-		panic(err)
-	}
-
-	pp.Title.Text = "CS wait time vs num of nodes"
-	pp.Y.Label.Text = "CS wait time (ms)"
-	pp.X.Label.Text = "num of nodes"
-
-	pp.X.Tick.Marker = MyTicks{ticksAt: nodes}
-
-	err = plotutil.AddLinePoints(pp, "Lamport", lamportResponseTimeResult, "Raymond", raymondResponseTimeResult)
-	if err != nil {
-		panic(err)
-	}
-
-	// Save the plot to a PNG file.
-	if err := pp.Save(6*vg.Inch, 4*vg.Inch, "report/response_time.png"); err != nil {
-		panic(err)
-	}
-
-	lamportThroughputResult := make(plotter.XYs, len(result))
-	raymondthroughputResult := make(plotter.XYs, len(result2))
-	for i, numOfNodes := range nodes {
-		lamportThroughputResult[i].X = float64(numOfNodes)
-		lamportThroughputResult[i].Y = result[numOfNodes].avgThroughput
-
-		raymondthroughputResult[i].X = float64(numOfNodes)
-		raymondthroughputResult[i].Y = result2[numOfNodes].avgThroughput
-	}
-
-	ppp, err := plot.New()
-	if err != nil {
-		panic(err)
+	lines := []interface{}{}
+	for _, a := range algorithms {
+		xys := make(plotter.XYs, len(nodes))
+		for i, numOfNodes := range nodes {
+			xys[i].X = float64(numOfNodes)
+			xys[i].Y = value(results[a.algo][numOfNodes])
+		}
+		lines = append(lines, a.name, xys)
 	}
 
-	ppp.Title.Text = "Throughput vs num of nodes"
-	ppp.Y.Label.Text = "throughput (num of CS enters per sec)"
-	ppp.X.Label.Text = "num of nodes"
-
-	ppp.X.Tick.Marker = MyTicks{ticksAt: nodes}
-
-	err = plotutil.AddLinePoints(ppp, "Lamport", lamportThroughputResult, "Raymond", raymondthroughputResult)
+	err = plotutil.AddLinePoints(p, lines...)
 	if err != nil {
 		panic(err)
 	}
 
 	// Save the plot to a PNG file.
-	if err := ppp.Save(6*vg.Inch, 4*vg.Inch, "report/throughput.png"); err != nil {
+	if err := p.Save(6*vg.Inch, 4*vg.Inch, filename); err != nil {
 		panic(err)
 	}
 }
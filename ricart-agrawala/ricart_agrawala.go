@@ -0,0 +1,177 @@
+package ricartagrawala
+
+import (
+	"distributed-lock-example/lamport"
+	"distributed-lock-example/logger"
+	"distributed-lock-example/transport"
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+var MessageRequest string = "request"
+var MessageReply string = "reply"
+
+type message struct {
+	SenderID   int    `json:"senderId"`
+	ReceiverID int    `json:"receiverId"`
+	Message    string `json:"message"`
+	Time       uint   `json:"time"`
+}
+
+// Node implements Ricart-Agrawala algorithm. Unlike lamport, there is no release
+// message. A node defers its reply to every request which has lower priority
+// than its own, and sends deferred replies when it exits CS. That takes
+// 2(N-1) messages per CS instead of 3(N-1).
+type Node struct {
+	id          int
+	clock       *lamport.Clock
+	requesting  bool
+	requestTime uint
+	inCS        bool
+	replies     int
+	defered     []int
+	waitCh      chan struct{}
+	neighbours  []int
+	log         *logger.Logger
+	lock        *sync.Mutex
+	transport   transport.Transport
+}
+
+func NewNode(id int, neighbourIDs []int, t transport.Transport) *Node {
+	return &Node{id: id,
+		clock:      &lamport.Clock{},
+		waitCh:     make(chan struct{}, 1),
+		neighbours: neighbourIDs,
+		log:        &logger.Logger{Prefix: fmt.Sprintf("[%d]", id)},
+		lock:       &sync.Mutex{},
+		transport:  t,
+	}
+}
+
+func (r *Node) ID() int {
+	return r.id
+}
+
+func (r *Node) send(m message) {
+	b, _ := json.Marshal(m)
+	if err := r.transport.Send(m.ReceiverID, b); err != nil {
+		r.log.Println("❗️ ", err)
+	}
+	r.log.Println("->> ", string(b))
+}
+
+func (r *Node) notify() {
+	select {
+	case r.waitCh <- struct{}{}:
+	default:
+	}
+}
+
+// hasPriority tells whether own pending request goes before request of senderID made at t
+func (r *Node) hasPriority(t uint, senderID int) bool {
+	return r.requestTime < t || (r.requestTime == t && r.id < senderID)
+}
+
+func (r *Node) ProcessMessage(b []byte) {
+	var m message
+	if err := json.Unmarshal(b, &m); err != nil {
+		r.log.Println("❗️", err)
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.clock.Receive(m.Time)
+	switch m.Message {
+	case MessageRequest:
+		if r.inCS || (r.requesting && r.hasPriority(m.Time, m.SenderID)) {
+			r.log.Println("deferring reply to ", m.SenderID)
+			r.defered = append(r.defered, m.SenderID)
+		} else {
+			r.send(message{SenderID: r.id, ReceiverID: m.SenderID, Message: MessageReply, Time: r.clock.Time()})
+		}
+	case MessageReply:
+		r.log.Println("got permission to enter from ", m.SenderID)
+		r.replies++
+		r.notify()
+	}
+}
+
+func (r *Node) InCS() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.inCS
+}
+
+// RequestTime is logical time of current or last request
+func (r *Node) RequestTime() uint {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.requestTime
+}
+
+func (r *Node) EnterCS() {
+	r.log.Println("entering to CS")
+	r.lock.Lock()
+	r.clock.Tick()
+	r.inCS = true
+	r.lock.Unlock()
+}
+
+func (r *Node) ExitCS() {
+	r.log.Println("exiting CS")
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.clock.Tick()
+	r.inCS = false
+	r.requesting = false
+	for _, id := range r.defered {
+		r.send(message{SenderID: r.id, ReceiverID: id, Message: MessageReply, Time: r.clock.Time()})
+	}
+	r.defered = nil
+}
+
+func (r *Node) AskToEnterCS(_ string /* just to satisfy interface */) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.clock.Tick()
+	r.requesting = true
+	r.requestTime = r.clock.Time()
+	r.replies = 0
+	for _, id := range r.neighbours {
+		r.send(message{SenderID: r.id, ReceiverID: id, Message: MessageRequest, Time: r.requestTime})
+	}
+	r.notify()
+}
+
+func (r *Node) WaitForCS() {
+	for {
+		<-r.waitCh
+
+		r.lock.Lock()
+		gotPermission := r.replies == len(r.neighbours)
+		r.lock.Unlock()
+		if gotPermission {
+			break
+		}
+	}
+}
+
+// TryWaitForCS is WaitForCS which doesn't block. It reports whether CS was
+// granted.
+func (r *Node) TryWaitForCS() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.requesting && !r.inCS && r.replies == len(r.neighbours)
+}
+
+// Start handles messages one at a time, in the order the transport delivers them
+func (r *Node) Start() {
+	for b := range r.transport.Receive() {
+		r.log.Println("<<- ", string(b))
+		r.ProcessMessage(b)
+	}
+}
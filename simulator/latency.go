@@ -0,0 +1,47 @@
+package simulator
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Latency draws how long something takes, like a message on a link or a node
+// thinking before it asks for CS. All randomness comes from r, so runs with
+// the same seed draw the same values.
+type Latency func(r *rand.Rand) time.Duration
+
+// Constant always takes d
+func Constant(d time.Duration) Latency {
+	return func(r *rand.Rand) time.Duration {
+		return d
+	}
+}
+
+// Uniform takes anything between min and max with equal probability
+func Uniform(min time.Duration, max time.Duration) Latency {
+	return func(r *rand.Rand) time.Duration {
+		if max <= min {
+			return min
+		}
+		return min + time.Duration(r.Int63n(int64(max-min)+1))
+	}
+}
+
+// Exponential takes at least min, plus an exponentially distributed delay with
+// given mean. It models links which are usually fast but sometimes very slow.
+func Exponential(min time.Duration, mean time.Duration) Latency {
+	return func(r *rand.Rand) time.Duration {
+		return min + time.Duration(r.ExpFloat64()*float64(mean))
+	}
+}
+
+// Normal takes mean give or take stddev. it never takes less than 0.
+func Normal(mean time.Duration, stddev time.Duration) Latency {
+	return func(r *rand.Rand) time.Duration {
+		d := mean + time.Duration(r.NormFloat64()*float64(stddev))
+		if d < 0 {
+			return 0
+		}
+		return d
+	}
+}
@@ -0,0 +1,354 @@
+// Package simulator runs mutual exclusion algorithms over a simulated network
+// in virtual time. Nothing sleeps: the simulator keeps a queue of events
+// ordered by virtual time and handles them one by one, so runs which take
+// minutes on real sockets finish in a fraction of a second.
+//
+// Every random choice, like latency of a message or how long a node stays in
+// CS, is drawn from one generator seeded with Config.Seed, and events at the
+// same virtual time are handled in the order they were scheduled. So a seed
+// replays exactly, as long as algorithms don't start wall clock timers of their
+// own. Turn those off before simulating, e.g. by setting raymond.TokenTimeout
+// to 0 and not using leases.
+package simulator
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Algorithm is what the simulator drives. Nodes are never started, the
+// simulator hands messages to ProcessMessage itself.
+type Algorithm interface {
+	ID() int
+	ProcessMessage(b []byte)
+	AskToEnterCS(CSID string)
+	TryWaitForCS() bool
+	EnterCS()
+	ExitCS()
+}
+
+// Clocked is an algorithm with logical clock. Its events carry logical time of
+// the request.
+type Clocked interface {
+	RequestTime() uint
+}
+
+var ErrDeadlock = errors.New("nodes wait for CS but no message is in flight")
+var ErrDeadline = errors.New("run did not complete before deadline")
+
+// Link is the one way connection from a node to another
+type Link struct {
+	From int
+	To   int
+}
+
+type Config struct {
+	Seed       int64
+	Latency    Latency                    // of messages. defaults to Uniform(1ms, 5ms)
+	Links      map[Link]Latency           // overrides Latency for some links
+	Think      Latency                    // before each request. defaults to Uniform(0, 100ms)
+	Hold       Latency                    // time spent in CS. defaults to Constant(10ms)
+	Iterations int                        // CS entries per node. defaults to 1
+	CSID       func(id int, i int) string // of i-th request of node id. defaults to ""
+	Deadline   time.Duration              // in virtual time. 0 means no deadline
+}
+
+type EventType string
+
+const (
+	EventRequest EventType = "request"
+	EventEnter   EventType = "enter"
+	EventExit    EventType = "exit"
+)
+
+// Event is something a node did, at virtual time Time
+type Event struct {
+	Type        EventType
+	Node        int
+	CSID        string
+	RequestTime uint // logical time of the request, if node is Clocked
+	Time        time.Duration
+}
+
+type NodeResult struct {
+	ID       int
+	Waits    []time.Duration // from asking for CS to entering it, one per iteration
+	Sent     int
+	Received int
+}
+
+type Result struct {
+	Time     time.Duration // when the last node left CS
+	Messages int
+	Nodes    []NodeResult // in id order
+}
+
+type node struct {
+	Algorithm
+	transport *Transport
+	iteration int
+	waiting   bool
+	askedAt   time.Duration
+	csid      string
+	result    NodeResult
+}
+
+// Sim is one simulated run. Create transports of nodes with Transport, add the
+// nodes with Add and call Run.
+type Sim struct {
+	config    Config
+	rand      *rand.Rand
+	now       time.Duration
+	queue     queue
+	seq       int
+	delivered map[Link]time.Duration // last delivery on each link, which keeps links FIFO
+	nodes     map[int]*node
+	observers []func(Event)
+	result    Result
+	lock      *sync.Mutex
+}
+
+func New(config Config) *Sim {
+	if config.Latency == nil {
+		config.Latency = Uniform(time.Millisecond, 5*time.Millisecond)
+	}
+	if config.Think == nil {
+		config.Think = Uniform(0, 100*time.Millisecond)
+	}
+	if config.Hold == nil {
+		config.Hold = Constant(10 * time.Millisecond)
+	}
+	if config.Iterations == 0 {
+		config.Iterations = 1
+	}
+	if config.CSID == nil {
+		config.CSID = func(id int, i int) string { return "" }
+	}
+	return &Sim{
+		config:    config,
+		rand:      rand.New(rand.NewSource(config.Seed)),
+		delivered: map[Link]time.Duration{},
+		nodes:     map[int]*node{},
+		lock:      &sync.Mutex{},
+	}
+}
+
+// Transport returns the simulated transport of node id. Pass it to the
+// constructor of the node, then Add the node.
+func (s *Sim) Transport(id int) *Transport {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	n, ok := s.nodes[id]
+	if !ok {
+		n = &node{transport: newTransport(s, id), result: NodeResult{ID: id}}
+		s.nodes[id] = n
+	}
+	return n.transport
+}
+
+// Add puts a node on the network. Its transport must come from Transport.
+func (s *Sim) Add(a Algorithm) {
+	s.Transport(a.ID())
+	s.lock.Lock()
+	s.nodes[a.ID()].Algorithm = a
+	s.lock.Unlock()
+}
+
+// Observe calls f for every event, in the order they happen
+func (s *Sim) Observe(f func(Event)) {
+	s.observers = append(s.observers, f)
+}
+
+// Now is the current virtual time
+func (s *Sim) Now() time.Duration {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.now
+}
+
+func (s *Sim) send(from int, to int, b []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	n, ok := s.nodes[to]
+	if !ok || n.Algorithm == nil {
+		return fmt.Errorf("unknown peer %d", to)
+	}
+	link := Link{from, to}
+	latency, ok := s.config.Links[link]
+	if !ok {
+		latency = s.config.Latency
+	}
+	at := s.now + latency(s.rand)
+	if at < s.delivered[link] {
+		at = s.delivered[link]
+	}
+	s.delivered[link] = at
+
+	c := make([]byte, len(b))
+	copy(c, b)
+	s.schedule(event{at: at, kind: deliver, node: to, b: c})
+	s.nodes[from].result.Sent++
+	s.result.Messages++
+	return nil
+}
+
+// schedule expects s.lock to be held
+func (s *Sim) schedule(e event) {
+	e.seq = s.seq
+	s.seq++
+	heap.Push(&s.queue, e)
+}
+
+func (s *Sim) after(l Latency, e event) {
+	s.lock.Lock()
+	e.at = s.now + l(s.rand)
+	s.schedule(e)
+	s.lock.Unlock()
+}
+
+func (s *Sim) emit(t EventType, n *node) {
+	e := Event{Type: t, Node: n.ID(), CSID: n.csid, Time: s.now}
+	if c, ok := n.Algorithm.(Clocked); ok {
+		e.RequestTime = c.RequestTime()
+	}
+	for _, f := range s.observers {
+		f(e)
+	}
+}
+
+// Run lets every node enter CS Config.Iterations times and returns once all
+// of them are done and no message is in flight. It returns ErrDeadlock if
+// some node waits for CS forever, and ErrDeadline if the run takes too long.
+// In both cases Result holds what happened so far.
+func (s *Sim) Run() (Result, error) {
+	nodes := s.sorted()
+	for _, n := range nodes {
+		if n.Algorithm == nil {
+			return Result{}, fmt.Errorf("transport of %d was created, but the node was never added", n.transport.id)
+		}
+		s.after(s.config.Think, event{kind: ask, node: n.ID()})
+	}
+
+	var err error
+	for {
+		s.lock.Lock()
+		if s.queue.Len() == 0 {
+			s.lock.Unlock()
+			break
+		}
+		e := heap.Pop(&s.queue).(event)
+		if s.config.Deadline != 0 && e.at > s.config.Deadline {
+			s.lock.Unlock()
+			err = ErrDeadline
+			break
+		}
+		s.now = e.at
+		n := s.nodes[e.node]
+		closed := n.transport.closed
+		s.lock.Unlock()
+		if e.kind == deliver && closed {
+			continue
+		}
+
+		switch e.kind {
+		case deliver:
+			n.result.Received++
+			n.ProcessMessage(e.b)
+		case ask:
+			n.csid = s.config.CSID(n.ID(), n.iteration)
+			n.waiting = true
+			n.askedAt = s.now
+			n.AskToEnterCS(n.csid)
+			s.emit(EventRequest, n)
+		case exit:
+			n.ExitCS()
+			s.emit(EventExit, n)
+			s.result.Time = s.now
+			n.iteration++
+			if n.iteration < s.config.Iterations {
+				s.after(s.config.Think, event{kind: ask, node: n.ID()})
+			}
+		}
+		s.poll(n)
+	}
+
+	if err == nil {
+		for _, n := range nodes {
+			if n.iteration < s.config.Iterations {
+				err = ErrDeadlock
+			}
+		}
+	}
+	for _, n := range nodes {
+		s.result.Nodes = append(s.result.Nodes, n.result)
+	}
+	return s.result, err
+}
+
+// poll lets n into CS if it was granted. only the node an event happened at
+// can be granted CS, so it is the only one to poll.
+func (s *Sim) poll(n *node) {
+	if !n.waiting || !n.TryWaitForCS() {
+		return
+	}
+	n.waiting = false
+	n.result.Waits = append(n.result.Waits, s.now-n.askedAt)
+	n.EnterCS()
+	s.emit(EventEnter, n)
+	s.after(s.config.Hold, event{kind: exit, node: n.ID()})
+}
+
+func (s *Sim) sorted() []*node {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	ids := []int{}
+	for id := range s.nodes {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	nodes := []*node{}
+	for _, id := range ids {
+		nodes = append(nodes, s.nodes[id])
+	}
+	return nodes
+}
+
+type kind int
+
+const (
+	deliver kind = iota
+	ask
+	exit
+)
+
+type event struct {
+	at   time.Duration
+	seq  int // breaks ties of events at same time, in the order they were scheduled
+	kind kind
+	node int
+	b    []byte
+}
+
+// queue is a min heap of events by time
+type queue []event
+
+func (q queue) Len() int { return len(q) }
+func (q queue) Less(i, j int) bool {
+	if q[i].at != q[j].at {
+		return q[i].at < q[j].at
+	}
+	return q[i].seq < q[j].seq
+}
+func (q queue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *queue) Push(x interface{}) { *q = append(*q, x.(event)) }
+func (q *queue) Pop() interface{} {
+	old := *q
+	e := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return e
+}
@@ -0,0 +1,85 @@
+package simulator
+
+import (
+	"distributed-lock-example/lamport"
+	"distributed-lock-example/maekawa"
+	"distributed-lock-example/raymond"
+	ricart_agrawala "distributed-lock-example/ricart-agrawala"
+	suzuki_kasami "distributed-lock-example/suzuki-kasami"
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(ioutil.Discard) // algorithms log every message
+	raymond.TokenTimeout = 0
+	os.Exit(m.Run())
+}
+
+func others(id int, n int) []int {
+	ids := []int{}
+	for i := 0; i < n; i++ {
+		if i != id {
+			ids = append(ids, i)
+		}
+	}
+	return ids
+}
+
+// star returns neighbours of id in a tree around node 0, which holds the token
+func star(id int, n int) []int {
+	if id == 0 {
+		return others(0, n)
+	}
+	return []int{0}
+}
+
+type run struct {
+	events []Event
+	result Result
+}
+
+func simulate(t *testing.T, n int, seed int64, newNode func(id int, t *Transport) Algorithm) run {
+	s := New(Config{Seed: seed, Latency: Exponential(time.Millisecond, 3*time.Millisecond), Iterations: 3})
+	for id := 0; id < n; id++ {
+		s.Add(newNode(id, s.Transport(id)))
+	}
+	r := run{}
+	s.Observe(func(e Event) { r.events = append(r.events, e) })
+	result, err := s.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.result = result
+	return r
+}
+
+func TestSameSeedReplays(t *testing.T) {
+	const n = 4
+	for _, c := range []struct {
+		algorithm string
+		newNode   func(id int, t *Transport) Algorithm
+	}{
+		{"lamport", func(id int, t *Transport) Algorithm { return lamport.NewNode(id, others(id, n), t) }},
+		{"ricart-agrawala", func(id int, t *Transport) Algorithm { return ricart_agrawala.NewNode(id, others(id, n), t) }},
+		{"suzuki-kasami", func(id int, t *Transport) Algorithm { return suzuki_kasami.NewNode(id, others(id, n), 0, t) }},
+		{"maekawa", func(id int, t *Transport) Algorithm { return maekawa.NewNode(id, others(id, n), t) }},
+		{"raymond", func(id int, t *Transport) Algorithm { return raymond.NewNode(id, star(id, n), 0, t) }},
+	} {
+		t.Run(c.algorithm, func(t *testing.T) {
+			first := simulate(t, n, 1, c.newNode)
+			for i := 0; i < 3; i++ {
+				if again := simulate(t, n, 1, c.newNode); !reflect.DeepEqual(first, again) {
+					t.Fatalf("replay %d of seed 1 differs\nfirst: %+v\nagain: %+v", i, first, again)
+				}
+			}
+			if other := simulate(t, n, 2, c.newNode); reflect.DeepEqual(first, other) {
+				t.Fatal("seeds 1 and 2 ran the same")
+			}
+		})
+	}
+}
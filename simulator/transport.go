@@ -0,0 +1,44 @@
+package simulator
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Transport hands messages to the simulator, which delivers them by calling
+// ProcessMessage of the receiver. Receive never yields anything.
+type Transport struct {
+	sim    *Sim
+	id     int
+	recvCh chan []byte
+	closed bool
+	once   *sync.Once
+}
+
+func newTransport(s *Sim, id int) *Transport {
+	return &Transport{sim: s, id: id, recvCh: make(chan []byte), once: &sync.Once{}}
+}
+
+func (t *Transport) Send(nodeID int, b []byte) error {
+	t.sim.lock.Lock()
+	closed := t.closed
+	t.sim.lock.Unlock()
+	if closed {
+		return fmt.Errorf("transport of %d is closed", t.id)
+	}
+	return t.sim.send(t.id, nodeID, b)
+}
+
+func (t *Transport) Receive() <-chan []byte {
+	return t.recvCh
+}
+
+func (t *Transport) Close() error {
+	t.once.Do(func() {
+		t.sim.lock.Lock()
+		t.closed = true
+		t.sim.lock.Unlock()
+		close(t.recvCh)
+	})
+	return nil
+}
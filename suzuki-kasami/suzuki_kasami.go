@@ -0,0 +1,203 @@
+package suzukikasami
+
+import (
+	"distributed-lock-example/logger"
+	"distributed-lock-example/transport"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+var MessageRequest string = "request"
+var MessageToken string = "token"
+
+type token struct {
+	LN    map[int]uint `json:"ln"` // sequence number of last request granted to each node
+	Queue []int        `json:"queue"`
+}
+
+type message struct {
+	SenderID   int    `json:"senderId"`
+	ReceiverID int    `json:"receiverId"`
+	Message    string `json:"message"`
+	Seq        uint   `json:"seq,omitempty"`
+	Token      *token `json:"token,omitempty"`
+}
+
+// Node implements Suzuki-Kasami broadcast algorithm. A request is broadcast to
+// every node, there is no tree to configure. Privilege is a token which
+// remembers the last granted request of every node and carries the queue of
+// nodes waiting for it.
+type Node struct {
+	id         int
+	neighbours []int
+	rn         map[int]uint // highest request number seen from each node
+	token      *token       // nil unless this node holds the token
+	using      bool         // token granted to this node, it is in CS or about to enter
+	inCS       bool
+	waitCh     chan struct{}
+	log        *logger.Logger
+	lock       *sync.Mutex
+	transport  transport.Transport
+}
+
+// NewNode creates a node. node with id == holder starts with the token
+func NewNode(id int, neighbourIDs []int, holder int, t transport.Transport) *Node {
+	n := &Node{id: id,
+		neighbours: neighbourIDs,
+		rn:         map[int]uint{id: 0},
+		waitCh:     make(chan struct{}, 1),
+		log:        &logger.Logger{Prefix: fmt.Sprintf("[%d]", id)},
+		lock:       &sync.Mutex{},
+		transport:  t,
+	}
+	for _, nid := range neighbourIDs {
+		n.rn[nid] = 0
+	}
+	if holder == id {
+		n.token = &token{LN: map[int]uint{}, Queue: []int{}}
+	}
+	return n
+}
+
+func (s *Node) ID() int {
+	return s.id
+}
+
+func (s *Node) send(m message) {
+	b, _ := json.Marshal(m)
+	if err := s.transport.Send(m.ReceiverID, b); err != nil {
+		s.log.Println("❗️ ", err)
+	}
+	s.log.Println("->> ", string(b))
+}
+
+func (s *Node) grant() {
+	s.using = true
+	select {
+	case s.waitCh <- struct{}{}:
+	default:
+	}
+}
+
+// outstanding tells whether node id has a request which token has not served yet
+func (s *Node) outstanding(id int) bool {
+	return s.rn[id] == s.token.LN[id]+1
+}
+
+func (s *Node) sendToken(to int) {
+	s.log.Println("giving token to ", to)
+	t := s.token
+	s.token = nil
+	s.send(message{SenderID: s.id, ReceiverID: to, Message: MessageToken, Token: t})
+}
+
+func (s *Node) ProcessMessage(b []byte) {
+	var m message
+	if err := json.Unmarshal(b, &m); err != nil {
+		s.log.Println("❗️", err)
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	switch m.Message {
+	case MessageRequest:
+		if m.Seq > s.rn[m.SenderID] {
+			s.rn[m.SenderID] = m.Seq
+		}
+		if s.token != nil && !s.using && s.outstanding(m.SenderID) {
+			s.sendToken(m.SenderID)
+		}
+	case MessageToken:
+		s.token = m.Token
+		if s.token.LN == nil {
+			s.token.LN = map[int]uint{}
+		}
+		s.grant()
+	}
+}
+
+func (s *Node) InCS() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.inCS
+}
+
+func (s *Node) EnterCS() {
+	s.log.Println("entering to CS")
+	s.lock.Lock()
+	s.inCS = true
+	s.lock.Unlock()
+}
+
+func (s *Node) ExitCS() {
+	s.log.Println("exiting CS")
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.inCS = false
+	s.using = false
+	s.token.LN[s.id] = s.rn[s.id]
+
+	queued := map[int]bool{}
+	for _, id := range s.token.Queue {
+		queued[id] = true
+	}
+	ids := []int{}
+	for id := range s.rn {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		if id != s.id && !queued[id] && s.outstanding(id) {
+			s.token.Queue = append(s.token.Queue, id)
+		}
+	}
+
+	if len(s.token.Queue) > 0 {
+		next := s.token.Queue[0]
+		s.token.Queue = s.token.Queue[1:]
+		s.sendToken(next)
+	}
+}
+
+func (s *Node) AskToEnterCS(_ string /* just to satisfy interface */) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.rn[s.id]++
+	if s.token != nil {
+		s.log.Println("using token for myself")
+		s.token.LN[s.id] = s.rn[s.id] - 1
+		s.grant()
+		return
+	}
+	for _, id := range s.neighbours {
+		s.send(message{SenderID: s.id, ReceiverID: id, Message: MessageRequest, Seq: s.rn[s.id]})
+	}
+}
+
+func (s *Node) WaitForCS() {
+	<-s.waitCh
+}
+
+// TryWaitForCS is WaitForCS which doesn't block. It reports whether CS was
+// granted.
+func (s *Node) TryWaitForCS() bool {
+	select {
+	case <-s.waitCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// Start handles messages one at a time, in the order the transport delivers them
+func (s *Node) Start() {
+	for b := range s.transport.Receive() {
+		s.log.Println("<<- ", string(b))
+		s.ProcessMessage(b)
+	}
+}
@@ -0,0 +1,80 @@
+package transport
+
+import "sync"
+
+// mailbox is an unbounded queue drained in order onto a channel, so whoever
+// puts messages in never waits for the reader.
+type mailbox struct {
+	lock    *sync.Mutex
+	pending [][]byte
+	notify  chan struct{}
+	recvCh  chan []byte
+	done    chan struct{}
+	closed  bool
+}
+
+func newMailbox() *mailbox {
+	mb := &mailbox{
+		lock:   &sync.Mutex{},
+		notify: make(chan struct{}, 1),
+		recvCh: make(chan []byte),
+		done:   make(chan struct{}),
+	}
+	go mb.pump()
+	return mb
+}
+
+// put returns false if the mailbox is closed
+func (mb *mailbox) put(b []byte) bool {
+	mb.lock.Lock()
+	defer mb.lock.Unlock()
+	if mb.closed {
+		return false
+	}
+	mb.pending = append(mb.pending, b)
+	select {
+	case mb.notify <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+func (mb *mailbox) close() {
+	mb.lock.Lock()
+	defer mb.lock.Unlock()
+	if !mb.closed {
+		mb.closed = true
+		close(mb.done)
+	}
+}
+
+func (mb *mailbox) pump() {
+	defer close(mb.recvCh)
+	for {
+		mb.lock.Lock()
+		if len(mb.pending) == 0 {
+			mb.lock.Unlock()
+			select {
+			case <-mb.notify:
+				continue
+			case <-mb.done:
+				return
+			}
+		}
+		b := mb.pending[0]
+		mb.pending = mb.pending[1:]
+		mb.lock.Unlock()
+
+		select {
+		case mb.recvCh <- b:
+		case <-mb.done:
+			return
+		}
+	}
+}
+
+func (mb *mailbox) isClosed() bool {
+	mb.lock.Lock()
+	defer mb.lock.Unlock()
+	return mb.closed
+}
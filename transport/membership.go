@@ -0,0 +1,153 @@
+package transport
+
+import "fmt"
+
+// Membership is implemented by transports whose set of peers can change while
+// they run.
+type Membership interface {
+	// AddPeer makes peer id reachable at addr, replacing its old address
+	AddPeer(id int, addr string) error
+	RemovePeer(id int)
+	// PeerAddr returns the address peer id is reached at
+	PeerAddr(id int) (string, bool)
+}
+
+// AddPeer adds peer to t if t supports membership changes. Otherwise it
+// assumes t already reaches every peer.
+func AddPeer(t Transport, id int, addr string) error {
+	if m, ok := t.(Membership); ok {
+		return m.AddPeer(id, addr)
+	}
+	return nil
+}
+
+// RemovePeer removes peer from t if t supports membership changes
+func RemovePeer(t Transport, id int) {
+	if m, ok := t.(Membership); ok {
+		m.RemovePeer(id)
+	}
+}
+
+// PeerAddr returns the address of peer if t knows it
+func PeerAddr(t Transport, id int) (string, bool) {
+	if m, ok := t.(Membership); ok {
+		return m.PeerAddr(id)
+	}
+	return "", false
+}
+
+func (u *UDP) AddPeer(id int, addr string) error {
+	a, err := resolveUDPAddr(addr)
+	if err != nil {
+		return err
+	}
+	u.lock.Lock()
+	u.peers[id] = a
+	u.lock.Unlock()
+	return nil
+}
+
+func (u *UDP) RemovePeer(id int) {
+	u.lock.Lock()
+	delete(u.peers, id)
+	u.lock.Unlock()
+}
+
+func (u *UDP) PeerAddr(id int) (string, bool) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	a, ok := u.peers[id]
+	if !ok {
+		return "", false
+	}
+	return a.String(), true
+}
+
+func (t *TCP) AddPeer(id int, addr string) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if p, ok := t.peers[id]; ok {
+		if p.addr == addr {
+			return nil
+		}
+		close(p.removed)
+	}
+	t.addPeer(id, addr)
+	return nil
+}
+
+// RemovePeer drops messages still queued for peer
+func (t *TCP) RemovePeer(id int) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if p, ok := t.peers[id]; ok {
+		close(p.removed)
+		delete(t.peers, id)
+	}
+}
+
+func (t *TCP) PeerAddr(id int) (string, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	p, ok := t.peers[id]
+	if !ok {
+		return "", false
+	}
+	return p.addr, true
+}
+
+// Memory peers are whoever joined the network, so there is nothing to add
+func (m *Memory) AddPeer(id int, addr string) error {
+	return nil
+}
+
+func (m *Memory) RemovePeer(id int) {}
+
+func (m *Memory) PeerAddr(id int) (string, bool) {
+	if _, ok := m.network.node(id); !ok {
+		return "", false
+	}
+	return fmt.Sprintf("memory:%d", id), true
+}
+
+func (r *Reliable) AddPeer(id int, addr string) error {
+	return AddPeer(r.inner, id, addr)
+}
+
+// RemovePeer stops retransmitting to peer. What was received from it is
+// remembered, a peer which is added again may go on with its session.
+func (r *Reliable) RemovePeer(id int) {
+	r.lock.Lock()
+	r.forget(id)
+	r.lock.Unlock()
+	RemovePeer(r.inner, id)
+}
+
+func (r *Reliable) PeerAddr(id int) (string, bool) {
+	return PeerAddr(r.inner, id)
+}
+
+func (m *Mux) AddPeer(id int, addr string) error {
+	return AddPeer(m.t, id, addr)
+}
+
+func (m *Mux) RemovePeer(id int) {
+	RemovePeer(m.t, id)
+}
+
+func (m *Mux) PeerAddr(id int) (string, bool) {
+	return PeerAddr(m.t, id)
+}
+
+// Peers are shared by all channels of a mux
+func (c *Channel) AddPeer(id int, addr string) error {
+	return c.mux.AddPeer(id, addr)
+}
+
+func (c *Channel) RemovePeer(id int) {
+	c.mux.RemovePeer(id)
+}
+
+func (c *Channel) PeerAddr(id int) (string, bool) {
+	return c.mux.PeerAddr(id)
+}
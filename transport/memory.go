@@ -0,0 +1,62 @@
+package transport
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Network connects Memory transports of nodes living in the same process.
+type Network struct {
+	lock  *sync.Mutex
+	nodes map[int]*Memory
+}
+
+func NewNetwork() *Network {
+	return &Network{lock: &sync.Mutex{}, nodes: map[int]*Memory{}}
+}
+
+// Join attaches node id to the network and returns its transport
+func (n *Network) Join(id int) *Memory {
+	m := &Memory{id: id, network: n, mailbox: newMailbox()}
+	n.lock.Lock()
+	n.nodes[id] = m
+	n.lock.Unlock()
+	return m
+}
+
+func (n *Network) node(id int) (*Memory, bool) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	m, ok := n.nodes[id]
+	return m, ok
+}
+
+// Memory delivers messages through channels. Send never blocks, every node has
+// an unbounded mailbox which is drained in the order messages were sent.
+type Memory struct {
+	id      int
+	network *Network
+	mailbox *mailbox
+}
+
+func (m *Memory) Send(nodeID int, b []byte) error {
+	peer, ok := m.network.node(nodeID)
+	if !ok {
+		return fmt.Errorf("unknown peer %d", nodeID)
+	}
+	c := make([]byte, len(b))
+	copy(c, b)
+	if !peer.mailbox.put(c) {
+		return fmt.Errorf("peer %d is closed", nodeID)
+	}
+	return nil
+}
+
+func (m *Memory) Receive() <-chan []byte {
+	return m.mailbox.recvCh
+}
+
+func (m *Memory) Close() error {
+	m.mailbox.close()
+	return nil
+}
@@ -0,0 +1,117 @@
+package transport
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+)
+
+var ErrChannelClosed = errors.New("channel is closed")
+
+type muxFrame struct {
+	Channel string          `json:"channel"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// Mux carries any number of named channels over one transport. Each channel is
+// a Transport of its own, so an algorithm node can run on it unchanged.
+// Messages keep their order within a channel. Payloads must be JSON, like
+// every message the algorithms send.
+type Mux struct {
+	t        Transport
+	lock     *sync.Mutex
+	channels map[string]*Channel
+	onNew    func(name string)
+	done     chan struct{}
+}
+
+// NewMux starts reading from t. onNew, if not nil, is called the first time a
+// message arrives for a channel which was not opened yet. The channel is
+// created before onNew is called and buffers the message until it is read.
+func NewMux(t Transport, onNew func(name string)) *Mux {
+	m := &Mux{t: t, lock: &sync.Mutex{}, channels: map[string]*Channel{}, onNew: onNew, done: make(chan struct{})}
+	go m.readLoop()
+	return m
+}
+
+// Channel returns the channel called name, opening it if needed
+func (m *Mux) Channel(name string) *Channel {
+	c, _ := m.channel(name)
+	return c
+}
+
+func (m *Mux) channel(name string) (*Channel, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if c, ok := m.channels[name]; ok {
+		return c, false
+	}
+	c := &Channel{name: name, mux: m, mailbox: newMailbox()}
+	select {
+	case <-m.done:
+		c.mailbox.close()
+	default:
+	}
+	m.channels[name] = c
+	return c, true
+}
+
+func (m *Mux) readLoop() {
+	defer func() {
+		m.lock.Lock()
+		close(m.done)
+		for _, c := range m.channels {
+			c.mailbox.close()
+		}
+		m.lock.Unlock()
+	}()
+	for b := range m.t.Receive() {
+		var f muxFrame
+		if err := json.Unmarshal(b, &f); err != nil {
+			continue
+		}
+		c, created := m.channel(f.Channel)
+		if created && m.onNew != nil {
+			m.onNew(f.Channel)
+		}
+		c.mailbox.put(f.Payload)
+	}
+}
+
+// Close closes the underlying transport and with it every channel
+func (m *Mux) Close() error {
+	return m.t.Close()
+}
+
+// Channel is one named stream of a Mux
+type Channel struct {
+	name    string
+	mux     *Mux
+	mailbox *mailbox
+}
+
+func (c *Channel) Name() string {
+	return c.name
+}
+
+func (c *Channel) Send(nodeID int, b []byte) error {
+	if c.mailbox.isClosed() {
+		return ErrChannelClosed
+	}
+	f, err := json.Marshal(muxFrame{Channel: c.name, Payload: b})
+	if err != nil {
+		return err
+	}
+	return c.mux.t.Send(nodeID, f)
+}
+
+func (c *Channel) Receive() <-chan []byte {
+	return c.mailbox.recvCh
+}
+
+// Close stops delivery on this channel only. Messages which arrive for it
+// later are dropped.
+func (c *Channel) Close() error {
+	c.mailbox.close()
+	return nil
+}
@@ -0,0 +1,265 @@
+package transport
+
+import (
+	"distributed-lock-example/logger"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// RetryInterval is how long Reliable waits for an ack before sending a message
+// again. It doubles on every retry, up to MaxRetryInterval. These tunables are
+// read when a Reliable is created.
+var RetryInterval = 200 * time.Millisecond
+var MaxRetryInterval = 5 * time.Second
+
+// GiveUpAfter is how long Reliable retransmits a message before it drops it,
+// and everything else queued for the same peer. 0 means never.
+var GiveUpAfter = time.Minute
+
+type envelope struct {
+	From    int             `json:"from"`
+	To      int             `json:"to"` // id the sender addressed. a peer may be known by more than one
+	Session int64           `json:"session"`
+	Seq     uint64          `json:"seq,omitempty"`
+	Ack     uint64          `json:"ack,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+type outgoing struct {
+	b        []byte
+	sent     time.Time
+	interval time.Duration
+	due      time.Time
+}
+
+type incoming struct {
+	session   int64
+	delivered uint64 // every seq up to this one was delivered
+	buffered  map[uint64][]byte
+}
+
+// stream is what a sender sends to one id
+type stream struct {
+	from int
+	to   int
+}
+
+// Reliable turns a lossy transport into one that delivers every message
+// exactly once and in the order it was sent. Messages get per peer sequence
+// numbers and are retransmitted with backoff until the peer acks them.
+// Duplicates are dropped and out of order messages are held back until the gap
+// is filled. Messages ready for delivery wait in a mailbox, so a slow reader
+// doesn't hold back acks.
+//
+// Every Reliable picks a new session for each peer it sends to, so a restarted
+// peer starts its sequence numbers over without its messages being taken for
+// duplicates. When a message is given up on, the next one to the same peer
+// starts a new session, so the peer doesn't wait for the lost one forever.
+type Reliable struct {
+	id       int
+	inner    Transport
+	lock     *sync.Mutex
+	sessions map[int]int64
+	ended    map[int]int64 // last session of peers, so a new one is greater
+	nextSeq  map[int]uint64
+	unacked  map[int]map[uint64]*outgoing
+	peers    map[stream]*incoming
+	mailbox  *mailbox
+	done     chan struct{}
+	once     *sync.Once
+	log      *logger.Logger
+	retry    time.Duration // RetryInterval
+	maxRetry time.Duration // MaxRetryInterval
+	giveUp   time.Duration // GiveUpAfter
+}
+
+// NewReliable wraps t. payloads sent through it must be valid JSON
+func NewReliable(id int, t Transport) *Reliable {
+	r := &Reliable{id: id, inner: t,
+		lock:     &sync.Mutex{},
+		sessions: map[int]int64{},
+		ended:    map[int]int64{},
+		nextSeq:  map[int]uint64{},
+		unacked:  map[int]map[uint64]*outgoing{},
+		peers:    map[stream]*incoming{},
+		mailbox:  newMailbox(),
+		done:     make(chan struct{}),
+		once:     &sync.Once{},
+		log:      &logger.Logger{Prefix: fmt.Sprintf("[%d]", id)},
+		retry:    RetryInterval,
+		maxRetry: MaxRetryInterval,
+		giveUp:   GiveUpAfter,
+	}
+	go r.receiveLoop()
+	go r.retransmitLoop()
+	return r
+}
+
+// Send hands the message to the underlying transport. An error is returned if
+// the first attempt fails, the message is retransmitted regardless.
+func (r *Reliable) Send(nodeID int, b []byte) error {
+	r.lock.Lock()
+	r.nextSeq[nodeID]++
+	seq := r.nextSeq[nodeID]
+	env, _ := json.Marshal(envelope{From: r.id, To: nodeID, Session: r.session(nodeID), Seq: seq, Payload: b})
+	if r.unacked[nodeID] == nil {
+		r.unacked[nodeID] = map[uint64]*outgoing{}
+	}
+	now := time.Now()
+	r.unacked[nodeID][seq] = &outgoing{b: env, sent: now, interval: r.retry, due: now.Add(r.retry)}
+	r.lock.Unlock()
+
+	return r.inner.Send(nodeID, env)
+}
+
+// session returns the session of messages to nodeID, and starts one if there is
+// none. a new session is always greater than the previous one. expects r.lock
+// to be held
+func (r *Reliable) session(nodeID int) int64 {
+	if s, ok := r.sessions[nodeID]; ok {
+		return s
+	}
+	s := time.Now().UnixNano()
+	if last, ok := r.ended[nodeID]; ok && s <= last {
+		s = last + 1
+	}
+	r.sessions[nodeID] = s
+	return s
+}
+
+// forget ends the session with nodeID and drops messages not acked yet.
+// expects r.lock to be held
+func (r *Reliable) forget(nodeID int) {
+	if s, ok := r.sessions[nodeID]; ok {
+		r.ended[nodeID] = s
+	}
+	delete(r.sessions, nodeID)
+	delete(r.unacked, nodeID)
+	delete(r.nextSeq, nodeID)
+}
+
+func (r *Reliable) Receive() <-chan []byte {
+	return r.mailbox.recvCh
+}
+
+func (r *Reliable) Close() error {
+	r.once.Do(func() { close(r.done) })
+	r.mailbox.close()
+	return r.inner.Close()
+}
+
+func (r *Reliable) receiveLoop() {
+	defer r.mailbox.close()
+	for b := range r.inner.Receive() {
+		var env envelope
+		if err := json.Unmarshal(b, &env); err != nil {
+			continue
+		}
+		if env.Seq == 0 {
+			r.handleAck(env)
+			continue
+		}
+
+		ack, _ := json.Marshal(envelope{From: r.id, To: env.To, Session: env.Session, Ack: env.Seq})
+		r.inner.Send(env.From, ack)
+
+		for _, p := range r.accept(env) {
+			if !r.mailbox.put(p) {
+				return
+			}
+		}
+	}
+}
+
+func (r *Reliable) handleAck(env envelope) {
+	r.lock.Lock()
+	if s, ok := r.sessions[env.To]; ok && s == env.Session {
+		delete(r.unacked[env.To], env.Ack)
+	}
+	r.lock.Unlock()
+}
+
+// accept records env and returns payloads which are ready to be delivered
+func (r *Reliable) accept(env envelope) [][]byte {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	key := stream{from: env.From, to: env.To}
+	in := r.peers[key]
+	if in == nil || env.Session > in.session {
+		in = &incoming{session: env.Session, buffered: map[uint64][]byte{}}
+		r.peers[key] = in
+	}
+	if env.Session < in.session || env.Seq <= in.delivered {
+		return nil // from an old session or already delivered
+	}
+	in.buffered[env.Seq] = env.Payload
+
+	ready := [][]byte{}
+	for {
+		p, ok := in.buffered[in.delivered+1]
+		if !ok {
+			break
+		}
+		delete(in.buffered, in.delivered+1)
+		in.delivered++
+		ready = append(ready, p)
+	}
+	return ready
+}
+
+func (r *Reliable) retransmitLoop() {
+	ticker := time.NewTicker(r.retry / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.done:
+			return
+		case now := <-ticker.C:
+			type retry struct {
+				nodeID int
+				b      []byte
+			}
+			retries := []retry{}
+			r.lock.Lock()
+			for nodeID, pending := range r.unacked {
+				if r.expired(pending, now) {
+					r.log.Printf("❗️ no ack from %d for %v. dropping %d messages to it", nodeID, r.giveUp, len(pending))
+					r.forget(nodeID)
+					continue
+				}
+				for _, o := range pending {
+					if now.Before(o.due) {
+						continue
+					}
+					retries = append(retries, retry{nodeID, o.b})
+					o.interval *= 2
+					if o.interval > r.maxRetry {
+						o.interval = r.maxRetry
+					}
+					o.due = now.Add(o.interval)
+				}
+			}
+			r.lock.Unlock()
+
+			for _, rt := range retries {
+				r.inner.Send(rt.nodeID, rt.b)
+			}
+		}
+	}
+}
+
+// expired tells if any of pending was sent more than GiveUpAfter ago
+func (r *Reliable) expired(pending map[uint64]*outgoing, now time.Time) bool {
+	if r.giveUp == 0 {
+		return false
+	}
+	for _, o := range pending {
+		if now.Sub(o.sent) > r.giveUp {
+			return true
+		}
+	}
+	return false
+}
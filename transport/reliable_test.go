@@ -0,0 +1,196 @@
+package transport
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+// cut drops everything sent through it while down is set
+type cut struct {
+	Transport
+	lock *sync.Mutex
+	down bool
+}
+
+func (c *cut) Send(nodeID int, b []byte) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.down {
+		return nil
+	}
+	return c.Transport.Send(nodeID, b)
+}
+
+func (c *cut) set(down bool) {
+	c.lock.Lock()
+	c.down = down
+	c.lock.Unlock()
+}
+
+// flaky drops, duplicates and reorders what is sent through it. choices come
+// from a seeded generator, so a run makes the same ones for the same sends.
+type flaky struct {
+	Transport
+	lock *sync.Mutex
+	rand *rand.Rand
+	held map[int][]byte // overtaken by the next message to the node
+}
+
+func newFlaky(t Transport, seed int64) *flaky {
+	return &flaky{Transport: t, lock: &sync.Mutex{}, rand: rand.New(rand.NewSource(seed)), held: map[int][]byte{}}
+}
+
+func (f *flaky) Send(nodeID int, b []byte) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	switch p := f.rand.Float64(); {
+	case p < 0.3:
+		return nil
+	case p < 0.45:
+		f.Transport.Send(nodeID, b)
+	case p < 0.6 && f.held[nodeID] == nil:
+		f.held[nodeID] = b
+		return nil
+	}
+	err := f.Transport.Send(nodeID, b)
+	if held := f.held[nodeID]; held != nil {
+		delete(f.held, nodeID)
+		f.Transport.Send(nodeID, held)
+	}
+	return err
+}
+
+func receive(t *testing.T, r *Reliable) string {
+	select {
+	case b := <-r.Receive():
+		return string(b)
+	case <-time.After(2 * time.Second):
+		t.Fatal("nothing received")
+		return ""
+	}
+}
+
+func TestReliableGivesUp(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer func(retry time.Duration, giveUp time.Duration) {
+		RetryInterval, GiveUpAfter = retry, giveUp
+	}(RetryInterval, GiveUpAfter)
+	RetryInterval = 10 * time.Millisecond
+	GiveUpAfter = 100 * time.Millisecond
+
+	network := NewNetwork()
+	link := &cut{Transport: network.Join(0), lock: &sync.Mutex{}, down: true}
+	a := NewReliable(0, link)
+	b := NewReliable(1, network.Join(1))
+	defer a.Close()
+	defer b.Close()
+
+	a.Send(1, []byte(`"lost"`))
+	time.Sleep(GiveUpAfter + 5*RetryInterval)
+	a.lock.Lock()
+	pending := len(a.unacked[1])
+	a.lock.Unlock()
+	if pending != 0 {
+		t.Fatalf("%d messages still retransmitted after GiveUpAfter", pending)
+	}
+
+	// the lost message must not hold back the ones sent after it
+	link.set(false)
+	a.Send(1, []byte(`"first"`))
+	a.Send(1, []byte(`"second"`))
+	for _, want := range []string{`"first"`, `"second"`} {
+		if got := receive(t, b); got != want {
+			t.Fatalf("received %s, want %s", got, want)
+		}
+	}
+}
+
+func TestReliableDeliversInOrderOnce(t *testing.T) {
+	network := NewNetwork()
+	a := NewReliable(0, network.Join(0))
+	b := NewReliable(1, network.Join(1))
+	defer a.Close()
+	defer b.Close()
+
+	// a readded peer starts over, its messages must not be taken for duplicates
+	a.Send(1, []byte(`1`))
+	receive(t, b)
+	a.RemovePeer(1)
+	for _, m := range []string{`2`, `3`, `4`} {
+		a.Send(1, []byte(m))
+	}
+	for _, want := range []string{`2`, `3`, `4`} {
+		if got := receive(t, b); got != want {
+			t.Fatalf("received %s, want %s", got, want)
+		}
+	}
+}
+
+func TestReliableOverLossyLink(t *testing.T) {
+	defer func(retry time.Duration) { RetryInterval = retry }(RetryInterval)
+	RetryInterval = 10 * time.Millisecond
+
+	for _, seed := range []int64{1, 2, 3} {
+		t.Run(fmt.Sprintf("seed %d", seed), func(t *testing.T) {
+			network := NewNetwork()
+			a := NewReliable(0, newFlaky(network.Join(0), seed))
+			b := NewReliable(1, newFlaky(network.Join(1), -seed)) // acks get lost too
+			defer a.Close()
+			defer b.Close()
+
+			const n = 200
+			go func() {
+				for i := 0; i < n; i++ {
+					a.Send(1, []byte(fmt.Sprint(i)))
+				}
+			}()
+			for i := 0; i < n; i++ {
+				if got, want := receive(t, b), fmt.Sprint(i); got != want {
+					t.Fatalf("received %s, want %s", got, want)
+				}
+			}
+			select {
+			case m := <-b.Receive():
+				t.Fatalf("received %s after all messages", m)
+			case <-time.After(20 * RetryInterval):
+			}
+		})
+	}
+}
+
+func TestReliableAcksWhileReaderIsSlow(t *testing.T) {
+	network := NewNetwork()
+	a := NewReliable(0, network.Join(0))
+	b := NewReliable(1, network.Join(1))
+	defer a.Close()
+	defer b.Close()
+
+	const n = 50
+	for i := 0; i < n; i++ {
+		a.Send(1, []byte(fmt.Sprint(i)))
+	}
+	// nobody reads from b yet, its acks must arrive all the same
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		a.lock.Lock()
+		pending := len(a.unacked[1])
+		a.lock.Unlock()
+		if pending == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d messages not acked while the reader is busy", pending)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i := 0; i < n; i++ {
+		if got, want := receive(t, b), fmt.Sprint(i); got != want {
+			t.Fatalf("received %s, want %s", got, want)
+		}
+	}
+}
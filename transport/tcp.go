@@ -0,0 +1,265 @@
+package transport
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// maxFrameSize protects readers from allocating huge buffers for garbage input
+const maxFrameSize = 16 << 20
+
+// DialTimeout and the reconnect intervals are read when a TCP is created
+var DialTimeout = 2 * time.Second
+var MinReconnectInterval = 100 * time.Millisecond
+var MaxReconnectInterval = 5 * time.Second
+
+// TCP keeps one long lived connection to every peer and writes each message as
+// a frame prefixed with its length (4 bytes, big endian). Messages to a peer
+// are delivered in the order they were sent. A broken connection is dialed
+// again with backoff, messages sent in the meantime are queued.
+type TCP struct {
+	listener net.Listener
+	lock     *sync.Mutex
+	peers    map[int]*tcpPeer
+	conns    map[net.Conn]struct{}
+	recvCh   chan []byte
+	done     chan struct{}
+	once     *sync.Once
+	wg       *sync.WaitGroup
+	dial     time.Duration // DialTimeout
+	minRetry time.Duration // MinReconnectInterval
+	maxRetry time.Duration // MaxReconnectInterval
+}
+
+type tcpPeer struct {
+	addr    string
+	lock    *sync.Mutex
+	pending [][]byte
+	notify  chan struct{}
+	removed chan struct{} // closed by RemovePeer
+}
+
+func NewTCP(listenAddr string, peers map[int]string) (*TCP, error) {
+	l, err := net.Listen("tcp4", listenAddr)
+	if err != nil {
+		return nil, err
+	}
+	t := &TCP{listener: l,
+		lock:     &sync.Mutex{},
+		peers:    map[int]*tcpPeer{},
+		conns:    map[net.Conn]struct{}{},
+		recvCh:   make(chan []byte, 64),
+		done:     make(chan struct{}),
+		once:     &sync.Once{},
+		wg:       &sync.WaitGroup{},
+		dial:     DialTimeout,
+		minRetry: MinReconnectInterval,
+		maxRetry: MaxReconnectInterval,
+	}
+	for id, addr := range peers {
+		t.addPeer(id, addr)
+	}
+
+	t.wg.Add(1)
+	go t.acceptLoop()
+	go func() {
+		t.wg.Wait()
+		close(t.recvCh)
+	}()
+	return t, nil
+}
+
+// addPeer expects t.lock to be held, or t not to be shared yet
+func (t *TCP) addPeer(id int, addr string) {
+	p := &tcpPeer{addr: addr, lock: &sync.Mutex{}, notify: make(chan struct{}, 1), removed: make(chan struct{})}
+	t.peers[id] = p
+	go t.writeLoop(p)
+}
+
+func (t *TCP) Send(nodeID int, b []byte) error {
+	if len(b) > maxFrameSize {
+		return fmt.Errorf("message of %d bytes is too large", len(b))
+	}
+	t.lock.Lock()
+	p, ok := t.peers[nodeID]
+	t.lock.Unlock()
+	if !ok {
+		return fmt.Errorf("unknown peer %d", nodeID)
+	}
+	c := make([]byte, len(b))
+	copy(c, b)
+
+	p.lock.Lock()
+	p.pending = append(p.pending, c)
+	p.lock.Unlock()
+	select {
+	case p.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (t *TCP) Receive() <-chan []byte {
+	return t.recvCh
+}
+
+func (t *TCP) Close() error {
+	var err error
+	t.once.Do(func() {
+		close(t.done)
+		err = t.listener.Close()
+		t.lock.Lock()
+		for conn := range t.conns {
+			conn.Close()
+		}
+		t.lock.Unlock()
+	})
+	return err
+}
+
+// next blocks until there is a message for the peer. false means transport is
+// closed or peer is removed
+func (p *tcpPeer) next(done chan struct{}) ([]byte, bool) {
+	for {
+		p.lock.Lock()
+		if len(p.pending) > 0 {
+			b := p.pending[0]
+			p.pending = p.pending[1:]
+			p.lock.Unlock()
+			return b, true
+		}
+		p.lock.Unlock()
+
+		select {
+		case <-p.notify:
+		case <-done:
+			return nil, false
+		case <-p.removed:
+			return nil, false
+		}
+	}
+}
+
+func (t *TCP) writeLoop(p *tcpPeer) {
+	var conn net.Conn
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+
+	backoff := t.minRetry
+	for {
+		b, ok := p.next(t.done)
+		if !ok {
+			return
+		}
+		for {
+			if conn == nil {
+				c, err := net.DialTimeout("tcp4", p.addr, t.dial)
+				if err != nil {
+					select {
+					case <-time.After(backoff):
+					case <-t.done:
+						return
+					case <-p.removed:
+						return
+					}
+					backoff *= 2
+					if backoff > t.maxRetry {
+						backoff = t.maxRetry
+					}
+					continue
+				}
+				conn = c
+				backoff = t.minRetry
+			}
+			if err := writeFrame(conn, b); err != nil {
+				conn.Close()
+				conn = nil
+				continue
+			}
+			break
+		}
+	}
+}
+
+func (t *TCP) acceptLoop() {
+	defer t.wg.Done()
+	for {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			select {
+			case <-t.done:
+				return
+			default:
+				continue
+			}
+		}
+		t.lock.Lock()
+		select {
+		case <-t.done:
+			t.lock.Unlock()
+			conn.Close()
+			return
+		default:
+			t.conns[conn] = struct{}{}
+		}
+		t.lock.Unlock()
+
+		t.wg.Add(1)
+		go t.readLoop(conn)
+	}
+}
+
+func (t *TCP) readLoop(conn net.Conn) {
+	defer t.wg.Done()
+	defer func() {
+		conn.Close()
+		t.lock.Lock()
+		delete(t.conns, conn)
+		t.lock.Unlock()
+	}()
+
+	r := bufio.NewReader(conn)
+	for {
+		b, err := readFrame(r)
+		if err != nil {
+			return
+		}
+		select {
+		case t.recvCh <- b:
+		case <-t.done:
+			return
+		}
+	}
+}
+
+func writeFrame(w io.Writer, b []byte) error {
+	frame := make([]byte, 4+len(b))
+	binary.BigEndian.PutUint32(frame, uint32(len(b)))
+	copy(frame[4:], b)
+	_, err := w.Write(frame)
+	return err
+}
+
+func readFrame(r io.Reader) ([]byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header)
+	if size > maxFrameSize {
+		return nil, fmt.Errorf("frame of %d bytes is too large", size)
+	}
+	b := make([]byte, size)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
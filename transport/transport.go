@@ -0,0 +1,9 @@
+package transport
+
+// Transport carries algorithm messages between nodes. Peers are addressed by
+// node ID, so algorithms never deal with network addresses themselves.
+type Transport interface {
+	Send(nodeID int, b []byte) error
+	Receive() <-chan []byte
+	Close() error
+}
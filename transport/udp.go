@@ -0,0 +1,99 @@
+package transport
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+// maxDatagramSize is the largest payload a single UDP datagram can carry
+const maxDatagramSize = 65507
+
+// UDP sends every message as a single datagram from its listening socket.
+// No connection is dialed per message.
+type UDP struct {
+	conn   *net.UDPConn
+	peers  map[int]*net.UDPAddr
+	lock   *sync.Mutex
+	recvCh chan []byte
+	closed bool
+}
+
+func NewUDP(listenAddr string, peers map[int]string) (*UDP, error) {
+	s, err := net.ResolveUDPAddr("udp4", listenAddr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp4", s)
+	if err != nil {
+		return nil, err
+	}
+
+	u := &UDP{conn: conn, peers: map[int]*net.UDPAddr{}, lock: &sync.Mutex{}, recvCh: make(chan []byte, 64)}
+	for id, addr := range peers {
+		a, err := resolveUDPAddr(addr)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		u.peers[id] = a
+	}
+
+	go u.readLoop()
+	return u, nil
+}
+
+func resolveUDPAddr(addr string) (*net.UDPAddr, error) {
+	return net.ResolveUDPAddr("udp4", addr)
+}
+
+func (u *UDP) Send(nodeID int, b []byte) error {
+	if len(b) > maxDatagramSize {
+		return fmt.Errorf("message of %d bytes does not fit in a datagram", len(b))
+	}
+	u.lock.Lock()
+	addr, ok := u.peers[nodeID]
+	u.lock.Unlock()
+	if !ok {
+		return fmt.Errorf("unknown peer %d", nodeID)
+	}
+	_, err := u.conn.WriteToUDP(b, addr)
+	return err
+}
+
+func (u *UDP) Receive() <-chan []byte {
+	return u.recvCh
+}
+
+func (u *UDP) Close() error {
+	u.lock.Lock()
+	u.closed = true
+	u.lock.Unlock()
+	return u.conn.Close()
+}
+
+func (u *UDP) isClosed() bool {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return u.closed
+}
+
+func (u *UDP) readLoop() {
+	defer close(u.recvCh)
+	buffer := make([]byte, maxDatagramSize)
+	for {
+		n, _, err := u.conn.ReadFromUDP(buffer)
+		if err != nil {
+			if u.isClosed() {
+				return
+			}
+			continue
+		}
+		if n == 0 {
+			continue
+		}
+		b := make([]byte, n)
+		copy(b, buffer[:n])
+		u.recvCh <- b
+	}
+}